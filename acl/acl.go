@@ -0,0 +1,250 @@
+// Package acl decides which identities can perform which operations on which configs
+//
+// A policy is a YAML document like:
+//
+//	rules:
+//	  - identities: ["spiffe://example.org/app", "deployer"]
+//	    paths: ["/etc/gonfigd/app/**"]
+//	    verbs: ["get", "watch"]
+//
+// Identities and paths are globs, where * matches within a path segment and ** across segments.
+// Requests not allowed by any rule are denied.
+package acl
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// Get allows reading a config
+	Get Verb = "get"
+	// Watch allows subscribing to changes of a config
+	Watch Verb = "watch"
+	// List allows listing configs
+	List Verb = "list"
+	// Write allows creating, updating and deleting configs
+	Write Verb = "write"
+	// Replicate allows streaming every config and its changes, i.e: to a follower
+	Replicate Verb = "replicate"
+	// Admin allows exporting and restoring snapshots of every config
+	Admin Verb = "admin"
+	// Any allows every verb
+	Any Verb = "*"
+)
+
+var supportedVerbs map[Verb]struct{} = map[Verb]struct{}{
+	Get:       {},
+	Watch:     {},
+	List:      {},
+	Write:     {},
+	Replicate: {},
+	Admin:     {},
+	Any:       {},
+}
+
+// Verb is an operation over a config
+type Verb string
+
+// Rule grants verbs over paths to identities
+type Rule struct {
+	Identities []string `yaml:"identities"`
+	Paths      []string `yaml:"paths"`
+	Verbs      []Verb   `yaml:"verbs"`
+
+	identities []*regexp.Regexp
+	paths      []*regexp.Regexp
+}
+
+// Policy is a set of rules
+type Policy struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// globToRegexp translates a glob where * does not cross / boundaries and ** does
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func compileGlobs(globs []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(globs))
+	for _, g := range globs {
+		re, err := globToRegexp(g)
+		if err != nil {
+			return nil, NewInvalidPolicyError(fmt.Sprintf("invalid glob %s: %v", g, err))
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePolicy parses and validates a YAML policy
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, NewInvalidPolicyError(err.Error())
+	}
+	for i, r := range p.Rules {
+		if len(r.Identities) == 0 || len(r.Paths) == 0 || len(r.Verbs) == 0 {
+			return nil, NewInvalidPolicyError(fmt.Sprintf("rule %d must have identities, paths and verbs", i))
+		}
+		for _, v := range r.Verbs {
+			if _, ok := supportedVerbs[v]; !ok {
+				return nil, NewInvalidPolicyError(fmt.Sprintf("rule %d has unknown verb %s", i, v))
+			}
+		}
+		var err error
+		if r.identities, err = compileGlobs(r.Identities); err != nil {
+			return nil, err
+		}
+		if r.paths, err = compileGlobs(r.Paths); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (r *Rule) allows(verb Verb) bool {
+	for _, v := range r.Verbs {
+		if v == verb || v == Any {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed checks whether identity can perform verb over path
+func (p *Policy) Allowed(identity string, verb Verb, path string) bool {
+	for _, r := range p.Rules {
+		if r.allows(verb) && matchAny(r.identities, identity) && matchAny(r.paths, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enforcer holds the policy loaded from a file, reloading it when the file changes
+type Enforcer struct {
+	sync.RWMutex
+	file    string
+	policy  *Policy
+	modTime time.Time
+	log     zerolog.Logger
+}
+
+// NewEnforcer returns a new *Enforcer with the policy in file already loaded
+func NewEnforcer(file string, logger zerolog.Logger) (*Enforcer, error) {
+	e := &Enforcer{file: file, log: logger}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// File returns the policy file currently enforced
+func (e *Enforcer) File() string {
+	e.RLock()
+	defer e.RUnlock()
+	return e.file
+}
+
+// Reload reads the policy file again
+// If the new policy is invalid, the previous one is kept
+func (e *Enforcer) Reload() error {
+	return e.SetFile(e.File())
+}
+
+// SetFile loads the policy in file, enforcing it and watching file from now on
+// If the new policy is invalid, the previous one and its file are kept
+func (e *Enforcer) SetFile(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return NewInvalidPolicyError(err.Error())
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return NewInvalidPolicyError(err.Error())
+	}
+	p, err := ParsePolicy(data)
+	if err != nil {
+		return err
+	}
+	e.Lock()
+	e.file = file
+	e.policy = p
+	e.modTime = fi.ModTime()
+	e.Unlock()
+	return nil
+}
+
+func (e *Enforcer) changed() bool {
+	fi, err := os.Stat(e.File())
+	if err != nil {
+		return false
+	}
+	e.RLock()
+	defer e.RUnlock()
+	return !fi.ModTime().Equal(e.modTime)
+}
+
+// Allowed checks whether identity can perform verb over path with the current policy
+func (e *Enforcer) Allowed(identity string, verb Verb, path string) bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.policy.Allowed(identity, verb, path)
+}
+
+// Watch checks the policy file every interval, reloading it when it changes
+func (e *Enforcer) Watch(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+			if !e.changed() {
+				break
+			}
+			if err := e.Reload(); err != nil {
+				e.log.Error().Msgf("failed to reload ACL policy, keeping the previous one: %v", err)
+				break
+			}
+			e.log.Info().Msgf("ACL policy reloaded from %s", e.File())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
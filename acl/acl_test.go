@@ -0,0 +1,84 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+rules:
+  - identities: ["spiffe://example.org/app"]
+    paths: ["/configs/app/**"]
+    verbs: ["get", "watch"]
+  - identities: ["deploy-*"]
+    paths: ["/configs/*.yaml"]
+    verbs: ["*"]
+`
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	assert.Nil(t, err)
+
+	assert.True(t, p.Allowed("spiffe://example.org/app", Get, "/configs/app/db.yaml"))
+	assert.True(t, p.Allowed("spiffe://example.org/app", Watch, "/configs/app/nested/db.yaml"))
+	assert.False(t, p.Allowed("spiffe://example.org/app", Write, "/configs/app/db.yaml"))
+	assert.False(t, p.Allowed("spiffe://example.org/app", Get, "/configs/other.yaml"))
+
+	assert.True(t, p.Allowed("deploy-ci", Write, "/configs/other.yaml"))
+	assert.False(t, p.Allowed("deploy-ci", Write, "/configs/app/db.yaml"))
+	assert.False(t, p.Allowed("anonymous", Get, "/configs/other.yaml"))
+
+	_, err2 := ParsePolicy([]byte("rules:\n  - identities: [\"*\"]\n    paths: [\"**\"]\n    verbs: [\"delete\"]"))
+	assert.EqualError(t, err2, fmt.Sprintf("[%s] Invalid ACL policy: rule 0 has unknown verb delete", InvalidPolicy))
+
+	_, err3 := ParsePolicy([]byte("rules:\n  - identities: [\"*\"]\n    verbs: [\"get\"]"))
+	assert.True(t, IsInvalidPolicyError(err3))
+}
+
+func TestEnforcer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "acl-tests")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.yaml")
+
+	_, err := NewEnforcer(file, zerolog.Nop())
+	assert.True(t, IsInvalidPolicyError(err))
+
+	ioutil.WriteFile(file, []byte(testPolicy), 0644)
+	e, err2 := NewEnforcer(file, zerolog.Nop())
+	assert.Nil(t, err2)
+	assert.False(t, e.Allowed("anonymous", Get, "/configs/foo.yaml"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Watch(ctx, 10*time.Millisecond)
+
+	ioutil.WriteFile(file, []byte("rules:\n  - identities: [\"anonymous\"]\n    paths: [\"**\"]\n    verbs: [\"get\"]"), 0644)
+	future := time.Now().Add(time.Second)
+	os.Chtimes(file, future, future)
+	assert.Eventually(t, func() bool {
+		return e.Allowed("anonymous", Get, "/configs/foo.yaml")
+	}, time.Second, 10*time.Millisecond)
+
+	ioutil.WriteFile(file, []byte("not: [a policy"), 0644)
+	future = future.Add(time.Second)
+	os.Chtimes(file, future, future)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, e.Allowed("anonymous", Get, "/configs/foo.yaml"))
+
+	// Switching to another file keeps the current one when the new policy is invalid
+	other := filepath.Join(dir, "other.yaml")
+	assert.True(t, IsInvalidPolicyError(e.SetFile(other)))
+	assert.Equal(t, file, e.File())
+	ioutil.WriteFile(other, []byte(testPolicy), 0644)
+	assert.Nil(t, e.SetFile(other))
+	assert.Equal(t, other, e.File())
+	assert.False(t, e.Allowed("anonymous", Get, "/configs/foo.yaml"))
+}
@@ -0,0 +1,36 @@
+package acl
+
+import "fmt"
+
+const (
+	InvalidPolicy ErrType = "INVALID_POLICY_ERROR"
+	Unknown       ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidPolicyError struct {
+	errType ErrType
+	reason  string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidPolicyError:
+		return InvalidPolicy
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidPolicyError(e error) bool {
+	return getErrorType(e) == InvalidPolicy
+}
+
+func (e InvalidPolicyError) Error() string {
+	return fmt.Sprintf("[%s] Invalid ACL policy: %s", e.errType, e.reason)
+}
+
+func NewInvalidPolicyError(reason string) InvalidPolicyError {
+	return InvalidPolicyError{errType: InvalidPolicy, reason: reason}
+}
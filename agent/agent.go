@@ -0,0 +1,311 @@
+// Package agent renders configs of a remote gonfigd to local files, for apps only reading files
+//
+// Every template watches a config and writes it to its destination, as is or through a
+// Go template, atomically. Whenever a destination changes, the app is reloaded by running
+// a command and/or signaling a process, no more often than minInterval.
+// An agent config is a YAML document like:
+//
+//	templates:
+//	  - path: /etc/gonfigd/app/db.yaml
+//	    destination: /etc/app/db.yaml
+//	  - path: /etc/gonfigd/app/app.yaml
+//	    destination: /etc/app/app.conf
+//	    template: /etc/app/app.conf.tmpl
+//	    perms: 0600
+//	reload:
+//	  signal: SIGHUP
+//	  pidFile: /run/app.pid
+//	  minInterval: 10s
+//
+// Templates get the config as .Config, and decoded as YAML or JSON as .Value, i.e: {{ .Value.host }}.
+// They can also read other configs, with {{ config "/etc/gonfigd/app/other.yaml" }}, and environment
+// variables, with {{ env "HOME" }}.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/atomicfile"
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultPerms os.FileMode = 0644
+
+// signals are the signals reload can send
+var signals map[string]syscall.Signal = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// Template renders a config to a local file
+type Template struct {
+	// Path is the config to render
+	Path        string `yaml:"path"`
+	Destination string `yaml:"destination"`
+	// Template is a Go template file rendering the config, written as is when empty
+	Template string      `yaml:"template"`
+	Perms    os.FileMode `yaml:"perms"`
+
+	tmpl *template.Template
+}
+
+// ReloadConfig tells how to reload the app when a destination changes
+type ReloadConfig struct {
+	// Command is run with sh -c
+	Command string `yaml:"command"`
+	// Signal is sent to PID, or to the process whose PID is in PIDFile, read on every reload
+	Signal  string `yaml:"signal"`
+	PID     int    `yaml:"pid"`
+	PIDFile string `yaml:"pidFile"`
+	// MinInterval is the minimum time between reloads, changes meanwhile are applied by a single reload
+	MinInterval string `yaml:"minInterval"`
+
+	minInterval time.Duration
+	signal      syscall.Signal
+}
+
+// Config of an Agent
+type Config struct {
+	Templates []*Template  `yaml:"templates"`
+	Reload    ReloadConfig `yaml:"reload"`
+}
+
+// ParseConfig parses and validates an agent config, reading its template files
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, NewInvalidConfigError(err.Error())
+	}
+	if len(cfg.Templates) == 0 {
+		return nil, NewInvalidConfigError("no templates")
+	}
+	destinations := make(map[string]bool, len(cfg.Templates))
+	for i, t := range cfg.Templates {
+		if t.Path == "" || t.Destination == "" {
+			return nil, NewInvalidConfigError(fmt.Sprintf("template %d must have a path and a destination", i))
+		}
+		if destinations[t.Destination] {
+			return nil, NewInvalidConfigError(fmt.Sprintf("destination %s is not unique", t.Destination))
+		}
+		destinations[t.Destination] = true
+		if t.Perms == 0 {
+			t.Perms = defaultPerms
+		}
+	}
+	r := &cfg.Reload
+	if r.Signal != "" {
+		sig, ok := signals[strings.ToUpper(r.Signal)]
+		if !ok {
+			return nil, NewInvalidConfigError(fmt.Sprintf("signal %s is not supported", r.Signal))
+		}
+		if r.PID == 0 && r.PIDFile == "" {
+			return nil, NewInvalidConfigError("signal needs a pid or a pidFile")
+		}
+		r.signal = sig
+	}
+	if r.MinInterval != "" {
+		d, err := time.ParseDuration(r.MinInterval)
+		if err != nil {
+			return nil, NewInvalidConfigError(fmt.Sprintf("minInterval: %v", err))
+		}
+		r.minInterval = d
+	}
+	return cfg, nil
+}
+
+// LoadConfig reads and parses an agent config file
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, NewInvalidConfigError(err.Error())
+	}
+	return ParseConfig(data)
+}
+
+// Configs serves and watches configs, i.e: *client.Client
+type Configs interface {
+	Get(path string) (string, error)
+	OnChange(path string, fn client.ChangeFunc) error
+}
+
+// Agent renders its templates whenever their configs change
+type Agent struct {
+	mu         sync.Mutex
+	cfg        *Config
+	configs    Configs
+	watched    map[string]bool
+	trigger    chan struct{}
+	lastReload time.Time
+	log        zerolog.Logger
+}
+
+// New returns a new *Agent, parsing the template files of cfg
+func New(cfg *Config, configs Configs, logger zerolog.Logger) (*Agent, error) {
+	a := &Agent{
+		cfg:     cfg,
+		configs: configs,
+		watched: make(map[string]bool),
+		trigger: make(chan struct{}, 1),
+		log:     logger,
+	}
+	for _, t := range cfg.Templates {
+		if t.Template == "" {
+			continue
+		}
+		tmpl, err := template.New(filepath.Base(t.Template)).
+			Option("missingkey=error").
+			Funcs(template.FuncMap{"config": a.config, "env": os.Getenv}).
+			ParseFiles(t.Template)
+		if err != nil {
+			return nil, NewInvalidConfigError(err.Error())
+		}
+		t.tmpl = tmpl
+	}
+	return a, nil
+}
+
+// watch triggers a render whenever path changes, the first time it is requested
+func (a *Agent) watch(path string) {
+	a.mu.Lock()
+	if a.watched[path] {
+		a.mu.Unlock()
+		return
+	}
+	a.watched[path] = true
+	a.mu.Unlock()
+	err := a.configs.OnChange(path, func(string, string, bool) {
+		select {
+		case a.trigger <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		a.log.Warn().Msgf("%s is not available yet: %v", path, err)
+	}
+}
+
+// config returns the content of path, watching it, for templates
+func (a *Agent) config(path string) (string, error) {
+	a.watch(path)
+	return a.configs.Get(path)
+}
+
+// render returns the content of the destination of t
+func (a *Agent) render(t *Template) ([]byte, error) {
+	config, err := a.config(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	if t.tmpl == nil {
+		return []byte(config), nil
+	}
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(config), &value); err != nil {
+		value = nil
+	}
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, map[string]interface{}{"Path": t.Path, "Config": config, "Value": value}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// RenderAll renders every template, returning whether any destination changed.
+// Templates failing to render keep their destination untouched.
+func (a *Agent) RenderAll() bool {
+	changed := false
+	for _, t := range a.cfg.Templates {
+		data, err := a.render(t)
+		if err == nil {
+			var c bool
+			if c, err = atomicfile.Write(t.Destination, data, t.Perms); c {
+				a.log.Info().Msgf("%s rendered to %s", t.Path, t.Destination)
+				changed = true
+			}
+		}
+		if err != nil {
+			a.log.Error().Msgf("%v", NewRenderError(t.Destination, err))
+		}
+	}
+	return changed
+}
+
+// Reload runs the reload command and sends the reload signal
+func (a *Agent) Reload(ctx context.Context) error {
+	r := a.cfg.Reload
+	a.lastReload = time.Now()
+	if r.Command != "" {
+		out, err := exec.CommandContext(ctx, "sh", "-c", r.Command).CombinedOutput()
+		if err != nil {
+			return NewReloadError(fmt.Errorf("%s: %v: %s", r.Command, err, strings.TrimSpace(string(out))))
+		}
+	}
+	if r.signal == 0 {
+		return nil
+	}
+	pid := r.PID
+	if r.PIDFile != "" {
+		data, err := ioutil.ReadFile(r.PIDFile)
+		if err != nil {
+			return NewReloadError(err)
+		}
+		if pid, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return NewReloadError(fmt.Errorf("pid file %s: %v", r.PIDFile, err))
+		}
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return NewReloadError(err)
+	}
+	if err := p.Signal(r.signal); err != nil {
+		return NewReloadError(fmt.Errorf("%s to %d: %v", r.Signal, pid, err))
+	}
+	return nil
+}
+
+// Run renders the templates, and again whenever their configs change, reloading the app
+// when a destination changed, until ctx is done
+func (a *Agent) Run(ctx context.Context) error {
+	for _, t := range a.cfg.Templates {
+		a.watch(t.Path)
+	}
+	pending := a.RenderAll()
+	for {
+		var wait <-chan time.Time
+		if pending {
+			wait = time.After(time.Until(a.lastReload.Add(a.cfg.Reload.minInterval)))
+		}
+		select {
+		case <-a.trigger:
+			if a.RenderAll() {
+				pending = true
+			}
+		case <-wait:
+			pending = false
+			if err := a.Reload(ctx); err != nil {
+				a.log.Error().Msgf("%v", err)
+			} else {
+				a.log.Info().Msg("reloaded")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
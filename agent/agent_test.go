@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConfigs is an in-memory Configs
+type fakeConfigs struct {
+	sync.Mutex
+	configs   map[string]string
+	callbacks map[string][]client.ChangeFunc
+}
+
+func newFakeConfigs(configs map[string]string) *fakeConfigs {
+	return &fakeConfigs{configs: configs, callbacks: make(map[string][]client.ChangeFunc)}
+}
+
+func (f *fakeConfigs) Get(path string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	config, ok := f.configs[path]
+	if !ok {
+		return "", client.NewNotFoundError(path, nil)
+	}
+	return config, nil
+}
+
+func (f *fakeConfigs) OnChange(path string, fn client.ChangeFunc) error {
+	f.Lock()
+	defer f.Unlock()
+	f.callbacks[path] = append(f.callbacks[path], fn)
+	return nil
+}
+
+func (f *fakeConfigs) set(path string, config string) {
+	f.Lock()
+	f.configs[path] = config
+	callbacks := f.callbacks[path]
+	f.Unlock()
+	for _, fn := range callbacks {
+		fn(path, config, false)
+	}
+}
+
+func readFile(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+templates:
+  - path: /configs/db.yaml
+    destination: /etc/app/db.yaml
+reload:
+  signal: sighup
+  pid: 1
+  minInterval: 5s
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultPerms, cfg.Templates[0].Perms)
+	assert.Equal(t, 5*time.Second, cfg.Reload.minInterval)
+
+	invalid := []string{
+		"templates: []",
+		"templates: [{path: /configs/db.yaml}]",
+		"templates: [{path: /a, destination: /b}, {path: /c, destination: /b}]",
+		"templates: [{path: /a, destination: /b}]\nreload: {signal: SIGKILL, pid: 1}",
+		"templates: [{path: /a, destination: /b}]\nreload: {signal: SIGHUP}",
+		"templates: [{path: /a, destination: /b}]\nreload: {minInterval: soon}",
+		"templates: [{path: /a, destination: /b, unknown: true}]",
+	}
+	for _, data := range invalid {
+		_, err := ParseConfig([]byte(data))
+		assert.True(t, IsInvalidConfigError(err), data)
+	}
+}
+
+func TestRenderAll(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "agent-tests")
+	defer os.RemoveAll(dir)
+	tmplFile := filepath.Join(dir, "app.conf.tmpl")
+	ioutil.WriteFile(tmplFile, []byte(`host={{ .Value.host }} cache={{ config "/configs/cache.yaml" }}`), 0644)
+	cfg := &Config{Templates: []*Template{
+		{Path: "/configs/db.yaml", Destination: filepath.Join(dir, "db.yaml"), Perms: 0600},
+		{Path: "/configs/db.yaml", Destination: filepath.Join(dir, "app.conf"), Template: tmplFile, Perms: 0644},
+		{Path: "/configs/missing.yaml", Destination: filepath.Join(dir, "missing.yaml"), Perms: 0644},
+	}}
+	configs := newFakeConfigs(map[string]string{"/configs/db.yaml": "host: db\n", "/configs/cache.yaml": "ttl: 1"})
+	a, err := New(cfg, configs, zerolog.Nop())
+	assert.Nil(t, err)
+
+	assert.True(t, a.RenderAll())
+	assert.Equal(t, "host: db\n", readFile(t, filepath.Join(dir, "db.yaml")))
+	assert.Equal(t, "host=db cache=ttl: 1", readFile(t, filepath.Join(dir, "app.conf")))
+	info, _ := os.Stat(filepath.Join(dir, "db.yaml"))
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	// Templates failing to render are not written
+	_, err = os.Stat(filepath.Join(dir, "missing.yaml"))
+	assert.True(t, os.IsNotExist(err))
+	// Configs read by templates are watched too
+	assert.Len(t, configs.callbacks["/configs/cache.yaml"], 1)
+
+	// Unchanged destinations are not written again
+	assert.False(t, a.RenderAll())
+	configs.set("/configs/cache.yaml", "ttl: 2")
+	assert.True(t, a.RenderAll())
+	assert.Equal(t, "host=db cache=ttl: 2", readFile(t, filepath.Join(dir, "app.conf")))
+
+	// A config the template cannot render keeps the destination untouched
+	configs.set("/configs/db.yaml", "port: 5432\n")
+	assert.True(t, a.RenderAll())
+	assert.Equal(t, "port: 5432\n", readFile(t, filepath.Join(dir, "db.yaml")))
+	assert.Equal(t, "host=db cache=ttl: 2", readFile(t, filepath.Join(dir, "app.conf")))
+}
+
+func TestRun(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "agent-tests")
+	defer os.RemoveAll(dir)
+	reloads := filepath.Join(dir, "reloads")
+	cfg, err := ParseConfig([]byte(`
+templates:
+  - path: /configs/db.yaml
+    destination: ` + filepath.Join(dir, "db.yaml") + `
+reload:
+  command: echo reload >> ` + reloads + `
+  minInterval: 500ms
+`))
+	assert.Nil(t, err)
+	configs := newFakeConfigs(map[string]string{"/configs/db.yaml": "port: 1"})
+	a, err := New(cfg, configs, zerolog.Nop())
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx) }()
+	countReloads := func() int {
+		data, _ := ioutil.ReadFile(reloads)
+		return strings.Count(string(data), "reload")
+	}
+	assert.Eventually(t, func() bool { return countReloads() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Changes within minInterval are applied by a single reload
+	configs.set("/configs/db.yaml", "port: 2")
+	configs.set("/configs/db.yaml", "port: 3")
+	assert.Eventually(t, func() bool { return readFile(t, filepath.Join(dir, "db.yaml")) == "port: 3" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, countReloads())
+	assert.Eventually(t, func() bool { return countReloads() == 2 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, 2, countReloads())
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestReloadSignal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "agent-tests")
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "app.pid")
+	cfg, err := ParseConfig([]byte("templates: [{path: /a, destination: /b}]\nreload: {signal: SIGUSR1, pidFile: " + pidFile + "}"))
+	assert.Nil(t, err)
+	a, _ := New(cfg, newFakeConfigs(map[string]string{}), zerolog.Nop())
+
+	assert.True(t, IsReloadError(a.Reload(context.Background())))
+	ioutil.WriteFile(pidFile, []byte("not-a-pid\n"), 0644)
+	assert.True(t, IsReloadError(a.Reload(context.Background())))
+}
@@ -0,0 +1,77 @@
+package agent
+
+import "fmt"
+
+const (
+	InvalidConfig ErrType = "INVALID_CONFIG_ERROR"
+	Render        ErrType = "RENDER_ERROR"
+	Reload        ErrType = "RELOAD_ERROR"
+	Unknown       ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidConfigError struct {
+	errType ErrType
+	reason  string
+}
+
+type RenderError struct {
+	errType     ErrType
+	destination string
+	err         error
+}
+
+type ReloadError struct {
+	errType ErrType
+	err     error
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidConfigError:
+		return InvalidConfig
+	case RenderError:
+		return Render
+	case ReloadError:
+		return Reload
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidConfigError(e error) bool {
+	return getErrorType(e) == InvalidConfig
+}
+
+func IsRenderError(e error) bool {
+	return getErrorType(e) == Render
+}
+
+func IsReloadError(e error) bool {
+	return getErrorType(e) == Reload
+}
+
+func (e InvalidConfigError) Error() string {
+	return fmt.Sprintf("[%s] Invalid agent config: %s", e.errType, e.reason)
+}
+
+func (e RenderError) Error() string {
+	return fmt.Sprintf("[%s] %s could not be rendered: %v", e.errType, e.destination, e.err)
+}
+
+func (e ReloadError) Error() string {
+	return fmt.Sprintf("[%s] Reload failed: %v", e.errType, e.err)
+}
+
+func NewInvalidConfigError(reason string) InvalidConfigError {
+	return InvalidConfigError{errType: InvalidConfig, reason: reason}
+}
+
+func NewRenderError(destination string, err error) RenderError {
+	return RenderError{errType: Render, destination: destination, err: err}
+}
+
+func NewReloadError(err error) ReloadError {
+	return ReloadError{errType: Reload, err: err}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fcgravalos/gonfigd/agent"
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/rs/zerolog"
+)
+
+const agentUsage = `Usage: gonfigd agent --config <file> [flags]
+
+  renders the configs of a daemon to local files, reloading the app whenever they change
+`
+
+// agentCommand runs `gonfigd agent` until SIGINT or SIGTERM, returning the exit code
+func agentCommand(args []string) int {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, agentUsage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", "", "YAML agent config, with the templates to render and how to reload the app")
+	addr := fs.String("server-addr", "localhost:8080", "gRPC address of the daemon")
+	caFile := fs.String("ca-file", "", "CA verifying the daemon certificate. Enables TLS")
+	certFile := fs.String("cert-file", "", "Client certificate presented to the daemon running with mTLS")
+	keyFile := fs.String("key-file", "", "Client certificate private key")
+	tokenFile := fs.String("token-file", "", "File with the bearer token sent to the daemon")
+	cacheFile := fs.String("cache-file", "", "File caching the configs, rendered at startup when the daemon is unreachable")
+	debug := fs.Bool("debug", false, "Enable debug logging")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	logger := zerolog.New(os.Stderr).
+		With().
+		Timestamp().
+		Caller().
+		Logger()
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+
+	cfg, err := agent.LoadConfig(*configFile)
+	if err != nil {
+		logger.Error().Msgf("%v", err)
+		return 1
+	}
+	opts, err := client.DialOptions(*caFile, *certFile, *keyFile, *tokenFile)
+	if err != nil {
+		logger.Error().Msgf("failed to configure the connection: %v", err)
+		return 1
+	}
+	c, err := client.New(client.Config{Addr: *addr, DialOptions: opts, CacheFile: *cacheFile, Logger: logger})
+	if err != nil {
+		logger.Error().Msgf("%v", err)
+		return 1
+	}
+	defer c.Close()
+	a, err := agent.New(cfg, c, logger)
+	if err != nil {
+		logger.Error().Msgf("%v", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sigChan
+		logger.Info().Msgf("received %s signal, stopping agent...", s.String())
+		cancel()
+	}()
+	if err := a.Run(ctx); err != nil {
+		logger.Error().Msgf("%v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,266 @@
+package api
+
+import (
+	context "context"
+	"crypto/tls"
+	"path/filepath"
+	"strings"
+
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/fcgravalos/gonfigd/tokens"
+	"github.com/rs/zerolog"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	status "google.golang.org/grpc/status"
+)
+
+// Anonymous is the identity of callers that did not authenticate
+const Anonymous = "anonymous"
+
+// methodVerbs maps every Gonfig RPC to the ACL verb it requires, methods missing are denied
+var methodVerbs map[string]acl.Verb = map[string]acl.Verb{
+	"/Gonfig/GetConfig":       acl.Get,
+	"/Gonfig/WatchConfig":     acl.Watch,
+	"/Gonfig/PutConfig":       acl.Write,
+	"/Gonfig/DeleteConfig":    acl.Write,
+	"/Gonfig/Replicate":       acl.Replicate,
+	"/Gonfig/ExportSnapshot":  acl.Admin,
+	"/Gonfig/RestoreSnapshot": acl.Admin,
+	"/Gonfig/ListConfigs":     acl.List,
+	"/Gonfig/GetHistory":      acl.Get,
+}
+
+// filteredMethods return only the configs the caller is allowed to, instead of being denied
+var filteredMethods map[string]bool = map[string]bool{
+	"/Gonfig/ListConfigs": true,
+}
+
+type authorizerKey struct{}
+
+// allowed checks whether the caller can perform verb over path, everyone can when no Authorizer is enforced
+func allowed(ctx context.Context, verb acl.Verb, path string) bool {
+	a, ok := ctx.Value(authorizerKey{}).(Authorizer)
+	return !ok || a.Allowed(IdentityFromContext(ctx), verb, path)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the caller identity
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the caller identity.
+// An identity explicitly attached with WithIdentity wins, then the one of the client certificate.
+func IdentityFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(identityKey{}).(string); ok {
+		return id
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return Anonymous
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return Anonymous
+	}
+	return IdentityFromTLS(tlsInfo.State)
+}
+
+// IdentityFromTLS returns the first URI, DNS or email SAN of a verified client certificate, then its CN.
+// Connections without a verified client certificate are Anonymous.
+func IdentityFromTLS(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return Anonymous
+	}
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	}
+	return Anonymous
+}
+
+// Authorizer decides whether an identity can perform verb over a config
+type Authorizer interface {
+	Allowed(identity string, verb acl.Verb, path string) bool
+}
+
+type configPathRequest interface {
+	GetConfigPath() string
+}
+
+// denyUnmapped rejects methods without a verb, so RPCs added later are never served unchecked
+func denyUnmapped(identity string, fullMethod string, logger zerolog.Logger) error {
+	logger.Warn().
+		Str("audit", "denied").
+		Str("identity", identity).
+		Str("method", fullMethod).
+		Msg("method not mapped to a verb")
+	return status.Errorf(codes.PermissionDenied, "%s is not mapped to a verb", fullMethod)
+}
+
+func authorize(ctx context.Context, a Authorizer, fullMethod string, req interface{}, logger zerolog.Logger) error {
+	verb, ok := methodVerbs[fullMethod]
+	if !ok {
+		return denyUnmapped(IdentityFromContext(ctx), fullMethod, logger)
+	}
+	path := ""
+	if r, ok := req.(configPathRequest); ok {
+		path = r.GetConfigPath()
+	}
+	// Grants match clean paths, i.e: /configs/app/** must not match /configs/app/../secret.yaml
+	if path != "" && path != filepath.Clean(path) {
+		return status.Errorf(codes.InvalidArgument, "%s is not a clean path", path)
+	}
+	identity := IdentityFromContext(ctx)
+	if !a.Allowed(identity, verb, path) {
+		logger.Warn().
+			Str("audit", "denied").
+			Str("identity", identity).
+			Str("verb", string(verb)).
+			Str("path", path).
+			Str("method", fullMethod).
+			Msg("permission denied")
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed to %s %s", identity, verb, path)
+	}
+	return nil
+}
+
+// AuthorizationUnaryInterceptor rejects unary calls not allowed by the Authorizer
+// Calls to filteredMethods get the Authorizer in their context instead
+func AuthorizationUnaryInterceptor(a Authorizer, logger zerolog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if filteredMethods[info.FullMethod] {
+			return handler(context.WithValue(ctx, authorizerKey{}, a), req)
+		}
+		if err := authorize(ctx, a, info.FullMethod, req, logger); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authorizedStream checks every received message against the Authorizer
+type authorizedStream struct {
+	grpc.ServerStream
+	authorizer Authorizer
+	fullMethod string
+	log        zerolog.Logger
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return authorize(s.Context(), s.authorizer, s.fullMethod, m, s.log)
+}
+
+// AuthorizationStreamInterceptor rejects streams whose requests are not allowed by the Authorizer
+func AuthorizationStreamInterceptor(a Authorizer, logger zerolog.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &authorizedStream{ServerStream: ss, authorizer: a, fullMethod: info.FullMethod, log: logger})
+	}
+}
+
+// Authenticator validates bearer tokens
+type Authenticator interface {
+	Authenticate(token string) (*tokens.Token, error)
+}
+
+// bearerToken returns the token in the authorization metadata, if any
+func bearerToken(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, v := range md.Get("authorization") {
+		if strings.HasPrefix(strings.ToLower(v), "bearer ") {
+			return strings.TrimSpace(v[len("bearer "):]), true
+		}
+	}
+	return "", false
+}
+
+// authenticate returns ctx with the identity of the token owner attached.
+// Calls without a token are left untouched when they are identified by their client certificate,
+// and rejected otherwise, unless allowAnonymous.
+func authenticate(ctx context.Context, a Authenticator, allowAnonymous bool, fullMethod string, logger zerolog.Logger) (context.Context, error) {
+	token, ok := bearerToken(ctx)
+	if !ok {
+		if !allowAnonymous && IdentityFromContext(ctx) == Anonymous {
+			logger.Warn().
+				Str("audit", "unauthenticated").
+				Str("method", fullMethod).
+				Msg("missing bearer token")
+			return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+		}
+		return ctx, nil
+	}
+	t, err := a.Authenticate(token)
+	if err != nil {
+		logger.Warn().
+			Str("audit", "unauthenticated").
+			Str("method", fullMethod).
+			Msg("invalid bearer token")
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	verb, ok := methodVerbs[fullMethod]
+	if !ok {
+		return nil, denyUnmapped(t.Name, fullMethod, logger)
+	}
+	if !t.Allows(verb) {
+		logger.Warn().
+			Str("audit", "denied").
+			Str("identity", t.Name).
+			Str("verb", string(verb)).
+			Str("method", fullMethod).
+			Msg("token scope does not allow verb")
+		return nil, status.Errorf(codes.PermissionDenied, "token %s is not allowed to %s", t.Name, verb)
+	}
+	logger.Debug().Msgf("authenticated %s calling %s", t.Name, fullMethod)
+	return WithIdentity(ctx, t.Name), nil
+}
+
+// AuthenticationUnaryInterceptor validates the bearer token of unary calls
+// Calls with neither a token nor a verified client certificate are rejected, unless allowAnonymous
+func AuthenticationUnaryInterceptor(a Authenticator, allowAnonymous bool, logger zerolog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, a, allowAnonymous, info.FullMethod, logger)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authenticatedStream overrides the stream context with the one carrying the caller identity
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// AuthenticationStreamInterceptor validates the bearer token of streams
+// Streams with neither a token nor a verified client certificate are rejected, unless allowAnonymous
+func AuthenticationStreamInterceptor(a Authenticator, allowAnonymous bool, logger zerolog.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), a, allowAnonymous, info.FullMethod, logger)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
@@ -0,0 +1,306 @@
+package api
+
+import (
+	"bytes"
+	context "context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/tokens"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	status "google.golang.org/grpc/status"
+)
+
+// fakeAuthorizer grants identity the verbs over the paths of a grant
+type fakeAuthorizer map[string]map[acl.Verb][]string
+
+func (fa fakeAuthorizer) Allowed(identity string, verb acl.Verb, path string) bool {
+	for _, p := range fa[identity][verb] {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeStream receives the requests of a WatchConfig stream
+type fakeStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	paths []string
+}
+
+func (fs *fakeStream) Context() context.Context {
+	return fs.ctx
+}
+
+func (fs *fakeStream) RecvMsg(m interface{}) error {
+	m.(*WatchConfigRequest).ConfigPath, fs.paths = fs.paths[0], fs.paths[1:]
+	return nil
+}
+
+// auditLine returns the last line logged to buf
+func auditLine(t *testing.T, buf *bytes.Buffer) map[string]string {
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	line := make(map[string]string)
+	if err := json.Unmarshal(lines[len(lines)-1], &line); err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func okHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	return "ok", nil
+}
+
+func TestAuthorizationUnaryInterceptor(t *testing.T) {
+	const path = "/configs/app.yaml"
+	requests := map[string]interface{}{
+		"/Gonfig/GetConfig":       &GetConfigRequest{ConfigPath: path},
+		"/Gonfig/WatchConfig":     &WatchConfigRequest{ConfigPath: path},
+		"/Gonfig/PutConfig":       &PutConfigRequest{ConfigPath: path},
+		"/Gonfig/DeleteConfig":    &DeleteConfigRequest{ConfigPath: path},
+		"/Gonfig/Replicate":       &ReplicateRequest{},
+		"/Gonfig/ExportSnapshot":  &ExportSnapshotRequest{},
+		"/Gonfig/RestoreSnapshot": &RestoreSnapshotRequest{},
+		"/Gonfig/GetHistory":      &GetHistoryRequest{ConfigPath: path},
+	}
+	for method, verb := range methodVerbs {
+		if filteredMethods[method] {
+			continue
+		}
+		req, ok := requests[method]
+		if !assert.True(t, ok, method) {
+			continue
+		}
+		reqPath := ""
+		if r, ok := req.(configPathRequest); ok {
+			reqPath = r.GetConfigPath()
+		}
+		var buf bytes.Buffer
+		a := fakeAuthorizer{"alice": {verb: {reqPath}}, "bob": {acl.Get: {path}, acl.List: {path}}}
+		interceptor := AuthorizationUnaryInterceptor(a, zerolog.New(&buf))
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+
+		resp, err := interceptor(WithIdentity(context.Background(), "alice"), req, info, okHandler)
+		assert.Nil(t, err, method)
+		assert.Equal(t, "ok", resp, method)
+
+		identity := "bob"
+		if verb == acl.Get {
+			identity = "mallory"
+		}
+		_, err = interceptor(WithIdentity(context.Background(), identity), req, info, okHandler)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err), method)
+		assert.Equal(t, map[string]string{
+			"level":    "warn",
+			"audit":    "denied",
+			"identity": identity,
+			"verb":     string(verb),
+			"path":     reqPath,
+			"method":   method,
+			"message":  "permission denied",
+		}, auditLine(t, &buf), method)
+	}
+
+	// Paths are checked clean, as they are written
+	a := fakeAuthorizer{"alice": {acl.Write: {"/configs/app/../secret.yaml", "/configs/secret.yaml"}}}
+	called := false
+	_, err := AuthorizationUnaryInterceptor(a, zerolog.Nop())(WithIdentity(context.Background(), "alice"),
+		&PutConfigRequest{ConfigPath: "/configs/app/../secret.yaml"}, &grpc.UnaryServerInfo{FullMethod: "/Gonfig/PutConfig"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			called = true
+			return nil, nil
+		})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.False(t, called)
+
+	// Methods not mapped to a verb are denied
+	interceptor := AuthorizationUnaryInterceptor(fakeAuthorizer{"alice": {acl.Admin: {""}}}, zerolog.Nop())
+	_, err = interceptor(WithIdentity(context.Background(), "alice"), &GetConfigRequest{}, &grpc.UnaryServerInfo{FullMethod: "/Gonfig/NewMethod"}, okHandler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestMethodVerbs(t *testing.T) {
+	// Every RPC of the service must be mapped to a verb, otherwise it is denied to everyone
+	var methods []string
+	for _, m := range _Gonfig_serviceDesc.Methods {
+		methods = append(methods, fmt.Sprintf("/%s/%s", _Gonfig_serviceDesc.ServiceName, m.MethodName))
+	}
+	for _, s := range _Gonfig_serviceDesc.Streams {
+		methods = append(methods, fmt.Sprintf("/%s/%s", _Gonfig_serviceDesc.ServiceName, s.StreamName))
+	}
+	for _, m := range methods {
+		_, ok := methodVerbs[m]
+		assert.True(t, ok, m)
+	}
+	assert.Len(t, methodVerbs, len(methods))
+}
+
+func TestAuthorizationStreamInterceptor(t *testing.T) {
+	var buf bytes.Buffer
+	a := fakeAuthorizer{"alice": {acl.Watch: {"/configs/app.yaml"}}}
+	interceptor := AuthorizationStreamInterceptor(a, zerolog.New(&buf))
+	ss := &fakeStream{ctx: WithIdentity(context.Background(), "alice"), paths: []string{"/configs/app.yaml", "/configs/db.yaml"}}
+
+	// Every message received is checked
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: "/Gonfig/WatchConfig"}, func(srv interface{}, stream grpc.ServerStream) error {
+		var req WatchConfigRequest
+		assert.Nil(t, stream.RecvMsg(&req))
+		err := stream.RecvMsg(&req)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		return err
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	line := auditLine(t, &buf)
+	assert.Equal(t, "denied", line["audit"])
+	assert.Equal(t, "/configs/db.yaml", line["path"])
+}
+
+func TestListConfigsFiltering(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	for _, k := range []string{"/configs/app.yaml", "/configs/db.yaml"} {
+		v, _ := kv.NewValue([]byte("foo: bar"))
+		db.Put(k, v)
+	}
+	s := NewServer(db, ps, nil, nil, zerolog.Nop())
+	a := fakeAuthorizer{"alice": {acl.List: {"/configs/app.yaml"}}}
+	interceptor := AuthorizationUnaryInterceptor(a, zerolog.Nop())
+	list := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.ListConfigs(ctx, req.(*ListConfigsRequest))
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/Gonfig/ListConfigs"}
+
+	resp, err := interceptor(WithIdentity(context.Background(), "alice"), &ListConfigsRequest{Prefix: "/configs"}, info, list)
+	assert.Nil(t, err)
+	configs := resp.(*ListConfigsResponse).Configs
+	assert.Len(t, configs, 1)
+	assert.Equal(t, "/configs/app.yaml", configs[0].ConfigPath)
+
+	// Denied identities get an empty list instead of an error
+	resp2, err := interceptor(WithIdentity(context.Background(), "bob"), &ListConfigsRequest{Prefix: "/configs"}, info, list)
+	assert.Nil(t, err)
+	assert.Empty(t, resp2.(*ListConfigsResponse).Configs)
+
+	// Without an Authorizer everything is listed
+	resp3, err := s.ListConfigs(context.Background(), &ListConfigsRequest{Prefix: "/configs"})
+	assert.Nil(t, err)
+	assert.Len(t, resp3.Configs, 2)
+}
+
+type fakeAuthenticator map[string]*tokens.Token
+
+func (fa fakeAuthenticator) Authenticate(token string) (*tokens.Token, error) {
+	t, ok := fa[token]
+	if !ok {
+		return nil, tokens.NewInvalidTokenError()
+	}
+	return t, nil
+}
+
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+// withClientCert returns a context with the peer of a connection with a verified client certificate
+func withClientCert(cn string) context.Context {
+	state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+func TestAuthenticationUnaryInterceptor(t *testing.T) {
+	a := fakeAuthenticator{
+		"r3ad": {Name: "reader", Scopes: []acl.Verb{acl.Get, acl.List}},
+		"4ll":  {Name: "alice", Scopes: []acl.Verb{acl.Any}},
+	}
+	var buf bytes.Buffer
+	authn := AuthenticationUnaryInterceptor(a, false, zerolog.New(&buf))
+	authz := AuthorizationUnaryInterceptor(fakeAuthorizer{"alice": {acl.Write: {"/configs/app.yaml"}}}, zerolog.Nop())
+	info := &grpc.UnaryServerInfo{FullMethod: "/Gonfig/PutConfig"}
+	req := &PutConfigRequest{ConfigPath: "/configs/app.yaml"}
+	// chain runs the authorization interceptor after the authentication one, like gonfigd does
+	chain := func(ctx context.Context, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+		return authn(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return authz(ctx, req, info, handler)
+		})
+	}
+
+	_, err := chain(withToken("wrong"), req, okHandler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, "unauthenticated", auditLine(t, &buf)["audit"])
+
+	_, err = chain(withToken("r3ad"), req, okHandler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	line := auditLine(t, &buf)
+	assert.Equal(t, "denied", line["audit"])
+	assert.Equal(t, "reader", line["identity"])
+	assert.Equal(t, "write", line["verb"])
+
+	// The token owner is the identity authorized
+	var identity string
+	_, err = chain(withToken("4ll"), req, func(ctx context.Context, req interface{}) (interface{}, error) {
+		identity = IdentityFromContext(ctx)
+		return "ok", nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", identity)
+
+	// Without a token, callers need a client certificate
+	_, err = chain(context.Background(), req, okHandler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = chain(withClientCert("agent"), req, okHandler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = AuthenticationUnaryInterceptor(a, false, zerolog.Nop())(withClientCert("agent"), req, info, okHandler)
+	assert.Nil(t, err)
+
+	// Unless anonymous callers are allowed
+	resp, err := AuthenticationUnaryInterceptor(a, true, zerolog.Nop())(context.Background(), req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return IdentityFromContext(ctx), nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Anonymous, resp)
+}
+
+func TestAuthenticationStreamInterceptor(t *testing.T) {
+	a := fakeAuthenticator{"w4tch": {Name: "alice", Scopes: []acl.Verb{acl.Watch}}}
+	authn := AuthenticationStreamInterceptor(a, false, zerolog.Nop())
+	authz := AuthorizationStreamInterceptor(fakeAuthorizer{"alice": {acl.Watch: {"/configs/app.yaml"}}}, zerolog.Nop())
+	info := &grpc.StreamServerInfo{FullMethod: "/Gonfig/WatchConfig"}
+
+	// The stream context carries the token owner, down to the authorization of every message
+	ss := &fakeStream{ctx: withToken("w4tch"), paths: []string{"/configs/app.yaml"}}
+	err := authn(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		assert.Equal(t, "alice", IdentityFromContext(stream.Context()))
+		return authz(srv, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+			var req WatchConfigRequest
+			return stream.RecvMsg(&req)
+		})
+	})
+	assert.Nil(t, err)
+
+	err = authn(nil, &fakeStream{ctx: withToken("wrong")}, info, func(srv interface{}, stream grpc.ServerStream) error {
+		t.Fatal("the stream should not be handled")
+		return nil
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	err = authn(nil, &fakeStream{ctx: context.Background()}, info, func(srv interface{}, stream grpc.ServerStream) error {
+		t.Fatal("the stream should not be handled")
+		return nil
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
@@ -2,27 +2,115 @@ package api
 
 import (
 	context "context"
+	"sync"
 
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/fcgravalos/gonfigd/configtree"
+	"github.com/fcgravalos/gonfigd/envvars"
+	"github.com/fcgravalos/gonfigd/history"
 	"github.com/fcgravalos/gonfigd/kv"
 	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/snapshot"
+	"github.com/fcgravalos/gonfigd/tracing"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/api/trace"
+	codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
 )
 
+// Renderer transforms the stored content of a config right before serving it
+type Renderer interface {
+	Render(path string, content string) (string, error)
+}
+
+// ReferenceRenderer is a Renderer resolving references to other configs or to the environment.
+// Configs written through the API cannot hold references, as they would be resolved with the
+// permissions of gonfigd instead of the ones of the writer.
+type ReferenceRenderer interface {
+	Renderer
+	HasReferences(content string) bool
+}
+
 type server struct {
 	kv.KV
 	pubsub.PubSub
 	zerolog.Logger
+	writer     *configtree.Writer
+	replicator Replicator
+	history    History
+	renderers  []Renderer
+	// shutdown is closed when the server is shutting down, ending the watch and replication streams
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// History returns the versions of a config, newest first
+type History interface {
+	Versions(key string) []history.Version
+}
+
+// Replicator streams every config and its changes to followers
+type Replicator interface {
+	Replicate(req *ReplicateRequest, stream Gonfig_ReplicateServer) error
+}
+
+// render applies every renderer, in order, to the content of a config
+func (s *server) render(path string, content string) (string, error) {
+	var err error
+	for _, r := range s.renderers {
+		if content, err = r.Render(path, content); err != nil {
+			return "", err
+		}
+	}
+	return content, nil
+}
+
+// FormatEnv is the format of GetConfig serving configs as environment variables
+const FormatEnv = "env"
+
+// formatEnv flattens a config into environment variable lines
+func formatEnv(config string, opts *EnvOptions) (string, error) {
+	casing, err := envvars.ParseCasing(opts.GetCasing())
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	vars, err := envvars.Flatten(config, envvars.Options{Prefix: opts.GetPrefix(), Separator: opts.GetSeparator(), Casing: casing})
+	switch {
+	case envvars.IsInvalidOptionsError(err):
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		return "", status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return envvars.Encode(vars), nil
 }
 
 func (s *server) GetConfig(ctx context.Context, req *GetConfigRequest) (*GetConfigResponse, error) {
+	if req.Format != "" && req.Format != FormatEnv {
+		return nil, status.Errorf(codes.InvalidArgument, "format %s is not supported", req.Format)
+	}
 	cfg, err := s.Get(req.ConfigPath)
 	if err != nil {
-		s.Error().Msgf("error while trying to read %s: %v", req.ConfigPath, err)
+		s.Error().Msgf("error while trying to read %s for %s: %v", req.ConfigPath, IdentityFromContext(ctx), err)
+		if kv.IsKeyNotFoundError(err) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
 		return nil, err
 	}
-	return &GetConfigResponse{Config: cfg.Text()}, nil
+	text, err := s.render(req.ConfigPath, cfg.Text())
+	if err != nil {
+		s.Error().Msgf("error while trying to render %s: %v", req.ConfigPath, err)
+		return nil, err
+	}
+	if req.Format == FormatEnv {
+		if text, err = formatEnv(text, req.Env); err != nil {
+			return nil, err
+		}
+	}
+	return &GetConfigResponse{Config: text}, nil
 }
 
+// WatchConfig streams the events of a config. The header is sent once subscribed.
 func (s *server) WatchConfig(req *WatchConfigRequest, stream Gonfig_WatchConfigServer) error {
 	if !s.TopicExists(req.ConfigPath) {
 		if err := s.CreateTopic(req.ConfigPath); err != nil {
@@ -34,26 +122,236 @@ func (s *server) WatchConfig(req *WatchConfigRequest, stream Gonfig_WatchConfigS
 	sID := sub.ID()
 	sCh := sub.Channel()
 	defer s.UnSubscribe(req.ConfigPath, sID)
+	// The header tells clients they are subscribed, so they can read the config without missing changes
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
 
 	ctx := stream.Context()
+	identity := IdentityFromContext(ctx)
 	for {
+		var ev *pubsub.Event
+		// Events published before the shutdown are sent before it
 		select {
-		case ev := <-sCh:
-			resp := &WatchConfigResponse{
-				SubscriptionID: sID,
-				Event:          ev.String(),
+		case ev = <-sCh:
+		default:
+			select {
+			case ev = <-sCh:
+			case <-s.shutdown:
+				// Watchers are told to reconnect, possibly to another server
+				resp := &WatchConfigResponse{
+					SubscriptionID: sID,
+					Event:          pubsub.NewEvent(pubsub.ServerShuttingDown, req.ConfigPath).String(),
+				}
+				if err := stream.Send(resp); err != nil {
+					s.Error().Msgf("failed to send response %v through stream: %v", resp, err)
+					return err
+				}
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			if err := stream.Send(resp); err != nil {
-				s.Error().Msgf("failed to send response %v through stream: %v", resp, err)
-				return err
-			}
-			s.Info().Msgf("event %s sent to subscription ID %s", resp.Event, resp.SubscriptionID)
+		}
+		// The send span continues the trace of the change, linked to the trace of this call
+		_, span := tracing.Tracer().Start(ev.Context(), "api.WatchConfig.Send",
+			trace.LinkedTo(trace.SpanFromContext(ctx).SpanContext()),
+			trace.WithAttributes(tracing.ConfigPath(req.ConfigPath)))
+		resp := &WatchConfigResponse{
+			SubscriptionID: sID,
+			Event:          ev.String(),
+		}
+		if err := stream.Send(resp); err != nil {
+			s.Error().Msgf("failed to send response %v through stream: %v", resp, err)
+			span.End()
+			return err
+		}
+		span.End()
+		s.Info().Msgf("event %s sent to subscription ID %s of %s", resp.Event, resp.SubscriptionID, identity)
+	}
+}
+
+// writeStatus translates configtree errors into gRPC status errors
+func writeStatus(err error) error {
+	switch {
+	case configtree.IsInvalidPathError(err), configtree.IsInvalidContentError(err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case configtree.IsConflictError(err):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case configtree.IsNotFoundError(err):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// PutConfig writes a config into the configuration tree.
+// The KV is updated, and the event published, by the fswatcher once the file is written.
+func (s *server) PutConfig(ctx context.Context, req *PutConfigRequest) (*PutConfigResponse, error) {
+	if s.writer == nil {
+		return nil, status.Error(codes.Unimplemented, "writes are disabled")
+	}
+	for _, r := range s.renderers {
+		if rr, ok := r.(ReferenceRenderer); ok && rr.HasReferences(req.Config) {
+			return nil, status.Errorf(codes.InvalidArgument, "%s cannot hold references to other configs or the environment", req.ConfigPath)
+		}
+	}
+	sum, err := s.writer.Put(req.ConfigPath, []byte(req.Config), req.ExpectedMD5)
+	if err != nil {
+		s.Error().Msgf("error while trying to write %s for %s: %v", req.ConfigPath, IdentityFromContext(ctx), err)
+		return nil, writeStatus(err)
+	}
+	s.Info().Msgf("%s written by %s", req.ConfigPath, IdentityFromContext(ctx))
+	return &PutConfigResponse{Md5: sum}, nil
+}
+
+// DeleteConfig removes a config from the configuration tree.
+// The KV is updated, and the event published, by the fswatcher once the file is removed.
+func (s *server) DeleteConfig(ctx context.Context, req *DeleteConfigRequest) (*DeleteConfigResponse, error) {
+	if s.writer == nil {
+		return nil, status.Error(codes.Unimplemented, "writes are disabled")
+	}
+	if err := s.writer.Delete(req.ConfigPath, req.ExpectedMD5); err != nil {
+		s.Error().Msgf("error while trying to delete %s for %s: %v", req.ConfigPath, IdentityFromContext(ctx), err)
+		return nil, writeStatus(err)
+	}
+	s.Info().Msgf("%s deleted by %s", req.ConfigPath, IdentityFromContext(ctx))
+	return &DeleteConfigResponse{}, nil
+}
+
+// replicateStream overrides the stream context with one also done when the server shuts down
+type replicateStream struct {
+	Gonfig_ReplicateServer
+	ctx context.Context
+}
+
+func (s *replicateStream) Context() context.Context {
+	return s.ctx
+}
+
+// Replicate streams every config and its changes to a follower
+// The stream ends with Unavailable when the server shuts down, so the follower reconnects
+func (s *server) Replicate(req *ReplicateRequest, stream Gonfig_ReplicateServer) error {
+	if s.replicator == nil {
+		return status.Error(codes.Unimplemented, "replication is disabled")
+	}
+	identity := IdentityFromContext(stream.Context())
+	s.Info().Msgf("%s replicating from revision %d of leader %s", identity, req.FromRevision, req.LeaderID)
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.shutdown:
+			cancel()
 		case <-ctx.Done():
-			return ctx.Err()
 		}
+	}()
+	err := s.replicator.Replicate(req, &replicateStream{Gonfig_ReplicateServer: stream, ctx: ctx})
+	select {
+	case <-s.shutdown:
+		if err == nil && stream.Context().Err() == nil {
+			err = status.Error(codes.Unavailable, "server is shutting down")
+		}
+	default:
+	}
+	s.Info().Msgf("%s stopped replicating: %v", identity, err)
+	return err
+}
+
+// ExportSnapshot returns a snapshot of every config served
+func (s *server) ExportSnapshot(ctx context.Context, req *ExportSnapshotRequest) (*ExportSnapshotResponse, error) {
+	snap, err := snapshot.Take(s.KV)
+	if err != nil {
+		s.Error().Msgf("error while taking snapshot for %s: %v", IdentityFromContext(ctx), err)
+		return nil, status.Error(codes.Internal, err.Error())
 	}
+	data, err := snap.Marshal()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.Info().Msgf("snapshot of %d configs exported by %s", len(snap.Entries), IdentityFromContext(ctx))
+	return &ExportSnapshotResponse{Snapshot: data}, nil
+}
+
+// RestoreSnapshot replaces every config served with the ones of a snapshot
+func (s *server) RestoreSnapshot(ctx context.Context, req *RestoreSnapshotRequest) (*RestoreSnapshotResponse, error) {
+	snap, err := snapshot.Unmarshal(req.Snapshot)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	n, err := snap.Restore(ctx, s.KV, s.PubSub, req.Force)
+	switch {
+	case snapshot.IsInvalidSnapshotError(err):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case snapshot.IsNotEmptyError(err):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil && n == 0:
+		s.Error().Msgf("error while restoring snapshot for %s: %v", IdentityFromContext(ctx), err)
+		return nil, status.Error(codes.Internal, err.Error())
+	case err != nil:
+		s.Error().Msgf("snapshot restored for %s, but: %v", IdentityFromContext(ctx), err)
+	}
+	s.Info().Msgf("snapshot of %d configs restored by %s", n, IdentityFromContext(ctx))
+	return &RestoreSnapshotResponse{Configs: int32(n)}, nil
+}
+
+// ListConfigs returns the configs under a prefix the caller is allowed to list
+func (s *server) ListConfigs(ctx context.Context, req *ListConfigsRequest) (*ListConfigsResponse, error) {
+	keys, err := s.List(req.Prefix)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &ListConfigsResponse{}
+	for _, k := range keys {
+		if !allowed(ctx, acl.List, k) {
+			continue
+		}
+		v, err := s.Get(k)
+		if err != nil {
+			// Deleted while listing
+			continue
+		}
+		resp.Configs = append(resp.Configs, &ConfigInfo{ConfigPath: k, Md5: v.MD5(), LastModified: v.LastModified().UnixNano()})
+	}
+	return resp, nil
+}
+
+// GetHistory returns the versions of a config, newest first
+func (s *server) GetHistory(ctx context.Context, req *GetHistoryRequest) (*GetHistoryResponse, error) {
+	if s.history == nil {
+		return nil, status.Error(codes.Unimplemented, "history is disabled")
+	}
+	resp := &GetHistoryResponse{}
+	for _, v := range s.history.Versions(req.ConfigPath) {
+		resp.Versions = append(resp.Versions, &ConfigVersion{
+			Md5:          v.MD5,
+			LastModified: v.LastModified.UnixNano(),
+			Config:       v.Content,
+			Deleted:      v.Deleted,
+			Metadata:     v.Metadata,
+		})
+	}
+	if len(resp.Versions) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no history of %s", req.ConfigPath)
+	}
+	return resp, nil
+}
+
+// NewServer returns a new gonfigd gRPC server
+// writer *configtree.Writer is optional, when nil, PutConfig and DeleteConfig are disabled
+// replicator Replicator is optional, when nil, Replicate is disabled
+// renderers will be applied in order to every config served
+func NewServer(kv kv.KV, ps pubsub.PubSub, writer *configtree.Writer, replicator Replicator, logger zerolog.Logger, renderers ...Renderer) *server {
+	return &server{KV: kv, PubSub: ps, Logger: logger, writer: writer, replicator: replicator, renderers: renderers, shutdown: make(chan struct{})}
+}
+
+// Shutdown sends watchers a ServerShuttingDown event and ends their streams,
+// so they can reconnect before the server stops
+func (s *server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
 }
 
-func NewServer(kv kv.KV, ps pubsub.PubSub, logger zerolog.Logger) *server {
-	return &server{kv, ps, logger}
+// SetHistory enables GetHistory, serving the versions recorded by h
+func (s *server) SetHistory(h History) {
+	s.history = h
 }
@@ -0,0 +1,38 @@
+package api
+
+import (
+	context "context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fcgravalos/gonfigd/configtree"
+	"github.com/fcgravalos/gonfigd/interpolate"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+func TestPutConfigReferences(t *testing.T) {
+	root, _ := ioutil.TempDir("", "api-tests")
+	defer os.RemoveAll(root)
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	s := NewServer(db, ps, configtree.NewWriter(root), nil, zerolog.Nop(), interpolate.NewInterpolator(root, db))
+	path := filepath.Join(root, "app.yaml")
+
+	// References would be resolved with the permissions of gonfigd, not the ones of the writer
+	for _, content := range []string{"token: ${env:GONFIGD_TOKEN}", "secret: ${file:secret.yaml#password}"} {
+		_, err := s.PutConfig(context.Background(), &PutConfigRequest{ConfigPath: path, Config: content})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), content)
+		_, statErr := os.Stat(path)
+		assert.True(t, os.IsNotExist(statErr))
+	}
+
+	_, err := s.PutConfig(context.Background(), &PutConfigRequest{ConfigPath: path, Config: "foo: bar"})
+	assert.Nil(t, err)
+}
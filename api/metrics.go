@@ -0,0 +1,35 @@
+package api
+
+import (
+	context "context"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/metrics"
+	grpc "google.golang.org/grpc"
+	status "google.golang.org/grpc/status"
+)
+
+func observe(fullMethod string, start time.Time, err error) {
+	metrics.GrpcRequests.WithLabelValues(fullMethod, status.Code(err).String()).Inc()
+	metrics.GrpcRequestDuration.WithLabelValues(fullMethod).Observe(time.Since(start).Seconds())
+}
+
+// MetricsUnaryInterceptor records the count, status code and duration of unary calls
+func MetricsUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		observe(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// MetricsStreamInterceptor records the count, status code and duration of streams
+func MetricsStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		observe(info.FullMethod, start, err)
+		return err
+	}
+}
@@ -0,0 +1,72 @@
+// Package atomicfile replaces files atomically, so readers never see them half written
+package atomicfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// File is the content a file is replaced with
+type File struct {
+	Path  string
+	Data  []byte
+	Perms os.FileMode
+}
+
+// stage writes f into a temporary file next to it, returning its name
+func stage(f File) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), "."+filepath.Base(f.Path))
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(f.Data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), f.Perms); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// Write atomically replaces file with data, unless it already has it, returning whether it changed
+func Write(file string, data []byte, perms os.FileMode) (bool, error) {
+	return WriteAll(File{Path: file, Data: data, Perms: perms})
+}
+
+// WriteAll replaces the files not having their data yet, returning whether any of them changed.
+// They are all written to temporary files before any is replaced, so none changes when any cannot be written.
+func WriteAll(files ...File) (bool, error) {
+	var tmps, paths []string
+	defer func() {
+		// The ones renamed are already gone
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for _, f := range files {
+		if current, err := ioutil.ReadFile(f.Path); err == nil && bytes.Equal(current, f.Data) {
+			continue
+		}
+		tmp, err := stage(f)
+		if err != nil {
+			return false, err
+		}
+		tmps = append(tmps, tmp)
+		paths = append(paths, f.Path)
+	}
+	for i := range tmps {
+		if err := os.Rename(tmps[i], paths[i]); err != nil {
+			return i > 0, err
+		}
+	}
+	return len(tmps) > 0, nil
+}
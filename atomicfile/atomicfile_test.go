@@ -0,0 +1,58 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "atomicfile-tests")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "db.yaml")
+
+	changed, err := Write(file, []byte("foo: bar"), 0640)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	data, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "foo: bar", string(data))
+	fi, _ := os.Stat(file)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	changed2, err2 := Write(file, []byte("foo: bar"), 0640)
+	assert.Nil(t, err2)
+	assert.False(t, changed2)
+
+	// No temporary file is left behind
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteAll(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "atomicfile-tests")
+	defer os.RemoveAll(dir)
+	db, app := filepath.Join(dir, "db.yaml"), filepath.Join(dir, "app.yaml")
+	ioutil.WriteFile(db, []byte("foo: bar"), 0644)
+
+	// Nothing is replaced when any file cannot be written
+	_, err := WriteAll(
+		File{Path: db, Data: []byte("foo: baz"), Perms: 0644},
+		File{Path: filepath.Join(dir, "missing", "app.yaml"), Data: []byte("app: true"), Perms: 0644},
+	)
+	assert.NotNil(t, err)
+	data, _ := ioutil.ReadFile(db)
+	assert.Equal(t, "foo: bar", string(data))
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t, entries, 1)
+
+	changed, err2 := WriteAll(File{Path: db, Data: []byte("foo: baz"), Perms: 0644}, File{Path: app, Data: []byte("app: true"), Perms: 0644})
+	assert.Nil(t, err2)
+	assert.True(t, changed)
+	data2, _ := ioutil.ReadFile(db)
+	assert.Equal(t, "foo: baz", string(data2))
+	data3, _ := ioutil.ReadFile(app)
+	assert.Equal(t, "app: true", string(data3))
+}
@@ -0,0 +1,384 @@
+// Package bundlesource serves the configs of a tarball or zip bundle, i.e: a CI artifact
+//
+// The bundle file is checked every interval, and when it changes, it is verified
+// and swapped as a whole: every change is applied to the KV at once, so readers
+// never see a mix of old and new configs, then one event per changed config is published.
+// A bundle failing verification is ignored, and the previous one is kept.
+// When signatures are verified, the bundle must be signed by a trusted key,
+// its detached signature living next to it, i.e: configs.tar.gz.sig, signed for the bundle file name.
+package bundlesource
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/fswatcher"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/metrics"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/signing"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/fcgravalos/gonfigd/tracing"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// Kind is the kind of source of bundles
+	Kind = "bundle"
+	// MetadataBundle is the metadata key holding the sha256 of the bundle a value was read from
+	MetadataBundle = "bundle"
+	// ChecksumSuffix is appended to the bundle file name to find its optional sha256 checksum file
+	ChecksumSuffix      = ".sha256"
+	defaultPollInterval = 10 * time.Second
+)
+
+func init() {
+	source.Register(Kind, func(spec source.Spec, env source.Env) (source.Source, error) {
+		bundle := spec.Option("path", "")
+		if bundle == "" || spec.Root == "" {
+			return nil, source.NewInvalidSpecError(fmt.Sprintf("source %s must have a root and a path option", spec.Name))
+		}
+		interval, err := spec.Duration("pollInterval", defaultPollInterval)
+		if err != nil {
+			return nil, err
+		}
+		s := NewSource(bundle, spec.Root, env.KV, env.PS, env.Logger)
+		s.verifier = env.Verifier
+		s.deps = env.Deps
+		s.name = spec.Name
+		s.interval = interval
+		return s, nil
+	})
+}
+
+// Source keeps the KV in sync with a bundle file
+type Source struct {
+	sync.Mutex
+	name     string
+	interval time.Duration
+	bundle   string
+	root     string
+	modTime  time.Time
+	// rejected is the modTime of the last bundle failing to load, so it is not read again until it changes
+	rejected time.Time
+	verifier *signing.Verifier
+	deps     source.DependencyTracker
+	// files holds the md5 of every config of the bundle currently served
+	files map[string]string
+	kv    kv.KV
+	ps    pubsub.PubSub
+	log   zerolog.Logger
+}
+
+// NewSource returns a new *Source
+// bundle string, the .tar, .tar.gz, .tgz or .zip file to serve
+// root string, the folder configs are keyed under
+func NewSource(bundle string, root string, kv kv.KV, ps pubsub.PubSub, logger zerolog.Logger) *Source {
+	return &Source{
+		name:     Kind,
+		interval: defaultPollInterval,
+		bundle:   bundle,
+		root:     root,
+		files:    make(map[string]string),
+		kv:       kv,
+		ps:       ps,
+		log:      logger,
+	}
+}
+
+// Name implements source.Source
+func (s *Source) Name() string {
+	return s.name
+}
+
+// entryName validates the name of an archive entry, returning it relative to the bundle root
+// Configs are skipped, returning an empty name, if they are hidden or temporary files
+func entryName(name string) (string, error) {
+	rel := path.Clean(name)
+	if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("entry %s is not within the bundle", name)
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if !fswatcher.IsValidFileName(part) {
+			return "", nil
+		}
+	}
+	return rel, nil
+}
+
+func readTar(r io.Reader) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return nil, fmt.Errorf("entry %s is not a regular file", hdr.Name)
+		}
+		rel, err := entryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if rel != "" {
+			files[rel] = data
+		}
+	}
+}
+
+func readZip(data []byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return nil, fmt.Errorf("entry %s is not a regular file", f.Name)
+		}
+		rel, err := entryName(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if rel != "" {
+			files[rel] = content
+		}
+	}
+	return files, nil
+}
+
+// verifyChecksum checks the bundle against its checksum file, if there is one
+// The checksum file holds the hex sha256 of the bundle, as written by sha256sum
+func (s *Source) verifyChecksum(sum string) error {
+	data, err := ioutil.ReadFile(s.bundle + ChecksumSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return NewInvalidBundleError(s.bundle, err.Error())
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || fields[0] != sum {
+		return NewInvalidBundleError(s.bundle, fmt.Sprintf("sha256 %s does not match its checksum file", sum))
+	}
+	return nil
+}
+
+// read verifies and extracts the bundle, returning its configs by path and its sha256
+func (s *Source) read() (map[string][]byte, string, error) {
+	data, err := ioutil.ReadFile(s.bundle)
+	if err != nil {
+		return nil, "", NewInvalidBundleError(s.bundle, err.Error())
+	}
+	sha := sha256.Sum256(data)
+	sum := hex.EncodeToString(sha[:])
+	if err := s.verifyChecksum(sum); err != nil {
+		return nil, "", err
+	}
+	if s.verifier != nil {
+		name, err := s.verifier.VerifyFile(s.bundle, filepath.Base(s.bundle), data)
+		if err != nil {
+			metrics.SignatureFailures.WithLabelValues(Kind).Inc()
+			s.log.Error().
+				Str("alert", "signature_verification_failed").
+				Msgf("rejecting bundle %s (sha256 %s): %v", s.bundle, sum, err)
+			return nil, "", err
+		}
+		s.log.Info().Msgf("bundle %s (sha256 %s) signed by %s", s.bundle, sum, name)
+	}
+
+	var files map[string][]byte
+	switch name := strings.ToLower(s.bundle); {
+	case strings.HasSuffix(name, ".zip"):
+		files, err = readZip(data)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			files, err = readTar(gz)
+		}
+	case strings.HasSuffix(name, ".tar"):
+		files, err = readTar(bytes.NewReader(data))
+	default:
+		err = fmt.Errorf("unsupported format, expected .tar, .tar.gz, .tgz or .zip")
+	}
+	if err != nil {
+		return nil, "", NewInvalidBundleError(s.bundle, err.Error())
+	}
+	return files, sum, nil
+}
+
+func (s *Source) publishEvent(ctx context.Context, config string, evType pubsub.EventType) error {
+	ev := pubsub.NewEventWithContext(ctx, evType, config)
+	if !s.ps.TopicExists(config) {
+		if err := s.ps.CreateTopic(config); err != nil {
+			return err
+		}
+	}
+	return s.ps.Publish(config, ev)
+}
+
+// Load verifies the bundle and swaps the configs currently served with its ones
+func (s *Source) Load(ctx context.Context) error {
+	ctx, span := tracing.Tracer().Start(ctx, "bundlesource.Load")
+	defer span.End()
+	s.Lock()
+	defer s.Unlock()
+
+	modTime, err := s.lastModified()
+	if err != nil {
+		return NewInvalidBundleError(s.bundle, err.Error())
+	}
+	files, sum, err := s.read()
+	if err != nil {
+		s.rejected = modTime
+		return err
+	}
+
+	changes := make(map[string]*kv.Value)
+	events := make(map[string]pubsub.EventType)
+	md5s := make(map[string]string, len(files))
+	for rel, data := range files {
+		md5s[rel] = fmt.Sprintf("%x", md5.Sum(data))
+		old, ok := s.files[rel]
+		if ok && old == md5s[rel] {
+			continue
+		}
+		key := filepath.Join(s.root, filepath.FromSlash(rel))
+		if changes[key], err = kv.NewValueWithMetadata(data, map[string]string{MetadataBundle: sum}); err != nil {
+			return err
+		}
+		events[key] = pubsub.ConfigCreated
+		if ok {
+			events[key] = pubsub.ConfigUpdated
+		}
+	}
+	for rel := range s.files {
+		if _, ok := files[rel]; !ok {
+			key := filepath.Join(s.root, filepath.FromSlash(rel))
+			changes[key] = nil
+			events[key] = pubsub.ConfigDeleted
+		}
+	}
+
+	if err := s.kv.Apply(changes); err != nil {
+		return err
+	}
+	s.files = md5s
+	s.modTime = modTime
+	s.rejected = time.Time{}
+	if s.deps != nil {
+		for k, v := range changes {
+			if v == nil {
+				s.deps.Untrack(k)
+			} else {
+				s.deps.Track(k, v.Text())
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(events))
+	for k := range events {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := s.publishEvent(ctx, k, events[k]); err != nil {
+			s.log.Error().Msgf("failed to publish %s event for %s: %v", events[k].String(), k, err)
+		}
+		if err := source.PublishDependents(ctx, s.ps, s.deps, k); err != nil {
+			s.log.Error().Msgf("failed to publish the events of the configs referencing %s: %v", k, err)
+		}
+	}
+	s.log.Info().Msgf("bundle %s (sha256 %s) loaded, %d configs changed", s.bundle, sum, len(events))
+	return nil
+}
+
+// lastModified returns the latest modification time of the bundle and its checksum and signature files,
+// so fixing any of them makes a rejected bundle to be read again
+func (s *Source) lastModified() (time.Time, error) {
+	fi, err := os.Stat(s.bundle)
+	if err != nil {
+		return time.Time{}, err
+	}
+	last := fi.ModTime()
+	for _, f := range []string{s.bundle + ChecksumSuffix, s.bundle + signing.SignatureSuffix} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// changed checks whether the bundle has been modified since it was loaded or rejected
+func (s *Source) changed() bool {
+	modTime, err := s.lastModified()
+	if err != nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return !modTime.Equal(s.modTime) && !modTime.Equal(s.rejected)
+}
+
+// Snapshot implements source.Source, loading the bundle
+func (s *Source) Snapshot(ctx context.Context) error {
+	return s.Load(ctx)
+}
+
+// Start implements source.Source, loading the bundle whenever it changes
+// A bundle failing verification keeps the previous one served, and is not read again until it changes
+func (s *Source) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-time.After(s.interval):
+			if !s.changed() {
+				break
+			}
+			if err := s.Load(ctx); err != nil {
+				s.log.Error().Msgf("failed to load bundle, keeping the previous one: %v", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
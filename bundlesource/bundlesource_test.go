@@ -0,0 +1,288 @@
+package bundlesource
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/interpolate"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/signing"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTarGz(t *testing.T, file string, files map[string]string) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	gz.Close()
+	if err := ioutil.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func writeZip(t *testing.T, file string, files map[string]string) {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, content := range files {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	if err := ioutil.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bundlesource-tests")
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "configs.tar.gz")
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	s := NewSource(bundle, "/configs", db, ps, zerolog.Nop())
+
+	data := writeTarGz(t, bundle, map[string]string{"./app/db.yaml": "foo: bar", "app/cache.yaml": "foo: bar", "app/.hidden": "x"})
+	assert.Nil(t, s.Load(context.Background()))
+	keys, _ := db.List("")
+	assert.Equal(t, []string{"/configs/app/cache.yaml", "/configs/app/db.yaml"}, keys)
+	v, _ := db.Get("/configs/app/db.yaml")
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), v.Metadata(MetadataBundle))
+
+	events := make(chan *pubsub.Event)
+	for _, k := range []string{"/configs/app/db.yaml", "/configs/app/cache.yaml", "/configs/app/new.yaml"} {
+		ps.CreateTopic(k)
+		sub, _ := ps.Subscribe(k)
+		go func(sub *pubsub.Subscription) {
+			events <- <-sub.Channel()
+		}(sub)
+	}
+
+	writeTarGz(t, bundle, map[string]string{"app/db.yaml": "foo: baz", "app/new.yaml": "new: true"})
+	errCh := make(chan error)
+	go func() {
+		errCh <- s.Load(context.Background())
+	}()
+	kinds := make(map[string]pubsub.EventType)
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-events:
+			kinds[ev.ConfigPath()] = ev.Kind()
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+	assert.Nil(t, <-errCh)
+	assert.Equal(t, map[string]pubsub.EventType{
+		"/configs/app/db.yaml":    pubsub.ConfigUpdated,
+		"/configs/app/cache.yaml": pubsub.ConfigDeleted,
+		"/configs/app/new.yaml":   pubsub.ConfigCreated,
+	}, kinds)
+
+	keys2, _ := db.List("")
+	assert.Equal(t, []string{"/configs/app/db.yaml", "/configs/app/new.yaml"}, keys2)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bundlesource-tests")
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "configs.zip")
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	s := NewSource(bundle, "/configs", db, ps, zerolog.Nop())
+
+	writeZip(t, bundle, map[string]string{"db.yaml": "foo: bar"})
+	assert.Nil(t, s.Load(context.Background()))
+
+	// Entries escaping the bundle
+	writeZip(t, bundle, map[string]string{"../db.yaml": "foo: baz"})
+	err := s.Load(context.Background())
+	assert.EqualError(t, err, fmt.Sprintf("[%s] Invalid bundle %s: entry ../db.yaml is not within the bundle", InvalidBundle, bundle))
+
+	// Checksum mismatch
+	writeZip(t, bundle, map[string]string{"db.yaml": "foo: baz"})
+	ioutil.WriteFile(bundle+ChecksumSuffix, []byte("0123  configs.zip\n"), 0644)
+	assert.True(t, IsInvalidBundleError(s.Load(context.Background())))
+
+	// Corrupted bundle
+	ioutil.WriteFile(bundle, []byte("not a zip"), 0644)
+	os.Remove(bundle + ChecksumSuffix)
+	assert.True(t, IsInvalidBundleError(s.Load(context.Background())))
+
+	// The previous bundle is still served
+	v, _ := db.Get("/configs/db.yaml")
+	assert.Equal(t, "foo: bar", v.Text())
+
+	// Matching checksum
+	writeZip(t, bundle, map[string]string{"db.yaml": "foo: baz"})
+	data, _ := ioutil.ReadFile(bundle)
+	sum := sha256.Sum256(data)
+	ioutil.WriteFile(bundle+ChecksumSuffix, []byte(hex.EncodeToString(sum[:])+"  configs.zip\n"), 0644)
+	assert.Nil(t, s.Load(context.Background()))
+	v2, _ := db.Get("/configs/db.yaml")
+	assert.Equal(t, "foo: baz", v2.Text())
+}
+
+func TestLoadSigned(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, untrusted, _ := ed25519.GenerateKey(rand.Reader)
+	dir, _ := ioutil.TempDir("", "bundlesource-tests")
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "configs.tar.gz")
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	s := NewSource(bundle, "/configs", db, ps, zerolog.Nop())
+	s.verifier = signing.NewVerifier(map[string]ed25519.PublicKey{"ci": pub})
+
+	data := writeTarGz(t, bundle, map[string]string{"db.yaml": "foo: bar"})
+	assert.True(t, signing.IsInvalidSignatureError(s.Load(context.Background())))
+
+	ioutil.WriteFile(bundle+signing.SignatureSuffix, signing.Sign(priv, "configs.tar.gz", data), 0644)
+	assert.Nil(t, s.Load(context.Background()))
+
+	data2 := writeTarGz(t, bundle, map[string]string{"db.yaml": "foo: baz"})
+	ioutil.WriteFile(bundle+signing.SignatureSuffix, signing.Sign(untrusted, "configs.tar.gz", data2), 0644)
+	assert.True(t, signing.IsInvalidSignatureError(s.Load(context.Background())))
+	v, _ := db.Get("/configs/db.yaml")
+	assert.Equal(t, "foo: bar", v.Text())
+}
+
+func TestChangedAfterRejection(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bundlesource-tests")
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "configs.zip")
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	s := NewSource(bundle, "/configs", db, ps, zerolog.Nop())
+	now := time.Now()
+
+	writeZip(t, bundle, map[string]string{"db.yaml": "foo: bar"})
+	os.Chtimes(bundle, now, now)
+	assert.Nil(t, s.Load(context.Background()))
+	assert.False(t, s.changed())
+
+	// A rejected bundle is not read again until it changes
+	ioutil.WriteFile(bundle, []byte("not a zip"), 0644)
+	os.Chtimes(bundle, now, now.Add(time.Second))
+	assert.True(t, s.changed())
+	assert.True(t, IsInvalidBundleError(s.Load(context.Background())))
+	assert.False(t, s.changed())
+
+	// Neither until its checksum file changes
+	writeZip(t, bundle, map[string]string{"db.yaml": "foo: baz"})
+	ioutil.WriteFile(bundle+ChecksumSuffix, []byte("0123  configs.zip\n"), 0644)
+	os.Chtimes(bundle, now, now.Add(2*time.Second))
+	os.Chtimes(bundle+ChecksumSuffix, now, now.Add(2*time.Second))
+	assert.True(t, IsInvalidBundleError(s.Load(context.Background())))
+	assert.False(t, s.changed())
+	data, _ := ioutil.ReadFile(bundle)
+	sum := sha256.Sum256(data)
+	ioutil.WriteFile(bundle+ChecksumSuffix, []byte(hex.EncodeToString(sum[:])+"  configs.zip\n"), 0644)
+	os.Chtimes(bundle+ChecksumSuffix, now, now.Add(3*time.Second))
+	assert.True(t, s.changed())
+	assert.Nil(t, s.Load(context.Background()))
+	assert.False(t, s.changed())
+	v, _ := db.Get("/configs/db.yaml")
+	assert.Equal(t, "foo: baz", v.Text())
+}
+
+func TestLoadDependents(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bundlesource-tests")
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "configs.tar.gz")
+	writeTarGz(t, bundle, map[string]string{"db.yaml": "host: db1", "app.yaml": "db: ${file:db.yaml#host}"})
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	interpolator := interpolate.NewInterpolator("/ci", db)
+	src, err := source.New(source.Spec{
+		Name:    "ci",
+		Kind:    Kind,
+		Root:    "/ci",
+		Options: map[string]string{"path": bundle},
+	}, source.Env{KV: db, PS: ps, Deps: interpolator, Logger: zerolog.Nop()})
+	assert.Nil(t, err)
+	assert.Nil(t, src.Snapshot(context.Background()))
+
+	// Configs referencing a changed one get an event, so they are rendered again
+	ps.CreateTopic("/ci/app.yaml")
+	sub, _ := ps.Subscribe("/ci/app.yaml")
+	writeTarGz(t, bundle, map[string]string{"db.yaml": "host: db2", "app.yaml": "db: ${file:db.yaml#host}"})
+	errCh := make(chan error)
+	go func() {
+		errCh <- src.(*Source).Load(context.Background())
+	}()
+	select {
+	case ev := <-sub.Channel():
+		assert.Equal(t, pubsub.ConfigUpdated, ev.Kind())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	assert.Nil(t, <-errCh)
+}
+
+func TestSourceFromSpec(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bundlesource-tests")
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "configs.tgz")
+	writeTarGz(t, bundle, map[string]string{"db.yaml": "foo: bar"})
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+
+	src, err := source.New(source.Spec{
+		Name:    "ci",
+		Kind:    Kind,
+		Root:    "/ci",
+		Options: map[string]string{"path": bundle, "pollInterval": "10ms"},
+	}, source.Env{KV: db, PS: ps, Logger: zerolog.Nop()})
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", src.Name())
+	assert.Nil(t, src.Snapshot(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		src.Start(ctx)
+		close(done)
+	}()
+	// Make sure the modification time changes
+	time.Sleep(20 * time.Millisecond)
+	writeTarGz(t, bundle, map[string]string{"db.yaml": "foo: baz"})
+	os.Chtimes(bundle, time.Now(), time.Now().Add(time.Second))
+	assert.Eventually(t, func() bool {
+		v, err := db.Get("/ci/db.yaml")
+		return err == nil && v.Text() == "foo: baz"
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	_, err2 := source.New(source.Spec{Name: "ci", Kind: Kind, Root: "/ci"}, source.Env{})
+	assert.True(t, source.IsInvalidSpecError(err2))
+}
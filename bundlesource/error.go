@@ -0,0 +1,37 @@
+package bundlesource
+
+import "fmt"
+
+const (
+	InvalidBundle ErrType = "INVALID_BUNDLE_ERROR"
+	Unknown       ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidBundleError struct {
+	errType ErrType
+	bundle  string
+	reason  string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidBundleError:
+		return InvalidBundle
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidBundleError(e error) bool {
+	return getErrorType(e) == InvalidBundle
+}
+
+func (e InvalidBundleError) Error() string {
+	return fmt.Sprintf("[%s] Invalid bundle %s: %s", e.errType, e.bundle, e.reason)
+}
+
+func NewInvalidBundleError(bundle string, reason string) InvalidBundleError {
+	return InvalidBundleError{errType: InvalidBundle, bundle: bundle, reason: reason}
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Validator is implemented by configs checking themselves once decoded
+type Validator interface {
+	Validate() error
+}
+
+// RejectFunc is called whenever an update of a bound config is rejected
+type RejectFunc func(path string, err error)
+
+// Binding holds the last valid decoded version of a config
+type Binding struct {
+	mu       sync.Mutex
+	path     string
+	typ      reflect.Type
+	value    atomic.Value
+	err      error
+	onReject []RejectFunc
+	client   *Client
+}
+
+// Bind decodes path into target, a pointer to a struct, and keeps decoding it into a new value of
+// the same type whenever it changes. Configs are decoded as JSON when their name ends with .json,
+// as YAML otherwise, and validated when implementing Validator. Updates failing to decode or
+// validate, and deletions, are rejected, keeping the previous value.
+func (c *Client) Bind(path string, target interface{}) (*Binding, error) {
+	typ := reflect.TypeOf(target)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("target of %s must be a pointer, got %T", path, target)
+	}
+	b := &Binding{path: path, typ: typ.Elem(), client: c}
+	// Registered first so no change is missed, the cache is always read for the latest config
+	if err := c.OnChange(path, func(string, string, bool) { b.update() }); err != nil {
+		return nil, err
+	}
+	config, err := c.cached(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := decode(path, config, target); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.value.Load() == nil {
+		b.value.Store(target)
+	}
+	return b, nil
+}
+
+// Load returns the last valid value, a pointer of the type given to Bind. It must not be modified.
+func (b *Binding) Load() interface{} {
+	return b.value.Load()
+}
+
+// Err returns why the last update was rejected, nil if the value loaded is the latest config
+func (b *Binding) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// OnReject calls fn whenever an update is rejected
+func (b *Binding) OnReject(fn RejectFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onReject = append(b.onReject, fn)
+}
+
+// update decodes the latest config, swapping the value if valid
+func (b *Binding) update() {
+	b.mu.Lock()
+	config, err := b.client.cached(b.path)
+	if err == nil {
+		v := reflect.New(b.typ).Interface()
+		if err = decode(b.path, config, v); err == nil {
+			b.value.Store(v)
+		}
+	}
+	b.err = err
+	onReject := append([]RejectFunc(nil), b.onReject...)
+	b.mu.Unlock()
+
+	if err == nil {
+		return
+	}
+	b.client.cfg.Logger.Error().Msgf("update of %s rejected, keeping the previous config: %v", b.path, err)
+	for _, fn := range onReject {
+		fn(b.path, err)
+	}
+}
+
+// decode decodes config into v, by the extension of path, and validates it
+func decode(path string, config string, v interface{}) error {
+	var err error
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal([]byte(config), v)
+	} else {
+		err = yaml.Unmarshal([]byte(config), v)
+	}
+	if err != nil {
+		return NewInvalidConfigError(path, err)
+	}
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return NewInvalidConfigError(path, err)
+		}
+	}
+	return nil
+}
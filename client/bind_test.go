@@ -0,0 +1,76 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type dbConfig struct {
+	Host string `yaml:"host" json:"host"`
+	Port int    `yaml:"port" json:"port"`
+}
+
+func (c *dbConfig) Validate() error {
+	if c.Port <= 0 {
+		return errors.New("port must be positive")
+	}
+	return nil
+}
+
+func TestBind(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	put(t, db, ps, "/configs/db.yaml", "host: db\nport: 5432")
+	put(t, db, ps, "/configs/db.json", `{"host": "db", "port": 0}`)
+	server, addr := serve(t, "127.0.0.1:0", db, ps)
+	defer server.Stop()
+	c, _ := New(Config{Addr: addr, Logger: zerolog.Nop()})
+	defer c.Close()
+
+	cfg := &dbConfig{}
+	b, err := c.Bind("/configs/db.yaml", cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, &dbConfig{Host: "db", Port: 5432}, cfg)
+	assert.Equal(t, cfg, b.Load().(*dbConfig))
+
+	rejected := make(chan error, 1)
+	b.OnReject(func(path string, err error) {
+		rejected <- err
+	})
+
+	// Valid updates are swapped in
+	put(t, db, ps, "/configs/db.yaml", "host: db2\nport: 5433")
+	assert.Eventually(t, func() bool {
+		return b.Load().(*dbConfig).Host == "db2"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, &dbConfig{Host: "db", Port: 5432}, cfg)
+
+	// Invalid ones are rejected
+	put(t, db, ps, "/configs/db.yaml", "host: db3\nport: -1")
+	select {
+	case err := <-rejected:
+		assert.True(t, IsInvalidConfigError(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("update not rejected")
+	}
+	assert.Equal(t, &dbConfig{Host: "db2", Port: 5433}, b.Load().(*dbConfig))
+	assert.True(t, IsInvalidConfigError(b.Err()))
+
+	put(t, db, ps, "/configs/db.yaml", "host: db4\nport: 5434")
+	assert.Eventually(t, func() bool {
+		return b.Load().(*dbConfig).Host == "db4"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, b.Err())
+
+	_, err2 := c.Bind("/configs/db.json", &dbConfig{})
+	assert.EqualError(t, err2, "[INVALID_CONFIG_ERROR] Config /configs/db.json was rejected: port must be positive")
+
+	_, err3 := c.Bind("/configs/db.yaml", dbConfig{})
+	assert.NotNil(t, err3)
+}
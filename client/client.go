@@ -0,0 +1,359 @@
+// Package client is the Go client of gonfigd
+//
+// Configs are watched once requested and served from a local cache, kept up to date
+// by their change events. Watches are resumed, with backoff, whenever the connection
+// to gonfigd breaks, reading their configs again so no change is missed.
+// The cache can be persisted to a file, serving its configs at startup when gonfigd is unreachable.
+//
+//	c, err := client.New(client.Config{Addr: "localhost:8080", CacheFile: "/var/cache/app/gonfigd.json"})
+//	if err != nil {
+//		...
+//	}
+//	defer c.Close()
+//	db, err := c.Get("/etc/gonfigd/app/db.yaml")
+//	c.OnChange("/etc/gonfigd/app/db.yaml", func(path string, config string, deleted bool) {
+//		...
+//	})
+//
+// Configs can also be bound to structs, swapped whenever a valid version is received:
+//
+//	b, err := c.Bind("/etc/gonfigd/app/db.yaml", &DBConfig{})
+//	db := b.Load().(*DBConfig)
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/rs/zerolog"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// ChangeFunc is called with the new content of a config whenever it changes, or with deleted set when it is deleted
+type ChangeFunc func(path string, config string, deleted bool)
+
+// Config of a Client
+type Config struct {
+	// Addr is the gRPC address of gonfigd
+	Addr string
+	// DialOptions are used to connect to gonfigd, insecure when empty. See DialOptions
+	DialOptions []grpc.DialOption
+	// CacheFile, when set, persists the cache so configs can be served when gonfigd is unreachable at startup
+	CacheFile string
+	// MinBackoff and MaxBackoff bound the wait between reconnections, 1s and 30s when not set
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Logger     zerolog.Logger
+}
+
+// Client serves the configs it watches from a local cache
+type Client struct {
+	sync.Mutex
+	cfg       Config
+	conn      *grpc.ClientConn
+	gonfig    api.GonfigClient
+	cache     map[string]string
+	watched   map[string]bool
+	callbacks map[string][]ChangeFunc
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// tokenCredentials sends a bearer token along every call
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
+
+// DialOptions returns the options to connect to gonfigd
+// caFile string, the CA verifying the gonfigd certificate, the connection is insecure when empty
+// certFile and keyFile string, the client certificate presented to gonfigd running with mTLS, if any
+// tokenFile string, the file holding the bearer token sent to gonfigd, if any
+func DialOptions(caFile string, certFile string, keyFile string, tokenFile string) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &tls.Config{RootCAs: x509.NewCertPool()}
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", caFile)
+		}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	} else if certFile != "" {
+		return nil, fmt.Errorf("a client certificate requires TLS, set the CA file too")
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: strings.TrimSpace(string(token)), secure: caFile != ""}))
+	}
+	return opts, nil
+}
+
+// New returns a new *Client, loading CacheFile if it exists.
+// It does not wait for gonfigd to be reachable.
+func New(cfg Config) (*Client, error) {
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	opts := cfg.DialOptions
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithInsecure()}
+	}
+	c := &Client{
+		cfg:       cfg,
+		cache:     make(map[string]string),
+		watched:   make(map[string]bool),
+		callbacks: make(map[string][]ChangeFunc),
+	}
+	if cfg.CacheFile != "" {
+		data, err := ioutil.ReadFile(cfg.CacheFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, NewInvalidCacheError(cfg.CacheFile, err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &c.cache); err != nil {
+				return nil, NewInvalidCacheError(cfg.CacheFile, err)
+			}
+		}
+	}
+	conn, err := grpc.Dial(cfg.Addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.gonfig = api.NewGonfigClient(conn)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c, nil
+}
+
+// Close stops every watch and closes the connection to gonfigd
+func (c *Client) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return c.conn.Close()
+}
+
+// Get returns a config from the cache, watching it first if it was not
+func (c *Client) Get(path string) (string, error) {
+	if err := c.Watch(path); err != nil {
+		return "", err
+	}
+	return c.cached(path)
+}
+
+// cached returns a config from the cache
+func (c *Client) cached(path string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	config, ok := c.cache[path]
+	if !ok {
+		return "", NewNotFoundError(path, nil)
+	}
+	return config, nil
+}
+
+// OnChange calls fn whenever path changes from now on, watching it first if it was not
+func (c *Client) OnChange(path string, fn ChangeFunc) error {
+	err := c.Watch(path)
+	c.Lock()
+	c.callbacks[path] = append(c.callbacks[path], fn)
+	c.Unlock()
+	return err
+}
+
+// Watch keeps path up to date in the cache, waiting for it to be read the first time.
+// When it cannot be read, the cached config is served, if any, while the watch keeps retrying.
+func (c *Client) Watch(path string) error {
+	c.Lock()
+	if c.watched[path] {
+		c.Unlock()
+		return nil
+	}
+	c.watched[path] = true
+	c.Unlock()
+
+	ready := make(chan error, 1)
+	var once sync.Once
+	synced := func(err error) {
+		once.Do(func() { ready <- err })
+	}
+	c.wg.Add(1)
+	go c.watch(path, synced)
+	return <-ready
+}
+
+// watch follows path until the client is closed, resuming with backoff whenever the stream breaks
+func (c *Client) watch(path string, synced func(error)) {
+	defer c.wg.Done()
+	backoff := c.cfg.MinBackoff
+	for {
+		started := time.Now()
+		err := c.follow(path, synced)
+		if c.ctx.Err() != nil {
+			synced(c.ctx.Err())
+			return
+		}
+		c.Lock()
+		_, cached := c.cache[path]
+		c.Unlock()
+		if cached {
+			synced(nil)
+		} else {
+			synced(NewNotFoundError(path, err))
+		}
+		if time.Since(started) > c.cfg.MaxBackoff {
+			backoff = c.cfg.MinBackoff
+		}
+		c.cfg.Logger.Warn().Msgf("watch of %s interrupted, retrying in %s: %v", path, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// follow subscribes to the changes of path, reads it, and applies its changes until the stream breaks
+func (c *Client) follow(path string, synced func(error)) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	stream, err := c.gonfig.WatchConfig(ctx, &api.WatchConfigRequest{ConfigPath: path})
+	if err != nil {
+		return err
+	}
+	// Subscribed once the header is received
+	if _, err := stream.Header(); err != nil {
+		return err
+	}
+	if err := c.refresh(ctx, path); err != nil {
+		return err
+	}
+	synced(nil)
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if strings.Contains(resp.Event, pubsub.ServerShuttingDown.String()) {
+			// Reconnect, the address may resolve to another server by then
+			return fmt.Errorf("server is shutting down")
+		}
+		if strings.Contains(resp.Event, pubsub.ConfigDeleted.String()) {
+			c.update(path, "", true)
+			continue
+		}
+		if err := c.refresh(ctx, path); err != nil {
+			return err
+		}
+	}
+}
+
+// refresh reads path from gonfigd into the cache
+func (c *Client) refresh(ctx context.Context, path string) error {
+	resp, err := c.gonfig.GetConfig(ctx, &api.GetConfigRequest{ConfigPath: path})
+	if status.Code(err) == codes.NotFound {
+		c.update(path, "", true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.update(path, resp.Config, false)
+	return nil
+}
+
+// update caches the config of path, calling its callbacks if it changed
+func (c *Client) update(path string, config string, deleted bool) {
+	c.Lock()
+	old, ok := c.cache[path]
+	if (deleted && !ok) || (!deleted && ok && old == config) {
+		c.Unlock()
+		return
+	}
+	if deleted {
+		delete(c.cache, path)
+	} else {
+		c.cache[path] = config
+	}
+	if err := c.persist(); err != nil {
+		c.cfg.Logger.Error().Msgf("failed to persist cache to %s: %v", c.cfg.CacheFile, err)
+	}
+	callbacks := append([]ChangeFunc(nil), c.callbacks[path]...)
+	c.Unlock()
+
+	for _, fn := range callbacks {
+		fn(path, config, deleted)
+	}
+}
+
+// persist writes the cache to CacheFile, if set. The lock must be held by the caller
+func (c *Client) persist() error {
+	if c.cfg.CacheFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.cache)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.cfg.CacheFile), "."+filepath.Base(c.cfg.CacheFile))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.cfg.CacheFile)
+}
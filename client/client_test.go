@@ -0,0 +1,256 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/tlsconfig"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+type change struct {
+	config  string
+	deleted bool
+}
+
+func serve(t *testing.T, addr string, db kv.KV, ps pubsub.PubSub) (*grpc.Server, string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	api.RegisterGonfigServer(s, api.NewServer(db, ps, nil, nil, zerolog.Nop()))
+	go s.Serve(lis)
+	return s, lis.Addr().String()
+}
+
+func put(t *testing.T, db kv.KV, ps pubsub.PubSub, path string, config string) {
+	v, _ := kv.NewValue([]byte(config))
+	if err := db.Put(path, v); err != nil {
+		t.Fatal(err)
+	}
+	if ps.TopicExists(path) {
+		ps.Publish(path, pubsub.NewEvent(pubsub.ConfigUpdated, path))
+	}
+}
+
+func waitChange(t *testing.T, changes chan change) change {
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	return change{}
+}
+
+func TestGetAndOnChange(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	put(t, db, ps, "/configs/db.yaml", "foo: bar")
+	server, addr := serve(t, "127.0.0.1:0", db, ps)
+	defer server.Stop()
+
+	c, err := New(Config{Addr: addr, Logger: zerolog.Nop()})
+	assert.Nil(t, err)
+	defer c.Close()
+
+	config, err := c.Get("/configs/db.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo: bar", config)
+
+	_, err2 := c.Get("/configs/missing.yaml")
+	assert.True(t, IsNotFoundError(err2))
+
+	changes := make(chan change, 1)
+	assert.Nil(t, c.OnChange("/configs/db.yaml", func(path string, config string, deleted bool) {
+		changes <- change{config, deleted}
+	}))
+
+	put(t, db, ps, "/configs/db.yaml", "foo: baz")
+	assert.Equal(t, change{"foo: baz", false}, waitChange(t, changes))
+	config2, _ := c.Get("/configs/db.yaml")
+	assert.Equal(t, "foo: baz", config2)
+
+	db.Delete("/configs/db.yaml")
+	ps.Publish("/configs/db.yaml", pubsub.NewEvent(pubsub.ConfigDeleted, "/configs/db.yaml"))
+	assert.Equal(t, change{"", true}, waitChange(t, changes))
+	_, err3 := c.Get("/configs/db.yaml")
+	assert.True(t, IsNotFoundError(err3))
+}
+
+func TestReconnect(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	put(t, db, ps, "/configs/db.yaml", "foo: bar")
+	server, addr := serve(t, "127.0.0.1:0", db, ps)
+
+	c, _ := New(Config{Addr: addr, MinBackoff: 50 * time.Millisecond, MaxBackoff: 200 * time.Millisecond, Logger: zerolog.Nop()})
+	defer c.Close()
+	changes := make(chan change, 1)
+	assert.Nil(t, c.OnChange("/configs/db.yaml", func(path string, config string, deleted bool) {
+		changes <- change{config, deleted}
+	}))
+
+	// Changes made while disconnected are read once the watch is resumed
+	server.Stop()
+	v, _ := kv.NewValue([]byte("foo: baz"))
+	db.Put("/configs/db.yaml", v)
+	config, _ := c.Get("/configs/db.yaml")
+	assert.Equal(t, "foo: bar", config)
+	server2, _ := serve(t, addr, db, ps)
+	defer server2.Stop()
+	assert.Equal(t, change{"foo: baz", false}, waitChange(t, changes))
+}
+
+func TestReconnectOnShutdown(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	put(t, db, ps, "/configs/db.yaml", "foo: bar")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := api.NewServer(db, ps, nil, nil, zerolog.Nop())
+	server := grpc.NewServer()
+	api.RegisterGonfigServer(server, gs)
+	go server.Serve(lis)
+
+	c, _ := New(Config{Addr: lis.Addr().String(), MinBackoff: 50 * time.Millisecond, MaxBackoff: 200 * time.Millisecond, Logger: zerolog.Nop()})
+	defer c.Close()
+	changes := make(chan change, 1)
+	assert.Nil(t, c.OnChange("/configs/db.yaml", func(path string, config string, deleted bool) {
+		changes <- change{config, deleted}
+	}))
+
+	// The watch ends on the shutting down event, so the server can stop gracefully
+	gs.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not stop")
+	}
+
+	v, _ := kv.NewValue([]byte("foo: baz"))
+	db.Put("/configs/db.yaml", v)
+	server2, _ := serve(t, lis.Addr().String(), db, ps)
+	defer server2.Stop()
+	assert.Equal(t, change{"foo: baz", false}, waitChange(t, changes))
+}
+
+func TestCacheFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "client-tests")
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache.json")
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	put(t, db, ps, "/configs/db.yaml", "foo: bar")
+	server, addr := serve(t, "127.0.0.1:0", db, ps)
+
+	c, _ := New(Config{Addr: addr, CacheFile: cacheFile, Logger: zerolog.Nop()})
+	config, err := c.Get("/configs/db.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo: bar", config)
+	c.Close()
+	server.Stop()
+
+	// gonfigd is unreachable
+	c2, err2 := New(Config{Addr: addr, CacheFile: cacheFile, Logger: zerolog.Nop()})
+	assert.Nil(t, err2)
+	defer c2.Close()
+	config2, err3 := c2.Get("/configs/db.yaml")
+	assert.Nil(t, err3)
+	assert.Equal(t, "foo: bar", config2)
+	_, err4 := c2.Get("/configs/cache.yaml")
+	assert.True(t, IsNotFoundError(err4))
+
+	ioutil.WriteFile(cacheFile, []byte("not json"), 0600)
+	_, err5 := New(Config{Addr: addr, CacheFile: cacheFile})
+	assert.True(t, IsInvalidCacheError(err5))
+}
+
+// writeSelfSigned writes a new self-signed certificate for localhost and its key
+func writeSelfSigned(certFile string, keyFile string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gonfigd"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func TestDialOptionsMTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "client-tests")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeSelfSigned(certFile, keyFile)
+
+	// The certificate is its own CA, verifying both the server and the client
+	r, err := tlsconfig.NewReloader(certFile, keyFile, certFile, zerolog.Nop())
+	assert.Nil(t, err)
+	lis, _ := net.Listen("tcp", "127.0.0.1:0")
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(r.TLSConfig())))
+	api.RegisterGonfigServer(s, api.NewServer(db, ps, nil, nil, zerolog.Nop()))
+	go s.Serve(lis)
+	defer s.Stop()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	get := func(opts []grpc.DialOption) error {
+		conn, err := grpc.Dial(net.JoinHostPort("localhost", port), opts...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = api.NewGonfigClient(conn).GetConfig(ctx, &api.GetConfigRequest{ConfigPath: "/configs/db.yaml"})
+		return err
+	}
+
+	withCert, err := DialOptions(certFile, certFile, keyFile, "")
+	assert.Nil(t, err)
+	assert.Equal(t, codes.NotFound, status.Code(get(withCert)))
+
+	withoutCert, _ := DialOptions(certFile, "", "", "")
+	assert.Equal(t, codes.Unavailable, status.Code(get(withoutCert)))
+
+	_, err2 := DialOptions("", certFile, keyFile, "")
+	assert.NotNil(t, err2)
+}
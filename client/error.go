@@ -0,0 +1,82 @@
+package client
+
+import "fmt"
+
+const (
+	NotFound      ErrType = "NOT_FOUND_ERROR"
+	InvalidCache  ErrType = "INVALID_CACHE_ERROR"
+	InvalidConfig ErrType = "INVALID_CONFIG_ERROR"
+	Unknown       ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type NotFoundError struct {
+	errType ErrType
+	path    string
+	err     error
+}
+
+type InvalidCacheError struct {
+	errType ErrType
+	file    string
+	err     error
+}
+
+type InvalidConfigError struct {
+	errType ErrType
+	path    string
+	err     error
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case NotFoundError:
+		return NotFound
+	case InvalidCacheError:
+		return InvalidCache
+	case InvalidConfigError:
+		return InvalidConfig
+	default:
+		return Unknown
+	}
+}
+
+func IsNotFoundError(e error) bool {
+	return getErrorType(e) == NotFound
+}
+
+func IsInvalidCacheError(e error) bool {
+	return getErrorType(e) == InvalidCache
+}
+
+func IsInvalidConfigError(e error) bool {
+	return getErrorType(e) == InvalidConfig
+}
+
+func (e NotFoundError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("[%s] Config %s is not available: %v", e.errType, e.path, e.err)
+	}
+	return fmt.Sprintf("[%s] Config %s is not available", e.errType, e.path)
+}
+
+func (e InvalidCacheError) Error() string {
+	return fmt.Sprintf("[%s] Cache file %s could not be loaded: %v", e.errType, e.file, e.err)
+}
+
+func NewNotFoundError(path string, err error) NotFoundError {
+	return NotFoundError{errType: NotFound, path: path, err: err}
+}
+
+func NewInvalidCacheError(file string, err error) InvalidCacheError {
+	return InvalidCacheError{errType: InvalidCache, file: file, err: err}
+}
+
+func (e InvalidConfigError) Error() string {
+	return fmt.Sprintf("[%s] Config %s was rejected: %v", e.errType, e.path, e.err)
+}
+
+func NewInvalidConfigError(path string, err error) InvalidConfigError {
+	return InvalidConfigError{errType: InvalidConfig, path: path, err: err}
+}
@@ -0,0 +1,391 @@
+// gonfigctl inspects and debugs a live gonfigd
+//
+//	gonfigctl [flags] get [-o text|env] [--prefix <prefix>] [--separator <separator>] [--casing upper|lower|preserve] <path>
+//	gonfigctl [flags] list [-o text|json] [prefix]
+//	gonfigctl [flags] watch [-o text|json] <path>
+//	gonfigctl [flags] diff [--file <file> | --version <md5>] <path>
+//	gonfigctl [flags] history [-o text|json] <path>
+//	gonfigctl [flags] put [--file <file>] [--expected-md5 <md5>] <path>
+//	gonfigctl [flags] rollback --to <md5> <path>
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/pmezard/go-difflib/difflib"
+	"google.golang.org/grpc"
+)
+
+const usage = `Usage: gonfigctl [flags] <command> [command flags] [args]
+
+Commands:
+  get <path>          print a config, as served or as environment variables
+  list [prefix]       list the configs under prefix
+  watch <path>        stream the events of a config
+  diff <path>         diff the current version of a config with the previous one, a version or a file
+  history <path>      print the versions of a config, newest first
+  put <path>          write a config, read from --file or stdin
+  rollback <path>     write back a previous version of a config
+
+Flags:
+`
+
+// errDiffer is returned by diff when the versions differ, exiting with 1 like diff(1) does
+var errDiffer = errors.New("versions differ")
+
+// eventPattern parses the events sent by WatchConfig, i.e: [2020-05-01 10:00:00 +0000 UTC] - CONFIG_UPDATED: /etc/app.yaml
+var eventPattern = regexp.MustCompile(`^\[(.*)\] - (\w+): (.*)$`)
+
+type command func(ctx context.Context, c api.GonfigClient, args []string, out io.Writer) error
+
+var commands map[string]command = map[string]command{
+	"get":      getCmd,
+	"list":     listCmd,
+	"watch":    watchCmd,
+	"diff":     diffCmd,
+	"history":  historyCmd,
+	"put":      putCmd,
+	"rollback": rollbackCmd,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs gonfigctl with args, returning the exit code
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("gonfigctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	addr := fs.String("server-addr", "localhost:8080", "gRPC address of gonfigd")
+	caFile := fs.String("ca-file", "", "CA verifying the gonfigd certificate. Enables TLS")
+	certFile := fs.String("cert-file", "", "Client certificate presented to gonfigd running with mTLS")
+	keyFile := fs.String("key-file", "", "Client certificate private key")
+	tokenFile := fs.String("token-file", "", "File with the bearer token sent to gonfigd")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long to wait for gonfigd, except when watching")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %s\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+
+	opts, err := client.DialOptions(*caFile, *certFile, *keyFile, *tokenFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to configure the connection: %v\n", err)
+		return 1
+	}
+	conn, err := grpc.Dial(*addr, opts...)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to connect to %s: %v\n", *addr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	if fs.Arg(0) != "watch" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	err = cmd(ctx, api.NewGonfigClient(conn), fs.Args()[1:], stdout)
+	switch {
+	case err == errDiffer:
+		return 1
+	case errors.Is(err, flag.ErrHelp):
+		return 2
+	case err != nil:
+		fmt.Fprintf(stderr, "%s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+// parse parses the flags of a command, which must be followed by nargs arguments
+func parse(fs *flag.FlagSet, args []string, nargs int, usage string) error {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gonfigctl %s\n", usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	return nil
+}
+
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("o", "text", "Output format, text or json")
+}
+
+func getCmd(ctx context.Context, c api.GonfigClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	output := fs.String("o", "text", "Output format, text or env")
+	prefix := fs.String("prefix", "", "Prefix of the environment variable names")
+	separator := fs.String("separator", "_", "Separator of the keys in environment variable names")
+	casing := fs.String("casing", "upper", "Casing of the environment variable names, upper, lower or preserve")
+	if err := parse(fs, args, 1, "get [-o text|env] <path>"); err != nil {
+		return err
+	}
+	req := &api.GetConfigRequest{ConfigPath: fs.Arg(0)}
+	switch *output {
+	case "text":
+	case api.FormatEnv:
+		req.Format = api.FormatEnv
+		req.Env = &api.EnvOptions{Prefix: *prefix, Separator: *separator, Casing: *casing}
+	default:
+		return fmt.Errorf("output %s is not one of text or env", *output)
+	}
+	resp, err := c.GetConfig(ctx, req)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(out, resp.Config)
+	return nil
+}
+
+func listCmd(ctx context.Context, c api.GonfigClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	output := outputFlag(fs)
+	prefix := ""
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		prefix = fs.Arg(0)
+	}
+	resp, err := c.ListConfigs(ctx, &api.ListConfigsRequest{Prefix: prefix})
+	if err != nil {
+		return err
+	}
+	for _, info := range resp.Configs {
+		lastModified := time.Unix(0, info.LastModified).UTC()
+		if *output == "json" {
+			writeJSON(out, map[string]interface{}{"path": info.ConfigPath, "md5": info.Md5, "lastModified": lastModified})
+		} else {
+			fmt.Fprintf(out, "%s  %s  %s\n", info.Md5, lastModified.Format(time.RFC3339), info.ConfigPath)
+		}
+	}
+	return nil
+}
+
+func watchCmd(ctx context.Context, c api.GonfigClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	output := outputFlag(fs)
+	if err := parse(fs, args, 1, "watch [-o text|json] <path>"); err != nil {
+		return err
+	}
+	stream, err := c.WatchConfig(ctx, &api.WatchConfigRequest{ConfigPath: fs.Arg(0)})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if *output != "json" {
+			fmt.Fprintln(out, resp.Event)
+			continue
+		}
+		ev := map[string]interface{}{"subscriptionID": resp.SubscriptionID, "event": resp.Event}
+		if m := eventPattern.FindStringSubmatch(resp.Event); m != nil {
+			ev["time"], ev["kind"], ev["path"] = m[1], m[2], m[3]
+		}
+		writeJSON(out, ev)
+	}
+}
+
+// versions returns the versions of path, newest first
+func versions(ctx context.Context, c api.GonfigClient, path string) ([]*api.ConfigVersion, error) {
+	resp, err := c.GetHistory(ctx, &api.GetHistoryRequest{ConfigPath: path})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Versions, nil
+}
+
+func findVersion(versions []*api.ConfigVersion, md5 string) (*api.ConfigVersion, error) {
+	for _, v := range versions {
+		if v.Md5 == md5 && !v.Deleted {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("version %s not found", md5)
+}
+
+func diffCmd(ctx context.Context, c api.GonfigClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	file := fs.String("file", "", "Diff the config, as served, with this file")
+	version := fs.String("version", "", "Diff the current version with this one, by md5. The previous version when neither --file nor --version are set")
+	if err := parse(fs, args, 1, "diff [--file <file> | --version <md5>] <path>"); err != nil {
+		return err
+	}
+	path := fs.Arg(0)
+	var from, to, fromName, toName string
+	if *file != "" {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		resp, err := c.GetConfig(ctx, &api.GetConfigRequest{ConfigPath: path})
+		if err != nil {
+			return err
+		}
+		from, fromName, to, toName = string(data), *file, resp.Config, path
+	} else {
+		vs, err := versions(ctx, c, path)
+		if err != nil {
+			return err
+		}
+		current := vs[0]
+		var previous *api.ConfigVersion
+		switch {
+		case *version != "":
+			if previous, err = findVersion(vs, *version); err != nil {
+				return err
+			}
+		case len(vs) > 1:
+			previous = vs[1]
+		default:
+			return fmt.Errorf("%s has no previous version", path)
+		}
+		from, fromName = previous.Config, fmt.Sprintf("%s@%s", path, previous.Md5)
+		to, toName = current.Config, fmt.Sprintf("%s@%s", path, current.Md5)
+		if current.Deleted {
+			to, toName = "", fmt.Sprintf("%s (deleted)", path)
+		}
+		if previous.Deleted {
+			from, fromName = "", fmt.Sprintf("%s (deleted)", path)
+		}
+	}
+	text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from),
+		B:        difflib.SplitLines(to),
+		FromFile: fromName,
+		ToFile:   toName,
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		return nil
+	}
+	fmt.Fprint(out, text)
+	return errDiffer
+}
+
+func historyCmd(ctx context.Context, c api.GonfigClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	output := outputFlag(fs)
+	if err := parse(fs, args, 1, "history [-o text|json] <path>"); err != nil {
+		return err
+	}
+	vs, err := versions(ctx, c, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, v := range vs {
+		lastModified := time.Unix(0, v.LastModified).UTC()
+		if *output == "json" {
+			writeJSON(out, map[string]interface{}{"md5": v.Md5, "lastModified": lastModified, "deleted": v.Deleted, "metadata": v.Metadata})
+			continue
+		}
+		md5 := v.Md5
+		if v.Deleted {
+			md5 = "deleted"
+		}
+		var metadata []string
+		for k, val := range v.Metadata {
+			metadata = append(metadata, k+"="+val)
+		}
+		fmt.Fprintf(out, "%-32s  %s  %s\n", md5, lastModified.Format(time.RFC3339), strings.Join(metadata, " "))
+	}
+	return nil
+}
+
+func putCmd(ctx context.Context, c api.GonfigClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	file := fs.String("file", "", "File with the config to write, stdin when empty")
+	expectedMD5 := fs.String("expected-md5", "", "Only write if the current config has this md5")
+	if err := parse(fs, args, 1, "put [--file <file>] [--expected-md5 <md5>] <path>"); err != nil {
+		return err
+	}
+	var data []byte
+	var err error
+	if *file != "" {
+		data, err = ioutil.ReadFile(*file)
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := c.PutConfig(ctx, &api.PutConfigRequest{ConfigPath: fs.Arg(0), Config: string(data), ExpectedMD5: *expectedMD5})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, resp.Md5)
+	return nil
+}
+
+func rollbackCmd(ctx context.Context, c api.GonfigClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	to := fs.String("to", "", "md5 of the version to roll back to, see history")
+	if err := parse(fs, args, 1, "rollback --to <md5> <path>"); err != nil {
+		return err
+	}
+	if *to == "" {
+		return errors.New("--to is required")
+	}
+	vs, err := versions(ctx, c, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	target, err := findVersion(vs, *to)
+	if err != nil {
+		return err
+	}
+	// Fails if the config changed meanwhile
+	expected := vs[0].Md5
+	if vs[0].Deleted {
+		expected = ""
+	}
+	resp, err := c.PutConfig(ctx, &api.PutConfigRequest{ConfigPath: fs.Arg(0), Config: target.Config, ExpectedMD5: expected})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, resp.Md5)
+	return nil
+}
+
+func writeJSON(out io.Writer, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintln(out, string(data))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/configtree"
+	"github.com/fcgravalos/gonfigd/history"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func serve(t *testing.T, root string) (*history.Store, string, func()) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	store := history.NewStore(db, history.DefaultSize)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := api.NewServer(store, ps, configtree.NewWriter(root), nil, zerolog.Nop())
+	s.SetHistory(store)
+	server := grpc.NewServer()
+	api.RegisterGonfigServer(server, s)
+	go server.Serve(lis)
+	return store, lis.Addr().String(), server.Stop
+}
+
+func put(t *testing.T, db kv.KV, path string, config string) *kv.Value {
+	v, _ := kv.NewValue([]byte(config))
+	if err := db.Put(path, v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func gonfigctl(addr string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"--server-addr", addr}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gonfigctl-tests")
+	defer os.RemoveAll(dir)
+	db, addr, stop := serve(t, dir)
+	defer stop()
+	path := filepath.Join(dir, "db.yaml")
+	v1 := put(t, db, path, "host: db\nport: 5432\n")
+	v2 := put(t, db, path, "host: db\nport: 5433\n")
+	put(t, db, filepath.Join(dir, "cache.yaml"), "ttl: 1\n")
+
+	code, out, _ := gonfigctl(addr, "get", path)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "host: db\nport: 5433\n", out)
+
+	codeEnv, outEnv, _ := gonfigctl(addr, "get", "-o", "env", "--prefix", "db", path)
+	assert.Equal(t, 0, codeEnv)
+	assert.Equal(t, "DB_HOST=db\nDB_PORT=5433\n", outEnv)
+
+	code2, out2, _ := gonfigctl(addr, "list", "-o", "json", filepath.Join(dir, "d"))
+	assert.Equal(t, 0, code2)
+	var info map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(out2), &info))
+	assert.Equal(t, path, info["path"])
+	assert.Equal(t, v2.MD5(), info["md5"])
+
+	code3, out3, _ := gonfigctl(addr, "history", path)
+	assert.Equal(t, 0, code3)
+	lines := strings.Split(strings.TrimSpace(out3), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], v2.MD5()))
+	assert.True(t, strings.HasPrefix(lines[1], v1.MD5()))
+
+	code4, out4, _ := gonfigctl(addr, "diff", path)
+	assert.Equal(t, 1, code4)
+	assert.Contains(t, out4, "-port: 5432\n+port: 5433\n")
+
+	local := filepath.Join(dir, "local.yaml")
+	ioutil.WriteFile(local, []byte("host: db\nport: 5433\n"), 0644)
+	code5, out5, _ := gonfigctl(addr, "diff", "--file", local, path)
+	assert.Equal(t, 0, code5)
+	assert.Empty(t, out5)
+
+	// Rollback writes the version back to the configuration tree
+	ioutil.WriteFile(path, []byte("host: db\nport: 5433\n"), 0644)
+	code6, out6, _ := gonfigctl(addr, "rollback", "--to", v1.MD5(), path)
+	assert.Equal(t, 0, code6)
+	assert.Equal(t, v1.MD5()+"\n", out6)
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "host: db\nport: 5432\n", string(data))
+
+	code7, _, stderr7 := gonfigctl(addr, "rollback", "--to", "unknown", path)
+	assert.Equal(t, 1, code7)
+	assert.Contains(t, stderr7, "version unknown not found")
+
+	code8, _, _ := gonfigctl(addr, "unknown")
+	assert.Equal(t, 2, code8)
+	code9, _, _ := gonfigctl(addr, "get")
+	assert.Equal(t, 2, code9)
+}
+
+func TestEventPattern(t *testing.T) {
+	ev := pubsub.NewEvent(pubsub.ConfigUpdated, "/etc/gonfigd/app.yaml")
+	m := eventPattern.FindStringSubmatch(ev.String())
+	assert.NotNil(t, m)
+	assert.Equal(t, "CONFIG_UPDATED", m[2])
+	assert.Equal(t, "/etc/gonfigd/app.yaml", m[3])
+}
@@ -0,0 +1,148 @@
+// Package configtree writes configs into the configuration tree on disk
+//
+// The KV is never written directly, the fswatcher picks the changes up
+// and updates the KV and publishes the events as for any other change.
+package configtree
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fcgravalos/gonfigd/fswatcher"
+	"gopkg.in/yaml.v2"
+)
+
+// Writer writes and deletes configs within a root folder
+type Writer struct {
+	sync.Mutex
+	root string
+}
+
+// NewWriter returns a new *Writer for the configuration tree at root
+func NewWriter(root string) *Writer {
+	return &Writer{root: root}
+}
+
+// validatePath checks path is a valid config file name within the root folder
+// Paths must be clean, i.e: without "..", so they are the same ones the ACL policy was checked against
+func (w *Writer) validatePath(path string) error {
+	if path != filepath.Clean(path) {
+		return NewInvalidPathError(path, "it is not a clean path")
+	}
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return NewInvalidPathError(path, fmt.Sprintf("it is not within %s", w.root))
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if !fswatcher.IsValidFileName(part) {
+			return NewInvalidPathError(path, fmt.Sprintf("%s is a hidden or temporary file name", part))
+		}
+	}
+	return nil
+}
+
+// validateContent checks YAML and JSON configs can be parsed
+func validateContent(path string, data []byte) error {
+	var doc interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".json":
+		err = json.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return NewInvalidContentError(path, err)
+	}
+	return nil
+}
+
+// checkMD5 checks the current content of path has the expected md5, if any
+func checkMD5(path string, expectedMD5 string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if expectedMD5 != "" {
+			return NewNotFoundError(path)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if actual := fmt.Sprintf("%x", md5.Sum(data)); expectedMD5 != "" && actual != expectedMD5 {
+		return NewConflictError(path, expectedMD5, actual)
+	}
+	return nil
+}
+
+// Put atomically writes data into path, returning its md5
+// expectedMD5 string, when not empty, the write only happens if the current config has that md5
+func (w *Writer) Put(path string, data []byte, expectedMD5 string) (string, error) {
+	if err := w.validatePath(path); err != nil {
+		return "", err
+	}
+	if err := validateContent(path, data); err != nil {
+		return "", err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if err := checkMD5(path, expectedMD5); err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	// The .tmp extension keeps the fswatcher from picking the file up before it is complete
+	tmp, err := ioutil.TempFile(dir, fmt.Sprintf(".%s-*.tmp", filepath.Base(path)))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum(data)), nil
+}
+
+// Delete removes path
+// expectedMD5 string, when not empty, the delete only happens if the current config has that md5
+func (w *Writer) Delete(path string, expectedMD5 string) error {
+	if err := w.validatePath(path); err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if err := checkMD5(path, expectedMD5); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return NewNotFoundError(path)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package configtree
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPut(t *testing.T) {
+	root, _ := ioutil.TempDir("", "configtree-tests")
+	defer os.RemoveAll(root)
+	w := NewWriter(root)
+	path := filepath.Join(root, "app", "db.yaml")
+
+	sum, err := w.Put(path, []byte("foo: bar"), "")
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("foo: bar"))), sum)
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "foo: bar", string(data))
+
+	_, err2 := w.Put(path, []byte("foo: baz"), "0123")
+	assert.EqualError(t, err2, fmt.Sprintf("[%s] Config %s has md5 %s, expected 0123", Conflict, path, sum))
+
+	sum2, err3 := w.Put(path, []byte("foo: baz"), sum)
+	assert.Nil(t, err3)
+	assert.NotEqual(t, sum, sum2)
+
+	_, err4 := w.Put(path, []byte("foo: [bar"), "")
+	assert.True(t, IsInvalidContentError(err4))
+
+	_, err5 := w.Put(filepath.Join(root, "app.json"), []byte("{\"foo\": "), "")
+	assert.True(t, IsInvalidContentError(err5))
+
+	_, err6 := w.Put(filepath.Join(root, "..", "escaped.yaml"), []byte("foo: bar"), "")
+	assert.True(t, IsInvalidPathError(err6))
+
+	_, err7 := w.Put(filepath.Join(root, ".hidden.yaml"), []byte("foo: bar"), "")
+	assert.True(t, IsInvalidPathError(err7))
+
+	// Paths with .. are rejected even when they resolve within the root folder
+	_, err9 := w.Put(root+"/app/../secret.yaml", []byte("foo: bar"), "")
+	assert.True(t, IsInvalidPathError(err9))
+	_, statErr := os.Stat(filepath.Join(root, "secret.yaml"))
+	assert.True(t, os.IsNotExist(statErr))
+
+	_, err8 := w.Put(filepath.Join(root, "missing.yaml"), []byte("foo: bar"), sum)
+	assert.True(t, IsNotFoundError(err8))
+
+	files, _ := ioutil.ReadDir(filepath.Join(root, "app"))
+	assert.Len(t, files, 1)
+}
+
+func TestDelete(t *testing.T) {
+	root, _ := ioutil.TempDir("", "configtree-tests")
+	defer os.RemoveAll(root)
+	w := NewWriter(root)
+	path := filepath.Join(root, "db.yaml")
+	sum, _ := w.Put(path, []byte("foo: bar"), "")
+
+	err := w.Delete(path, "0123")
+	assert.True(t, IsConflictError(err))
+
+	err2 := w.Delete(path, sum)
+	assert.Nil(t, err2)
+	_, statErr := os.Stat(path)
+	assert.True(t, os.IsNotExist(statErr))
+
+	err3 := w.Delete(path, "")
+	assert.True(t, IsNotFoundError(err3))
+
+	err4 := w.Delete(root, "")
+	assert.True(t, IsInvalidPathError(err4))
+
+	w.Put(path, []byte("foo: bar"), "")
+	err5 := w.Delete(root+"/app/../db.yaml", "")
+	assert.True(t, IsInvalidPathError(err5))
+	_, statErr2 := os.Stat(path)
+	assert.Nil(t, statErr2)
+}
@@ -0,0 +1,100 @@
+package configtree
+
+import "fmt"
+
+const (
+	InvalidPath    ErrType = "INVALID_PATH_ERROR"
+	InvalidContent ErrType = "INVALID_CONTENT_ERROR"
+	Conflict       ErrType = "CONFLICT_ERROR"
+	NotFound       ErrType = "NOT_FOUND_ERROR"
+	Unknown        ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidPathError struct {
+	errType ErrType
+	path    string
+	reason  string
+}
+
+type InvalidContentError struct {
+	errType ErrType
+	path    string
+	err     error
+}
+
+type ConflictError struct {
+	errType  ErrType
+	path     string
+	expected string
+	actual   string
+}
+
+type NotFoundError struct {
+	errType ErrType
+	path    string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidPathError:
+		return InvalidPath
+	case InvalidContentError:
+		return InvalidContent
+	case ConflictError:
+		return Conflict
+	case NotFoundError:
+		return NotFound
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidPathError(e error) bool {
+	return getErrorType(e) == InvalidPath
+}
+
+func IsInvalidContentError(e error) bool {
+	return getErrorType(e) == InvalidContent
+}
+
+func IsConflictError(e error) bool {
+	return getErrorType(e) == Conflict
+}
+
+func IsNotFoundError(e error) bool {
+	return getErrorType(e) == NotFound
+}
+
+func (e InvalidPathError) Error() string {
+	return fmt.Sprintf("[%s] Path %s is not valid: %s", e.errType, e.path, e.reason)
+}
+
+func (e InvalidContentError) Error() string {
+	return fmt.Sprintf("[%s] Content of %s is not valid: %v", e.errType, e.path, e.err)
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("[%s] Config %s has md5 %s, expected %s", e.errType, e.path, e.actual, e.expected)
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("[%s] Config %s does not exist", e.errType, e.path)
+}
+
+func NewInvalidPathError(path string, reason string) InvalidPathError {
+	return InvalidPathError{errType: InvalidPath, path: path, reason: reason}
+}
+
+func NewInvalidContentError(path string, err error) InvalidContentError {
+	return InvalidContentError{errType: InvalidContent, path: path, err: err}
+}
+
+func NewConflictError(path string, expected string, actual string) ConflictError {
+	return ConflictError{errType: Conflict, path: path, expected: expected, actual: actual}
+}
+
+func NewNotFoundError(path string) NotFoundError {
+	return NotFoundError{errType: NotFound, path: path}
+}
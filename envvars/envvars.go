@@ -0,0 +1,180 @@
+// Package envvars exports configs as environment variables, for apps configured through them
+//
+// A YAML or JSON config is flattened into a variable per value, named after the keys leading
+// to it, joined by a separator and prefixed. I.e: with the APP prefix,
+//
+//	db:
+//	  host: localhost
+//	  ports: [5432, 5433]
+//
+// is exported as APP_DB_HOST=localhost, APP_DB_PORTS_0=5432 and APP_DB_PORTS_1=5433.
+// Characters not allowed in variable names are replaced by underscores, and null values are exported empty.
+package envvars
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	Upper    Casing = "upper"
+	Lower    Casing = "lower"
+	Preserve Casing = "preserve"
+
+	// DefaultSeparator joins the prefix and keys by default
+	DefaultSeparator = "_"
+)
+
+// Casing of the variable names
+type Casing string
+
+var (
+	invalidChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+	validName    = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+	// safeValue are the values written as is by Encode, others are quoted
+	safeValue = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]*$`)
+)
+
+// ParseCasing returns the casing named name, Upper when empty
+func ParseCasing(name string) (Casing, error) {
+	switch c := Casing(strings.ToLower(name)); c {
+	case "":
+		return Upper, nil
+	case Upper, Lower, Preserve:
+		return c, nil
+	default:
+		return "", NewInvalidOptionsError(fmt.Sprintf("casing %s is not one of upper, lower or preserve", name))
+	}
+}
+
+// Options of Flatten
+type Options struct {
+	// Prefix is prepended to every name, followed by Separator
+	Prefix string
+	// Separator joins the prefix and keys, DefaultSeparator when empty
+	Separator string
+	// Casing of the names, Upper when empty
+	Casing Casing
+}
+
+// Var is an environment variable
+type Var struct {
+	Name  string
+	Value string
+}
+
+func (v Var) String() string {
+	return v.Name + "=" + v.Value
+}
+
+// flattener walks a decoded config, collecting its variables
+type flattener struct {
+	opts Options
+	vars map[string]string
+}
+
+func (f *flattener) name(parts []string) string {
+	name := strings.Join(parts, f.opts.Separator)
+	switch f.opts.Casing {
+	case Upper:
+		name = strings.ToUpper(name)
+	case Lower:
+		name = strings.ToLower(name)
+	}
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func (f *flattener) walk(parts []string, value interface{}) error {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for k, child := range v {
+			key := invalidChars.ReplaceAllString(fmt.Sprint(k), "_")
+			if err := f.walk(append(parts[:len(parts):len(parts)], key), child); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		for i, child := range v {
+			if err := f.walk(append(parts[:len(parts):len(parts)], strconv.Itoa(i)), child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	name := f.name(parts)
+	if name == "" {
+		return NewInvalidConfigError("it is a single value, a prefix is required")
+	}
+	if _, ok := f.vars[name]; ok {
+		return NewNameConflictError(name)
+	}
+	switch v := value.(type) {
+	case nil:
+		f.vars[name] = ""
+	case string:
+		f.vars[name] = v
+	case float64:
+		f.vars[name] = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		f.vars[name] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+// Flatten returns the variables of a YAML or JSON config, sorted by name
+func Flatten(config string, opts Options) ([]Var, error) {
+	if opts.Separator == "" {
+		opts.Separator = DefaultSeparator
+	}
+	if !validName.MatchString(opts.Prefix) || !validName.MatchString(opts.Separator) {
+		return nil, NewInvalidOptionsError("prefix and separator may only have letters, digits and underscores")
+	}
+	if opts.Casing == "" {
+		opts.Casing = Upper
+	}
+	if _, err := ParseCasing(string(opts.Casing)); err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(config), &value); err != nil {
+		return nil, NewInvalidConfigError(err.Error())
+	}
+	f := &flattener{opts: opts, vars: make(map[string]string)}
+	var parts []string
+	if opts.Prefix != "" {
+		parts = []string{opts.Prefix}
+	}
+	if value != nil {
+		if err := f.walk(parts, value); err != nil {
+			return nil, err
+		}
+	}
+	vars := make([]Var, 0, len(f.vars))
+	for name, value := range f.vars {
+		vars = append(vars, Var{Name: name, Value: value})
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars, nil
+}
+
+// Encode returns vars as NAME=value lines, quoting values so they can be sourced by a shell or read as a .env file
+func Encode(vars []Var) string {
+	var b strings.Builder
+	for _, v := range vars {
+		value := v.Value
+		if !safeValue.MatchString(value) {
+			value = "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+		}
+		b.WriteString(v.Name + "=" + value + "\n")
+	}
+	return b.String()
+}
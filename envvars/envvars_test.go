@@ -0,0 +1,81 @@
+package envvars
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const config = `
+db:
+  host: localhost
+  ports: [5432, 5433]
+  ssl: true
+  timeout: 1.5
+  password:
+log-level: debug
+`
+
+func TestFlatten(t *testing.T) {
+	vars, err := Flatten(config, Options{Prefix: "app"})
+	assert.Nil(t, err)
+	assert.Equal(t, []Var{
+		{Name: "APP_DB_HOST", Value: "localhost"},
+		{Name: "APP_DB_PASSWORD", Value: ""},
+		{Name: "APP_DB_PORTS_0", Value: "5432"},
+		{Name: "APP_DB_PORTS_1", Value: "5433"},
+		{Name: "APP_DB_SSL", Value: "true"},
+		{Name: "APP_DB_TIMEOUT", Value: "1.5"},
+		{Name: "APP_LOG_LEVEL", Value: "debug"},
+	}, vars)
+
+	vars2, err := Flatten(`{"db": {"host": "localhost"}, "Port": 5432}`, Options{Separator: "__", Casing: Preserve})
+	assert.Nil(t, err)
+	assert.Equal(t, []Var{{Name: "Port", Value: "5432"}, {Name: "db__host", Value: "localhost"}}, vars2)
+
+	vars3, err := Flatten("[a, b]", Options{Casing: Lower})
+	assert.Nil(t, err)
+	assert.Equal(t, []Var{{Name: "_0", Value: "a"}, {Name: "_1", Value: "b"}}, vars3)
+
+	vars4, err := Flatten("", Options{})
+	assert.Nil(t, err)
+	assert.Empty(t, vars4)
+
+	vars5, err := Flatten("hello", Options{Prefix: "GREETING"})
+	assert.Nil(t, err)
+	assert.Equal(t, []Var{{Name: "GREETING", Value: "hello"}}, vars5)
+}
+
+func TestFlattenErrors(t *testing.T) {
+	_, err := Flatten("hello", Options{})
+	assert.True(t, IsInvalidConfigError(err))
+	_, err = Flatten("foo: [", Options{})
+	assert.True(t, IsInvalidConfigError(err))
+	_, err = Flatten("a-b: 1\na_b: 2", Options{})
+	assert.True(t, IsNameConflictError(err))
+	_, err = Flatten("a: 1", Options{Separator: "-"})
+	assert.True(t, IsInvalidOptionsError(err))
+	_, err = Flatten("a: 1", Options{Casing: "camel"})
+	assert.True(t, IsInvalidOptionsError(err))
+}
+
+func TestParseCasing(t *testing.T) {
+	c, err := ParseCasing("")
+	assert.Nil(t, err)
+	assert.Equal(t, Upper, c)
+	c2, err := ParseCasing("Lower")
+	assert.Nil(t, err)
+	assert.Equal(t, Lower, c2)
+	_, err = ParseCasing("camel")
+	assert.True(t, IsInvalidOptionsError(err))
+}
+
+func TestEncode(t *testing.T) {
+	vars := []Var{
+		{Name: "HOST", Value: "db.local:5432"},
+		{Name: "EMPTY", Value: ""},
+		{Name: "GREETING", Value: "it's me"},
+		{Name: "MULTILINE", Value: "a\nb"},
+	}
+	assert.Equal(t, "HOST=db.local:5432\nEMPTY=\nGREETING='it'\\''s me'\nMULTILINE='a\nb'\n", Encode(vars))
+}
@@ -0,0 +1,76 @@
+package envvars
+
+import "fmt"
+
+const (
+	InvalidOptions ErrType = "INVALID_OPTIONS_ERROR"
+	InvalidConfig  ErrType = "INVALID_CONFIG_ERROR"
+	NameConflict   ErrType = "NAME_CONFLICT_ERROR"
+	Unknown        ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidOptionsError struct {
+	errType ErrType
+	reason  string
+}
+
+type InvalidConfigError struct {
+	errType ErrType
+	reason  string
+}
+
+type NameConflictError struct {
+	errType ErrType
+	name    string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidOptionsError:
+		return InvalidOptions
+	case InvalidConfigError:
+		return InvalidConfig
+	case NameConflictError:
+		return NameConflict
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidOptionsError(e error) bool {
+	return getErrorType(e) == InvalidOptions
+}
+
+func IsInvalidConfigError(e error) bool {
+	return getErrorType(e) == InvalidConfig
+}
+
+func IsNameConflictError(e error) bool {
+	return getErrorType(e) == NameConflict
+}
+
+func (e InvalidOptionsError) Error() string {
+	return fmt.Sprintf("[%s] Invalid options: %s", e.errType, e.reason)
+}
+
+func (e InvalidConfigError) Error() string {
+	return fmt.Sprintf("[%s] Config cannot be exported as environment variables: %s", e.errType, e.reason)
+}
+
+func (e NameConflictError) Error() string {
+	return fmt.Sprintf("[%s] Several values are exported as %s", e.errType, e.name)
+}
+
+func NewInvalidOptionsError(reason string) InvalidOptionsError {
+	return InvalidOptionsError{errType: InvalidOptions, reason: reason}
+}
+
+func NewInvalidConfigError(reason string) InvalidConfigError {
+	return InvalidConfigError{errType: InvalidConfig, reason: reason}
+}
+
+func NewNameConflictError(name string) NameConflictError {
+	return NameConflictError{errType: NameConflict, name: name}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/fcgravalos/gonfigd/envvars"
+	"github.com/fcgravalos/gonfigd/supervisor"
+	"github.com/rs/zerolog"
+)
+
+const execUsage = `Usage: gonfigd exec [flags] -- command [args...]
+
+  runs command with configs of a daemon as files or environment variables,
+  reloading or restarting it whenever they change, and exits with its exit code
+`
+
+// pairsFlag is a repeatable flag of key=value pairs
+type pairsFlag [][2]string
+
+func (p *pairsFlag) String() string {
+	pairs := make([]string, len(*p))
+	for i, kv := range *p {
+		pairs[i] = kv[0] + "=" + kv[1]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p *pairsFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("%s is not a key=value pair", value)
+	}
+	*p = append(*p, [2]string{kv[0], kv[1]})
+	return nil
+}
+
+// stringsFlag is a repeatable flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// execCommand runs `gonfigd exec`, returning the exit code of the command
+func execCommand(args []string) int {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, execUsage)
+		fs.PrintDefaults()
+	}
+	var files, env pairsFlag
+	var envFrom stringsFlag
+	fs.Var(&files, "file", "Config written to a file, as path=destination. Can be repeated")
+	fs.Var(&env, "env", "Config exported as an environment variable, as NAME=path. Can be repeated")
+	fs.Var(&envFrom, "env-from", "Config whose values are exported as environment variables, as [PREFIX=]path. Can be repeated")
+	envSeparator := fs.String("env-separator", envvars.DefaultSeparator, "Separator of the keys in the --env-from variable names")
+	envCasing := fs.String("env-casing", "upper", "Casing of the --env-from variable names, upper, lower or preserve")
+	addr := fs.String("server-addr", "localhost:8080", "gRPC address of the daemon")
+	caFile := fs.String("ca-file", "", "CA verifying the daemon certificate. Enables TLS")
+	certFile := fs.String("cert-file", "", "Client certificate presented to the daemon running with mTLS")
+	keyFile := fs.String("key-file", "", "Client certificate private key")
+	tokenFile := fs.String("token-file", "", "File with the bearer token sent to the daemon")
+	cacheFile := fs.String("cache-file", "", "File caching the configs, used at startup when the daemon is unreachable")
+	reloadSignal := fs.String("reload-signal", "", "Signal sent to the command when a file changes, i.e: SIGHUP. The command is restarted when empty")
+	stopSignal := fs.String("stop-signal", "SIGTERM", "Signal stopping the command")
+	gracePeriod := fs.Duration("grace-period", supervisor.DefaultGracePeriod, "How long the command has to exit once stopped, before being killed")
+	debug := fs.Bool("debug", false, "Enable debug logging")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	logger := zerolog.New(os.Stderr).
+		With().
+		Timestamp().
+		Caller().
+		Logger()
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+
+	cfg := supervisor.Config{Command: fs.Args(), GracePeriod: *gracePeriod}
+	for _, f := range files {
+		cfg.Files = append(cfg.Files, supervisor.File{Path: f[0], Destination: f[1]})
+	}
+	for _, e := range env {
+		cfg.Env = append(cfg.Env, supervisor.Env{Name: e[0], Path: e[1]})
+	}
+	casing, err := envvars.ParseCasing(*envCasing)
+	if err != nil {
+		logger.Error().Msgf("%v", err)
+		return 2
+	}
+	for _, e := range envFrom {
+		opts := envvars.Options{Separator: *envSeparator, Casing: casing}
+		path := e
+		if i := strings.Index(e, "="); i >= 0 {
+			opts.Prefix, path = e[:i], e[i+1:]
+		}
+		cfg.EnvFrom = append(cfg.EnvFrom, supervisor.EnvFrom{Path: path, Options: opts})
+	}
+	if *reloadSignal != "" {
+		if cfg.ReloadSignal, err = supervisor.ParseSignal(*reloadSignal); err != nil {
+			logger.Error().Msgf("%v", err)
+			return 2
+		}
+	}
+	if cfg.StopSignal, err = supervisor.ParseSignal(*stopSignal); err != nil {
+		logger.Error().Msgf("%v", err)
+		return 2
+	}
+
+	opts, err := client.DialOptions(*caFile, *certFile, *keyFile, *tokenFile)
+	if err != nil {
+		logger.Error().Msgf("failed to configure the connection: %v", err)
+		return 1
+	}
+	c, err := client.New(client.Config{Addr: *addr, DialOptions: opts, CacheFile: *cacheFile, Logger: logger})
+	if err != nil {
+		logger.Error().Msgf("%v", err)
+		return 1
+	}
+	defer c.Close()
+	s, err := supervisor.New(cfg, c, logger)
+	if err != nil {
+		logger.Error().Msgf("%v", err)
+		return 2
+	}
+	code, err := s.Run(context.Background())
+	if err != nil {
+		logger.Error().Msgf("%v", err)
+		return 1
+	}
+	return code
+}
@@ -7,30 +7,70 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/metrics"
 	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/signing"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/fcgravalos/gonfigd/tracing"
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/api/trace"
 )
 
 var excludedFileExtensions map[string]struct{}
 
 func init() {
 	excludedFileExtensions = make(map[string]struct{})
-	for _, ext := range []string{".swp", ".swx", ".~", ".tmp"} {
+	for _, ext := range []string{".swp", ".swx", ".~", ".tmp", signing.SignatureSuffix} {
 		excludedFileExtensions[ext] = struct{}{}
 	}
 }
 
+// Kind is the kind of source of the fswatcher
+const Kind = "fs"
+
+const defaultWalkInterval = 5 * time.Second
+
+func init() {
+	source.Register(Kind, func(spec source.Spec, env source.Env) (source.Source, error) {
+		if spec.Root == "" {
+			return nil, source.NewInvalidSpecError(fmt.Sprintf("source %s must have a root", spec.Name))
+		}
+		interval, err := spec.Duration("walkInterval", defaultWalkInterval)
+		if err != nil {
+			return nil, err
+		}
+		s := NewSource(spec.Name, spec.Root, interval, env.KV, env.PS, env.Deps, env.Logger)
+		s.fsw.verifier = env.Verifier
+		return s, nil
+	})
+}
+
+// DependencyTracker keeps track of the configs referenced by other configs,
+// so dependent configs can be notified when a referenced one changes
+type DependencyTracker = source.DependencyTracker
+
 type fsWatcher struct {
+	// root is the watched folder, configs are signed for their path relative to it
+	root     string
 	watcher  *fsnotify.Watcher
 	registry *registry
 	kv       kv.KV
 	ps       pubsub.PubSub
+	deps     DependencyTracker
+	verifier *signing.Verifier
 	log      zerolog.Logger
+	// readFile reads configs, ioutil.ReadFile when nil
+	readFile func(path string) ([]byte, error)
+	// rejected holds the modTime of the configs failing verification,
+	// so walks skip them until they or their signatures change
+	rejected   map[string]time.Time
+	rejectedMu sync.Mutex
 }
 
 type registry struct {
@@ -55,7 +95,9 @@ func (r *registry) unregister(path string) {
 	r.Unlock()
 }
 
-func isValidFileName(name string) bool {
+// IsValidFileName checks whether a file name is a config the fswatcher keeps track of
+// Hidden files and editor or temporary files are not
+func IsValidFileName(name string) bool {
 	// Discard hidden files
 	if match, _ := filepath.Match("\\.*", name); match {
 		return false
@@ -71,26 +113,104 @@ func isValidFile(name string) bool {
 	if err != nil {
 		return false
 	}
-	return fi.Mode().IsRegular() && isValidFileName(filepath.Base(name))
+	return fi.Mode().IsRegular() && IsValidFileName(filepath.Base(name))
 }
 
-func (fsw *fsWatcher) upsertFileOnDb(path string) (bool, error) {
-	changed := false
-	data, err := ioutil.ReadFile(path)
+func (fsw *fsWatcher) upsertFileOnDb(ctx context.Context, path string) (bool, error) {
+	_, changed, err := fsw.upsert(ctx, path)
+	return changed, err
+}
+
+// upsert stores the config in path into the KV, returning whether it changed,
+// and whether it was created, as the key was missing
+func (fsw *fsWatcher) upsert(ctx context.Context, path string) (created bool, changed bool, err error) {
+	_, span := tracing.Tracer().Start(ctx, "fswatcher.upsertFileOnDb", trace.WithAttributes(tracing.ConfigPath(path)))
+	defer span.End()
+	// Taken before reading, so changes made meanwhile get the config verified again
+	modTime := fsw.lastModified(path)
+	readFile := fsw.readFile
+	if readFile == nil {
+		readFile = ioutil.ReadFile
+	}
+	// The file is read and verified without holding the KV lock, and only stored if the key did not change
+	// meanwhile. Otherwise it is read again, so concurrent events never regress the key to an older content.
+	var data []byte
+	for {
+		oldMD5 := ""
+		if old, err := fsw.kv.Get(path); err == nil {
+			oldMD5 = old.MD5()
+		}
+		if data, err = readFile(path); err != nil {
+			break
+		}
+		if fsw.verifier != nil {
+			if _, err = fsw.verifier.VerifyFile(path, fsw.signedPath(path), data); err != nil {
+				break
+			}
+		}
+		if oldMD5 == fmt.Sprintf("%x", md5.Sum(data)) {
+			break
+		}
+		var v *kv.Value
+		if v, err = kv.NewValue(data); err != nil {
+			break
+		}
+		if err = fsw.kv.PutIfMatch(path, v, oldMD5); !kv.IsConflictError(err) {
+			changed = err == nil
+			created = changed && oldMD5 == ""
+			break
+		}
+		fsw.log.Debug().Msgf("%s changed while being read, reading it again", path)
+	}
+	if fsw.verifier != nil {
+		fsw.setRejected(path, modTime, signing.IsInvalidSignatureError(err))
+	}
+	if signing.IsInvalidSignatureError(err) {
+		metrics.SignatureFailures.WithLabelValues(Kind).Inc()
+		fsw.log.Error().
+			Str("alert", "signature_verification_failed").
+			Msgf("rejecting %s, keeping its last verified version: %v", path, err)
+	}
 	if err != nil {
-		return changed, err
+		return false, false, err
+	}
+	if changed && fsw.deps != nil {
+		fsw.deps.Track(path, string(data))
 	}
+	return created, changed, nil
+}
 
-	v, err := fsw.kv.Get(path)
-	if (v != nil && v.MD5() != fmt.Sprintf("%x", md5.Sum(data))) || err != nil {
-		newVal, _ := kv.NewValue(data)
-		err = fsw.kv.Put(path, newVal)
-		if err != nil {
-			return changed, err
+// lastModified returns the latest modification time of a config and its signature file,
+// so fixing any of them makes a rejected config to be verified again
+func (fsw *fsWatcher) lastModified(path string) time.Time {
+	var last time.Time
+	for _, f := range []string{path, path + signing.SignatureSuffix} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(last) {
+			last = fi.ModTime()
 		}
-		changed = true
 	}
-	return changed, nil
+	return last
+}
+
+func (fsw *fsWatcher) setRejected(path string, modTime time.Time, rejected bool) {
+	fsw.rejectedMu.Lock()
+	defer fsw.rejectedMu.Unlock()
+	if !rejected {
+		delete(fsw.rejected, path)
+		return
+	}
+	if fsw.rejected == nil {
+		fsw.rejected = make(map[string]time.Time)
+	}
+	fsw.rejected[path] = modTime
+}
+
+// isRejected checks whether the config failed verification and has not changed since
+func (fsw *fsWatcher) isRejected(path string) bool {
+	fsw.rejectedMu.Lock()
+	modTime, ok := fsw.rejected[path]
+	fsw.rejectedMu.Unlock()
+	return ok && modTime.Equal(fsw.lastModified(path))
 }
 
 func (fsw *fsWatcher) walk(path string, fi os.FileInfo, err error) error {
@@ -102,16 +222,38 @@ func (fsw *fsWatcher) walk(path string, fi os.FileInfo, err error) error {
 
 		// If it's a regular file, we don't have to set a fsnotify watch but we check if it's stored in db
 	} else if isValidFile(path) {
-		if _, err := fsw.kv.Get(path); err != nil {
+		// Configs failing verification are not alerted again on every walk
+		if _, err := fsw.kv.Get(path); err != nil && !fsw.isRejected(path) {
 			fsw.log.Warn().Msgf("missing file %s in kv, inserting and creating event", path)
-			return fsw.createEventHandler(path)
+			ctx, span := tracing.Tracer().Start(context.Background(), "fswatcher.walk", trace.WithAttributes(tracing.ConfigPath(path)))
+			defer span.End()
+			return fsw.createOrWriteEventHandler(ctx, path)
+		}
+	}
+	return nil
+}
+
+// resync adds the watches of every folder and upserts every config, so changes made
+// before the watches were added, i.e: since the snapshot, are not lost
+func (fsw *fsWatcher) resync(path string, fi os.FileInfo, err error) error {
+	if err != nil {
+		return nil
+	}
+	if fi.IsDir() {
+		return fsw.walk(path, fi, err)
+	}
+	if isValidFile(path) {
+		ctx, span := tracing.Tracer().Start(context.Background(), "fswatcher.resync", trace.WithAttributes(tracing.ConfigPath(path)))
+		defer span.End()
+		if err := fsw.createOrWriteEventHandler(ctx, path); err != nil && !signing.IsInvalidSignatureError(err) {
+			fsw.log.Error().Msgf("failed to resync %s: %v", path, err)
 		}
 	}
 	return nil
 }
 
-func (fsw *fsWatcher) publishEvent(config string, evType pubsub.EventType) error {
-	ev := pubsub.NewEvent(evType, config)
+func (fsw *fsWatcher) publishEvent(ctx context.Context, config string, evType pubsub.EventType) error {
+	ev := pubsub.NewEventWithContext(ctx, evType, config)
 	if !fsw.ps.TopicExists(config) {
 		err := fsw.ps.CreateTopic(config)
 		if err != nil {
@@ -121,55 +263,98 @@ func (fsw *fsWatcher) publishEvent(config string, evType pubsub.EventType) error
 	return fsw.ps.Publish(config, ev)
 }
 
-func (fsw *fsWatcher) createOrWriteEventHandler(name string, evType pubsub.EventType) error {
-	changed, err := fsw.upsertFileOnDb(name)
+// publishDependentsEvents notifies every config referencing the given one that it has been updated
+func (fsw *fsWatcher) publishDependentsEvents(ctx context.Context, config string) error {
+	if fsw.deps == nil {
+		return nil
+	}
+	for _, d := range fsw.deps.Dependents(config) {
+		if err := fsw.publishEvent(ctx, d, pubsub.ConfigUpdated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createOrWriteEventHandler publishes ConfigCreated when the config was missing, whichever of the
+// CREATE and WRITE events of a new file is handled first, and ConfigUpdated otherwise,
+// i.e: files replaced by a rename (atomic writes) update the existing config
+func (fsw *fsWatcher) createOrWriteEventHandler(ctx context.Context, name string) error {
+	created, changed, err := fsw.upsert(ctx, name)
 	if err != nil {
 		return err
 	}
 	if changed {
-		return fsw.publishEvent(name, evType)
+		evType := pubsub.ConfigUpdated
+		if created {
+			evType = pubsub.ConfigCreated
+		}
+		if err := fsw.publishEvent(ctx, name, evType); err != nil {
+			return err
+		}
+		return fsw.publishDependentsEvents(ctx, name)
 	}
 	return nil
 }
 
-func (fsw *fsWatcher) createEventHandler(name string) error {
-	return fsw.createOrWriteEventHandler(name, pubsub.ConfigCreated)
-}
-
-func (fsw *fsWatcher) writeEventHandler(name string) error {
-	return fsw.createOrWriteEventHandler(name, pubsub.ConfigUpdated)
-}
-
-func (fsw *fsWatcher) removeEventHandler(name string) error {
+func (fsw *fsWatcher) removeEventHandler(ctx context.Context, name string) error {
 	if fsw.registry.isRegistered(name) {
 		if err := fsw.watcher.Remove(name); err != nil {
 			return err
 		}
 		fsw.registry.unregister(name)
 	}
+	fsw.setRejected(name, time.Time{}, false)
 	err := fsw.kv.Delete(name)
 	if err != nil {
 		return err
 	}
-	return fsw.publishEvent(name, pubsub.ConfigDeleted)
+	if fsw.deps != nil {
+		fsw.deps.Untrack(name)
+	}
+	if err := fsw.publishEvent(ctx, name, pubsub.ConfigDeleted); err != nil {
+		return err
+	}
+	return fsw.publishDependentsEvents(ctx, name)
+}
+
+// signedPath returns the path a config is signed for, its slash separated path relative to root
+func (fsw *fsWatcher) signedPath(path string) string {
+	rel, err := filepath.Rel(fsw.root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// signedConfig returns the config a signature file belongs to, if signatures are verified,
+// so the config is verified again when its signature changes
+func (fsw *fsWatcher) signedConfig(name string) string {
+	if fsw.verifier == nil || !strings.HasSuffix(name, signing.SignatureSuffix) {
+		return ""
+	}
+	if config := strings.TrimSuffix(name, signing.SignatureSuffix); isValidFile(config) {
+		return config
+	}
+	return ""
 }
 
 func (fsw *fsWatcher) routeEvent(ev fsnotify.Event) {
 	evOp := ev.Op.String()
+	metrics.FsEvents.WithLabelValues(evOp).Inc()
+	ctx, span := tracing.Tracer().Start(context.Background(), "fswatcher."+evOp, trace.WithAttributes(tracing.ConfigPath(ev.Name)))
+	defer span.End()
 	var err error
 	switch evOp {
-	case "CREATE":
+	case "CREATE", "WRITE":
 		if isValidFile(ev.Name) {
-			err = fsw.createEventHandler(ev.Name)
-		}
-		break
-	case "WRITE":
-		if isValidFile(ev.Name) {
-			err = fsw.writeEventHandler(ev.Name)
+			err = fsw.createOrWriteEventHandler(ctx, ev.Name)
+		} else if config := fsw.signedConfig(ev.Name); config != "" {
+			err = fsw.createOrWriteEventHandler(ctx, config)
 		}
 		break
 	case "REMOVE":
-		err = fsw.removeEventHandler(ev.Name)
+		err = fsw.removeEventHandler(ctx, ev.Name)
 		break
 	default:
 		err = nil
@@ -182,18 +367,27 @@ func (fsw *fsWatcher) routeEvent(ev fsnotify.Event) {
 }
 
 // Start creates a new fsWatcher
+// deps DependencyTracker is optional, when nil, configs referencing others won't be notified
 // It will return an error if it's not able to create a *fsnotify.Watcer
-func Start(ctx context.Context, root string, fwalkInterval time.Duration, kv kv.KV, ps pubsub.PubSub, logger zerolog.Logger) error {
+func Start(ctx context.Context, root string, fwalkInterval time.Duration, kv kv.KV, ps pubsub.PubSub, deps DependencyTracker, logger zerolog.Logger) error {
+	fsw := &fsWatcher{root: root, kv: kv, ps: ps, deps: deps, log: logger}
+	return fsw.run(ctx, root, fwalkInterval)
+}
+
+func (fsw *fsWatcher) run(ctx context.Context, root string, fwalkInterval time.Duration) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		logger.Error().Msgf("failed to create new fsnotify watcher: %v", err)
+		fsw.log.Error().Msgf("failed to create new fsnotify watcher: %v", err)
 		return err
 	}
 	defer watcher.Close()
-	registry := &registry{
+	fsw.watcher = watcher
+	fsw.registry = &registry{
 		r: map[string]struct{}{},
 	}
-	fsw := &fsWatcher{watcher: watcher, registry: registry, kv: kv, ps: ps, log: logger}
+
+	fsw.log.Debug().Msgf("resyncing %s directory", root)
+	filepath.Walk(root, fsw.resync)
 
 	stopCh := make(chan struct{}, 1)
 	go func(ctx context.Context, root string, fsw *fsWatcher, stopCh chan struct{}) {
@@ -201,7 +395,9 @@ func Start(ctx context.Context, root string, fwalkInterval time.Duration, kv kv.
 			select {
 			case <-time.After(fwalkInterval):
 				fsw.log.Debug().Msgf("walking %s directory", root)
+				start := time.Now()
 				filepath.Walk(root, fsw.walk)
+				metrics.WalkDuration.Observe(time.Since(start).Seconds())
 				break
 			case <-ctx.Done():
 				stopCh <- struct{}{}
@@ -211,17 +407,72 @@ func Start(ctx context.Context, root string, fwalkInterval time.Duration, kv kv.
 		}
 	}(ctx, root, fsw, stopCh)
 
+	// handlers are the events being routed, waited for on stop so their changes are published
+	var handlers sync.WaitGroup
 	for {
 		select {
 		case ev := <-fsw.watcher.Events:
-			go fsw.routeEvent(ev)
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				fsw.routeEvent(ev)
+			}()
 		case err := <-fsw.watcher.Errors:
 			fsw.log.Error().Msgf("error watching for filesystem changes: %v\n", err)
 		case <-ctx.Done():
 			<-stopCh
+			handlers.Wait()
 			fsw.log.Info().Msgf("fswatcher stopped")
 			return nil
 		}
 	}
+}
+
+// Source is the fswatcher as a source.Source
+type Source struct {
+	name     string
+	root     string
+	interval time.Duration
+	fsw      *fsWatcher
+}
+
+// NewSource returns a new *Source watching root
+// deps DependencyTracker is optional, when nil, configs referencing others won't be notified
+func NewSource(name string, root string, fwalkInterval time.Duration, kv kv.KV, ps pubsub.PubSub, deps DependencyTracker, logger zerolog.Logger) *Source {
+	return &Source{
+		name:     name,
+		root:     root,
+		interval: fwalkInterval,
+		fsw:      &fsWatcher{root: root, kv: kv, ps: ps, deps: deps, log: logger},
+	}
+}
+
+// Name implements source.Source
+func (s *Source) Name() string {
+	return s.name
+}
+
+// Snapshot stores every config under root into the KV
+func (s *Source) Snapshot(ctx context.Context) error {
+	return filepath.Walk(s.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && path != s.root && !IsValidFileName(fi.Name()) {
+			return filepath.SkipDir
+		}
+		if !isValidFile(path) {
+			return nil
+		}
+		// Configs failing verification are left out, they have already been alerted
+		if _, err = s.fsw.upsertFileOnDb(ctx, path); err != nil && !signing.IsInvalidSignatureError(err) {
+			return err
+		}
+		return nil
+	})
+}
 
+// Start watches root until ctx is done
+func (s *Source) Start(ctx context.Context) error {
+	return s.fsw.run(ctx, s.root, s.interval)
 }
@@ -2,6 +2,8 @@ package fswatcher
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,7 +12,11 @@ import (
 	"time"
 
 	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/metrics"
 	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/signing"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,7 +37,7 @@ func TestUpsertFileOnDb(t *testing.T) {
 		panic(err)
 	}
 	fsw := &fsWatcher{kv: testCfg.kv, ps: testCfg.ps}
-	changed, e1 := fsw.upsertFileOnDb(fullPath)
+	changed, e1 := fsw.upsertFileOnDb(context.Background(), fullPath)
 	assert.Nil(t, e1)
 	assert.True(t, changed)
 
@@ -39,7 +45,7 @@ func TestUpsertFileOnDb(t *testing.T) {
 	assert.Nil(t, e2)
 	assert.Equal(t, "foo: bar", v1.Text())
 
-	changed2, e3 := fsw.upsertFileOnDb(fullPath)
+	changed2, e3 := fsw.upsertFileOnDb(context.Background(), fullPath)
 	assert.Nil(t, e3)
 	assert.False(t, changed2)
 
@@ -51,7 +57,7 @@ func TestUpsertFileOnDb(t *testing.T) {
 	if _, err := f.WriteString("\nbar: baz"); err != nil {
 		panic(err)
 	}
-	changed3, e4 := fsw.upsertFileOnDb(fullPath)
+	changed3, e4 := fsw.upsertFileOnDb(context.Background(), fullPath)
 	assert.Nil(t, e4)
 	assert.True(t, changed3)
 
@@ -60,12 +66,185 @@ func TestUpsertFileOnDb(t *testing.T) {
 	assert.Equal(t, "foo: bar\nbar: baz", v2.Text())
 }
 
+func TestConcurrentUpsertFileOnDb(t *testing.T) {
+	fullPath := fmt.Sprintf("%s/concurrent.yaml", testCfg.root)
+	db, _ := kv.NewKV(kv.INMEMORY)
+	if err := ioutil.WriteFile(fullPath, []byte("foo: 1"), 0644); err != nil {
+		panic(err)
+	}
+
+	// The first handler reads foo: 1, then waits for a second one to store foo: 2
+	read, stored := make(chan struct{}), make(chan struct{})
+	reads := 0
+	slow := &fsWatcher{kv: db, ps: testCfg.ps, readFile: func(path string) ([]byte, error) {
+		data, err := ioutil.ReadFile(path)
+		if reads++; reads == 1 {
+			close(read)
+			<-stored
+		}
+		return data, err
+	}}
+	done := make(chan bool)
+	go func() {
+		changed, err := slow.upsertFileOnDb(context.Background(), fullPath)
+		assert.Nil(t, err)
+		done <- changed
+	}()
+
+	<-read
+	// The KV is not locked while the file is read
+	_, err := db.Get(fullPath)
+	assert.True(t, kv.IsKeyNotFoundError(err))
+	if err := ioutil.WriteFile(fullPath, []byte("foo: 2"), 0644); err != nil {
+		panic(err)
+	}
+	fsw := &fsWatcher{kv: db, ps: testCfg.ps}
+	changed, err := fsw.upsertFileOnDb(context.Background(), fullPath)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	close(stored)
+
+	// The stale read is not stored, the file is read again instead
+	assert.False(t, <-done)
+	assert.Equal(t, 2, reads)
+	v, err := db.Get(fullPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo: 2", v.Text())
+}
+
+func TestSourceSnapshot(t *testing.T) {
+	root, _ := ioutil.TempDir("", "fswatcher-snapshot")
+	defer os.RemoveAll(root)
+	os.MkdirAll(fmt.Sprintf("%s/app", root), 0755)
+	os.MkdirAll(fmt.Sprintf("%s/.git", root), 0755)
+	ioutil.WriteFile(fmt.Sprintf("%s/app/db.yaml", root), []byte("foo: bar"), 0644)
+	ioutil.WriteFile(fmt.Sprintf("%s/app/db.swp", root), []byte("foo: bar"), 0644)
+	ioutil.WriteFile(fmt.Sprintf("%s/.git/config", root), []byte("foo: bar"), 0644)
+
+	db, _ := kv.NewKV(kv.INMEMORY)
+	src, err := source.New(source.Spec{Name: "local", Kind: Kind, Root: root}, source.Env{KV: db, PS: testCfg.ps, Logger: testCfg.log})
+	assert.Nil(t, err)
+	assert.Equal(t, "local", src.Name())
+	assert.Nil(t, src.Snapshot(context.Background()))
+
+	keys, _ := db.List("")
+	assert.Equal(t, []string{fmt.Sprintf("%s/app/db.yaml", root)}, keys)
+
+	_, err2 := source.New(source.Spec{Name: "local", Kind: Kind}, source.Env{})
+	assert.True(t, source.IsInvalidSpecError(err2))
+}
+
+func TestSourceStartAfterSnapshot(t *testing.T) {
+	root, _ := ioutil.TempDir("", "fswatcher-start")
+	defer os.RemoveAll(root)
+	os.MkdirAll(fmt.Sprintf("%s/app", root), 0755)
+	fp := fmt.Sprintf("%s/app/db.yaml", root)
+	ioutil.WriteFile(fp, []byte("foo: bar"), 0644)
+
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	src := NewSource("local", root, time.Hour, db, ps, nil, testCfg.log)
+	assert.Nil(t, src.Snapshot(context.Background()))
+	ps.CreateTopic(fp)
+	sub, _ := ps.Subscribe(fp)
+
+	// Edits between the snapshot and the start are picked up without waiting for the walk interval
+	ioutil.WriteFile(fp, []byte("foo: baz"), 0644)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Start(ctx)
+
+	select {
+	case ev := <-sub.Channel():
+		assert.Equal(t, pubsub.ConfigUpdated, ev.Kind())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	v, _ := db.Get(fp)
+	assert.Equal(t, "foo: baz", v.Text())
+}
+
+func TestUpsertSignedFileOnDb(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, untrusted, _ := ed25519.GenerateKey(rand.Reader)
+	fullPath := fmt.Sprintf("%s/signed.yaml", testCfg.root)
+	fsw := &fsWatcher{
+		root:     testCfg.root,
+		kv:       testCfg.kv,
+		ps:       testCfg.ps,
+		verifier: signing.NewVerifier(map[string]ed25519.PublicKey{"ci": pub}),
+		log:      testCfg.log,
+	}
+
+	ioutil.WriteFile(fullPath, []byte("foo: bar"), 0644)
+	_, e1 := fsw.upsertFileOnDb(context.Background(), fullPath)
+	assert.True(t, signing.IsInvalidSignatureError(e1))
+	_, e2 := testCfg.kv.Get(fullPath)
+	assert.True(t, kv.IsKeyNotFoundError(e2))
+
+	ioutil.WriteFile(fullPath+signing.SignatureSuffix, signing.Sign(priv, "signed.yaml", []byte("foo: bar")), 0644)
+	assert.Equal(t, fullPath, fsw.signedConfig(fullPath+signing.SignatureSuffix))
+	changed, e3 := fsw.upsertFileOnDb(context.Background(), fullPath)
+	assert.Nil(t, e3)
+	assert.True(t, changed)
+
+	// The last verified version is kept
+	ioutil.WriteFile(fullPath, []byte("foo: baz"), 0644)
+	ioutil.WriteFile(fullPath+signing.SignatureSuffix, signing.Sign(untrusted, "signed.yaml", []byte("foo: baz")), 0644)
+	_, e4 := fsw.upsertFileOnDb(context.Background(), fullPath)
+	assert.True(t, signing.IsInvalidSignatureError(e4))
+	v, _ := testCfg.kv.Get(fullPath)
+	assert.Equal(t, "foo: bar", v.Text())
+
+	// Signatures made for another path are rejected
+	ioutil.WriteFile(fullPath+signing.SignatureSuffix, signing.Sign(priv, "other.yaml", []byte("foo: baz")), 0644)
+	_, e5 := fsw.upsertFileOnDb(context.Background(), fullPath)
+	assert.True(t, signing.IsInvalidSignatureError(e5))
+	ioutil.WriteFile(fullPath+signing.SignatureSuffix, signing.Sign(priv, "signed.yaml", []byte("foo: baz")), 0644)
+	_, e6 := fsw.upsertFileOnDb(context.Background(), fullPath)
+	assert.Nil(t, e6)
+}
+
+func TestWalkRejectedConfig(t *testing.T) {
+	root, _ := ioutil.TempDir("", "fswatcher-rejected")
+	defer os.RemoveAll(root)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	fsw := &fsWatcher{
+		root:     root,
+		kv:       db,
+		ps:       ps,
+		verifier: signing.NewVerifier(map[string]ed25519.PublicKey{"ci": pub}),
+		log:      testCfg.log,
+	}
+	fp := fmt.Sprintf("%s/signed.yaml", root)
+	ioutil.WriteFile(fp, []byte("foo: bar"), 0644)
+	fi, _ := os.Stat(fp)
+	failures := testutil.ToFloat64(metrics.SignatureFailures.WithLabelValues(Kind))
+
+	// Rejected configs are only verified again when they change
+	assert.True(t, signing.IsInvalidSignatureError(fsw.walk(fp, fi, nil)))
+	assert.Nil(t, fsw.walk(fp, fi, nil))
+	assert.Nil(t, fsw.walk(fp, fi, nil))
+	assert.Equal(t, failures+1, testutil.ToFloat64(metrics.SignatureFailures.WithLabelValues(Kind)))
+
+	ioutil.WriteFile(fp+signing.SignatureSuffix, signing.Sign(priv, "signed.yaml", []byte("foo: bar")), 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(fp+signing.SignatureSuffix, later, later)
+	assert.Nil(t, fsw.walk(fp, fi, nil))
+	v, err := db.Get(fp)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo: bar", v.Text())
+}
+
 func TestIsValidFileName(t *testing.T) {
-	assert.True(t, isValidFileName("foo.yaml"))
-	assert.False(t, isValidFileName("foo.swp"))
-	assert.False(t, isValidFileName("foo.swx"))
-	assert.False(t, isValidFileName("foo.~"))
-	assert.False(t, isValidFileName("foo.tmp"))
+	assert.True(t, IsValidFileName("foo.yaml"))
+	assert.False(t, IsValidFileName("foo.swp"))
+	assert.False(t, IsValidFileName("foo.swx"))
+	assert.False(t, IsValidFileName("foo.~"))
+	assert.False(t, IsValidFileName("foo.tmp"))
+	assert.False(t, IsValidFileName("foo.yaml.sig"))
 }
 
 func TestIsValidFile(t *testing.T) {
@@ -104,13 +283,51 @@ func TestPublishEvent(t *testing.T) {
 		done <- struct{}{}
 	}(done)
 
-	e3 := fsw.publishEvent("foo/config.yaml", pubsub.ConfigCreated)
+	e3 := fsw.publishEvent(context.Background(), "foo/config.yaml", pubsub.ConfigCreated)
 	assert.Nil(t, e3)
 	<-done
 	assert.Equal(t, "foo/config.yaml", ev.ConfigPath())
 	assert.Equal(t, pubsub.ConfigCreated, ev.Kind())
 }
 
+type fakeTracker map[string][]string
+
+func (ft fakeTracker) Track(path string, content string) {}
+
+func (ft fakeTracker) Untrack(path string) {}
+
+func (ft fakeTracker) Dependents(path string) []string {
+	return ft[path]
+}
+
+func TestPublishDependentsEvents(t *testing.T) {
+	fsw := &fsWatcher{ps: testCfg.ps, deps: fakeTracker{"base.yaml": {"app.yaml"}}}
+	e1 := fsw.ps.CreateTopic("app.yaml")
+	assert.Nil(t, e1)
+
+	sub, e2 := fsw.ps.Subscribe("app.yaml")
+	assert.Nil(t, e2)
+
+	var ev *pubsub.Event
+
+	done := make(chan struct{})
+
+	go func(done chan struct{}) {
+		scH := sub.Channel()
+		ev = <-scH
+		done <- struct{}{}
+	}(done)
+
+	e3 := fsw.publishDependentsEvents(context.Background(), "base.yaml")
+	assert.Nil(t, e3)
+	<-done
+	assert.Equal(t, "app.yaml", ev.ConfigPath())
+	assert.Equal(t, pubsub.ConfigUpdated, ev.Kind())
+
+	e4 := fsw.publishDependentsEvents(context.Background(), "app.yaml")
+	assert.Nil(t, e4)
+}
+
 func TestStart(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -120,7 +337,7 @@ func TestStart(t *testing.T) {
 	sub, _ := testCfg.ps.Subscribe(fp)
 	sCh := sub.Channel()
 
-	go Start(ctx, testCfg.root, 5*time.Second, testCfg.kv, testCfg.ps, testCfg.log)
+	go Start(ctx, testCfg.root, 5*time.Second, testCfg.kv, testCfg.ps, nil, testCfg.log)
 
 	err := ioutil.WriteFile(fp, []byte("foo: bar"), 0644)
 	if err != nil {
@@ -0,0 +1,95 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/fcgravalos/gonfigd/api"
+)
+
+// Auth holds the optional authentication and authorization of the gateway,
+// the same ones enforced by the gRPC API
+type Auth struct {
+	Authenticator api.Authenticator
+	Authorizer    api.Authorizer
+	// AllowAnonymous lets callers with neither a bearer token nor a client certificate in, when there is an Authenticator
+	AllowAnonymous bool
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(strings.ToLower(h), "bearer ") {
+		return strings.TrimSpace(h[len("bearer "):]), true
+	}
+	return "", false
+}
+
+// identify returns the caller identity: the owner of the bearer token if any,
+// then the one of the client certificate. It writes the error response when the token is not valid.
+func (s *Server) identify(w http.ResponseWriter, r *http.Request, verb acl.Verb) (string, bool) {
+	token, ok := bearerToken(r)
+	if ok && s.auth.Authenticator != nil {
+		t, err := s.auth.Authenticator.Authenticate(token)
+		if err != nil {
+			s.log.Warn().
+				Str("audit", "unauthenticated").
+				Str("method", r.Method+" "+r.URL.Path).
+				Msg("invalid bearer token")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid bearer token"))
+			return "", false
+		}
+		if !t.Allows(verb) {
+			s.log.Warn().
+				Str("audit", "denied").
+				Str("identity", t.Name).
+				Str("verb", string(verb)).
+				Str("method", r.Method+" "+r.URL.Path).
+				Msg("token scope does not allow verb")
+			writeError(w, http.StatusForbidden, fmt.Errorf("token %s is not allowed to %s", t.Name, verb))
+			return "", false
+		}
+		return t.Name, true
+	}
+	identity := api.Anonymous
+	if r.TLS != nil {
+		identity = api.IdentityFromTLS(*r.TLS)
+	}
+	if identity == api.Anonymous && s.auth.Authenticator != nil && !s.auth.AllowAnonymous {
+		s.log.Warn().
+			Str("audit", "unauthenticated").
+			Str("method", r.Method+" "+r.URL.Path).
+			Msg("missing bearer token")
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("missing bearer token"))
+		return "", false
+	}
+	return identity, true
+}
+
+// allowed checks the ACL policy, if any
+func (s *Server) allowed(identity string, verb acl.Verb, key string) bool {
+	return s.auth.Authorizer == nil || s.auth.Authorizer.Allowed(identity, verb, key)
+}
+
+// authorize writes a 403 response, audit-logging it, when identity cannot perform verb over key
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, identity string, verb acl.Verb, key string) bool {
+	if s.allowed(identity, verb, key) {
+		return true
+	}
+	s.log.Warn().
+		Str("audit", "denied").
+		Str("identity", identity).
+		Str("verb", string(verb)).
+		Str("path", key).
+		Str("method", r.Method+" "+r.URL.Path).
+		Msg("permission denied")
+	writeError(w, http.StatusForbidden, fmt.Errorf("%s is not allowed to %s %s", identity, verb, key))
+	return false
+}
+
+// authenticated resolves the caller identity and checks it can perform verb over key
+func (s *Server) authenticated(w http.ResponseWriter, r *http.Request, verb acl.Verb, key string) bool {
+	identity, ok := s.identify(w, r, verb)
+	return ok && s.authorize(w, r, identity, verb, key)
+}
@@ -0,0 +1,358 @@
+// Package gateway exposes the gonfigd configs through an HTTP/JSON API
+//
+//	GET /v1/configs/{path}       returns the config, with its md5 as ETag. Supports If-None-Match, and
+//	                             format=env to get it as environment variables, named after prefix, separator and casing
+//	GET /v1/configs?prefix=      lists the configs whose path starts with prefix
+//	GET /v1/watch/{path}         long-polls until the config changes, mirroring WatchConfig
+//	GET /v1/events/{path}        streams the config changes as Server-Sent Events. Supports Last-Event-ID
+//
+// Paths are relative to the root folder of the configuration tree.
+// Callers are authenticated and authorized like in the gRPC API.
+package gateway
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/envvars"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/rs/zerolog"
+)
+
+const (
+	configsPrefix = "/v1/configs"
+	watchPrefix   = "/v1/watch/"
+	eventsPrefix  = "/v1/events/"
+	// defaultPollTimeout is how long a watch request waits for changes when no timeout is given
+	defaultPollTimeout = 30 * time.Second
+	// maxPollTimeout caps the timeout requested by clients
+	maxPollTimeout = 5 * time.Minute
+	// deletedVersion is the version of configs that do not exist
+	deletedVersion = "-"
+	// defaultHeartbeat is how often a comment is sent through idle event streams
+	defaultHeartbeat = 15 * time.Second
+)
+
+// ConfigInfo describes a config in list responses
+type ConfigInfo struct {
+	Path         string    `json:"path"`
+	MD5          string    `json:"md5"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// ListResponse is the body of list responses
+type ListResponse struct {
+	Configs []ConfigInfo `json:"configs"`
+}
+
+// WatchResponse is the body of watch responses
+type WatchResponse struct {
+	SubscriptionID string `json:"subscriptionID,omitempty"`
+	Event          string `json:"event"`
+	Kind           string `json:"kind"`
+	Path           string `json:"path"`
+}
+
+// Server is the HTTP gateway, backed by the same KV and PubSub than the gRPC server
+type Server struct {
+	kv        kv.KV
+	ps        pubsub.PubSub
+	root      string
+	renderers []api.Renderer
+	auth      Auth
+	heartbeat time.Duration
+	mux       *http.ServeMux
+	log       zerolog.Logger
+	// shutdown is closed when the server is shutting down, ending the watches and event streams
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewServer returns a new *Server
+// root string, the root folder of the configuration tree
+// auth Auth, the authentication and authorization to enforce, its zero value allows everyone
+// renderers will be applied in order to every config served
+func NewServer(kv kv.KV, ps pubsub.PubSub, root string, auth Auth, logger zerolog.Logger, renderers ...api.Renderer) *Server {
+	s := &Server{kv: kv, ps: ps, root: root, renderers: renderers, auth: auth, heartbeat: defaultHeartbeat, log: logger, shutdown: make(chan struct{})}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc(configsPrefix, s.handleList)
+	s.mux.HandleFunc(configsPrefix+"/", s.handleGet)
+	s.mux.HandleFunc(watchPrefix, s.handleWatch)
+	s.mux.HandleFunc(eventsPrefix, s.handleEvents)
+	return s
+}
+
+// Shutdown sends watchers a SERVER_SHUTTING_DOWN event and ends their requests,
+// so they can reconnect before the HTTP server is shut down
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// key returns the KV key of a path relative to the root folder
+func (s *Server) key(rel string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+rel)))
+}
+
+// rel returns the path relative to the root folder of a KV key
+func (s *Server) rel(key string) string {
+	rel, err := filepath.Rel(s.root, key)
+	if err != nil {
+		return key
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (s *Server) render(key string, content string) (string, error) {
+	var err error
+	for _, r := range s.renderers {
+		if content, err = r.Render(key, content); err != nil {
+			return "", err
+		}
+	}
+	return content, nil
+}
+
+func etag(content string) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum([]byte(content)))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// current returns the rendered content of a config
+func (s *Server) current(key string) (string, *kv.Value, error) {
+	v, err := s.kv.Get(key)
+	if err != nil {
+		return "", nil, err
+	}
+	text, err := s.render(key, v.Text())
+	if err != nil {
+		return "", nil, err
+	}
+	return text, v, nil
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	key := s.key(strings.TrimPrefix(r.URL.Path, configsPrefix+"/"))
+	if !s.authenticated(w, r, acl.Get, key) {
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != api.FormatEnv {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("format %s is not supported", format))
+		return
+	}
+	casing, err := envvars.ParseCasing(query.Get("casing"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	text, v, err := s.current(key)
+	if kv.IsKeyNotFoundError(err) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.log.Error().Msgf("error while trying to read %s: %v", key, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if format == api.FormatEnv {
+		vars, err := envvars.Flatten(text, envvars.Options{Prefix: query.Get("prefix"), Separator: query.Get("separator"), Casing: casing})
+		switch {
+		case envvars.IsInvalidOptionsError(err):
+			writeError(w, http.StatusBadRequest, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		text = envvars.Encode(vars)
+	}
+
+	tag := etag(text)
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Last-Modified", v.LastModified().UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == tag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	identity, ok := s.identify(w, r, acl.List)
+	if !ok {
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	keys, err := s.kv.List("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := ListResponse{Configs: []ConfigInfo{}}
+	for _, k := range keys {
+		rel := s.rel(k)
+		// Configs the caller is not allowed to list are left out
+		if !strings.HasPrefix(rel, prefix) || !s.allowed(identity, acl.List, k) {
+			continue
+		}
+		v, err := s.kv.Get(k)
+		if err != nil {
+			// Deleted while listing
+			continue
+		}
+		resp.Configs = append(resp.Configs, ConfigInfo{Path: rel, MD5: v.MD5(), LastModified: v.LastModified()})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// subscribe subscribes to the changes of key, creating its topic if needed
+func (s *Server) subscribe(key string) (*pubsub.Subscription, error) {
+	if !s.ps.TopicExists(key) {
+		if err := s.ps.CreateTopic(key); err != nil {
+			s.log.Error().Msgf("cannot subscribe to changes of %s: %v", key, err)
+			return nil, err
+		}
+	}
+	return s.ps.Subscribe(key)
+}
+
+// version returns the ETag of the current config, or deletedVersion if it cannot be served
+func (s *Server) version(key string) string {
+	text, _, err := s.current(key)
+	if err != nil {
+		return deletedVersion
+	}
+	return etag(text)
+}
+
+// missedEvent returns the event a client knowing the given version of a config missed, if any
+func (s *Server) missedEvent(key string, known string) *pubsub.Event {
+	if known == "" {
+		return nil
+	}
+	switch current := s.version(key); {
+	case current == known:
+		return nil
+	case current == deletedVersion:
+		return pubsub.NewEvent(pubsub.ConfigDeleted, key)
+	default:
+		return pubsub.NewEvent(pubsub.ConfigUpdated, key)
+	}
+}
+
+// pollTimeout parses the timeout query parameter, i.e: ?timeout=30s
+func pollTimeout(r *http.Request) (time.Duration, error) {
+	t := r.URL.Query().Get("timeout")
+	if t == "" {
+		return defaultPollTimeout, nil
+	}
+	d, err := time.ParseDuration(t)
+	if err != nil {
+		return 0, err
+	}
+	if d > maxPollTimeout {
+		d = maxPollTimeout
+	}
+	return d, nil
+}
+
+// handleWatch blocks until the config changes or the timeout expires, then responds 204 No Content.
+// When If-None-Match is given and does not match the current config, it responds right away,
+// so clients don't miss changes happening between polls.
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	rel := strings.TrimPrefix(r.URL.Path, watchPrefix)
+	key := s.key(rel)
+	if !s.authenticated(w, r, acl.Watch, key) {
+		return
+	}
+	timeout, err := pollTimeout(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sub, err := s.subscribe(key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer s.ps.UnSubscribe(key, sub.ID())
+
+	if ev := s.missedEvent(key, r.Header.Get("If-None-Match")); ev != nil {
+		writeJSON(w, http.StatusOK, WatchResponse{Event: ev.String(), Kind: ev.Kind().String(), Path: rel})
+		return
+	}
+
+	var ev *pubsub.Event
+	// An event published before the shutdown is sent instead of it
+	select {
+	case ev = <-sub.Channel():
+	default:
+		select {
+		case ev = <-sub.Channel():
+		case <-time.After(timeout):
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-s.shutdown:
+			ev := pubsub.NewEvent(pubsub.ServerShuttingDown, key)
+			writeJSON(w, http.StatusOK, WatchResponse{SubscriptionID: sub.ID(), Event: ev.String(), Kind: ev.Kind().String(), Path: rel})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, WatchResponse{
+		SubscriptionID: sub.ID(),
+		Event:          ev.String(),
+		Kind:           ev.Kind().String(),
+		Path:           rel,
+	})
+	s.log.Info().Msgf("event %s sent to long-poll subscription ID %s", ev.String(), sub.ID())
+}
@@ -0,0 +1,286 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/tokens"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer() (*Server, kv.KV, pubsub.PubSub) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	return NewServer(db, ps, "/configs", Auth{}, zerolog.Nop()), db, ps
+}
+
+func put(db kv.KV, key string, content string) {
+	v, _ := kv.NewValue([]byte(content))
+	db.Put(key, v)
+}
+
+func do(s *Server, method string, url string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGetConfig(t *testing.T) {
+	s, db, _ := newTestServer()
+	put(db, "/configs/app/db.yaml", "foo: bar")
+	v, _ := db.Get("/configs/app/db.yaml")
+
+	rec := do(s, "GET", "/v1/configs/app/db.yaml", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "foo: bar", rec.Body.String())
+	assert.Equal(t, "\""+v.MD5()+"\"", rec.Header().Get("ETag"))
+
+	rec2 := do(s, "GET", "/v1/configs/app/db.yaml", map[string]string{"If-None-Match": rec.Header().Get("ETag")})
+	assert.Equal(t, http.StatusNotModified, rec2.Code)
+	assert.Empty(t, rec2.Body.String())
+
+	rec3 := do(s, "GET", "/v1/configs/app/missing.yaml", nil)
+	assert.Equal(t, http.StatusNotFound, rec3.Code)
+
+	rec4 := do(s, "POST", "/v1/configs/app/db.yaml", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec4.Code)
+
+	assert.Equal(t, "/configs/etc/passwd", s.key("../../etc/passwd"))
+}
+
+func TestGetConfigEnv(t *testing.T) {
+	s, db, _ := newTestServer()
+	put(db, "/configs/app/db.yaml", "db:\n  host: localhost\n  port: 5432")
+	put(db, "/configs/app/motd.txt", "hello")
+
+	rec := do(s, "GET", "/v1/configs/app/db.yaml?format=env&prefix=app&casing=lower", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "app_db_host=localhost\napp_db_port=5432\n", rec.Body.String())
+
+	rec2 := do(s, "GET", "/v1/configs/app/db.yaml?format=toml", nil)
+	assert.Equal(t, http.StatusBadRequest, rec2.Code)
+	rec3 := do(s, "GET", "/v1/configs/app/db.yaml?format=env&separator=-", nil)
+	assert.Equal(t, http.StatusBadRequest, rec3.Code)
+	rec4 := do(s, "GET", "/v1/configs/app/motd.txt?format=env", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec4.Code)
+}
+
+func TestListConfigs(t *testing.T) {
+	s, db, _ := newTestServer()
+	put(db, "/configs/app/db.yaml", "foo: bar")
+	put(db, "/configs/app/cache.yaml", "foo: baz")
+	put(db, "/configs/other.yaml", "foo: qux")
+
+	rec := do(s, "GET", "/v1/configs?prefix=app/", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp ListResponse
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Len(t, resp.Configs, 2)
+	assert.Equal(t, "app/cache.yaml", resp.Configs[0].Path)
+	assert.Equal(t, "app/db.yaml", resp.Configs[1].Path)
+
+	rec2 := do(s, "GET", "/v1/configs", nil)
+	var resp2 ListResponse
+	assert.Nil(t, json.Unmarshal(rec2.Body.Bytes(), &resp2))
+	assert.Len(t, resp2.Configs, 3)
+}
+
+func TestWatchConfig(t *testing.T) {
+	s, db, ps := newTestServer()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, _ := http.Get(srv.URL + "/v1/watch/app/db.yaml?timeout=5s")
+		done <- resp
+	}()
+
+	assert.Eventually(t, func() bool {
+		return ps.TopicExists("/configs/app/db.yaml")
+	}, time.Second, 10*time.Millisecond)
+	// Give the handler time to subscribe after creating the topic
+	time.Sleep(50 * time.Millisecond)
+	ps.Publish("/configs/app/db.yaml", pubsub.NewEvent(pubsub.ConfigCreated, "/configs/app/db.yaml"))
+
+	resp := <-done
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var wr WatchResponse
+	assert.Nil(t, json.Unmarshal(body, &wr))
+	assert.Equal(t, pubsub.ConfigCreated.String(), wr.Kind)
+	assert.Equal(t, "app/db.yaml", wr.Path)
+
+	rec := do(s, "GET", "/v1/watch/app/db.yaml?timeout=10ms", nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	put(db, "/configs/app/db.yaml", "foo: bar")
+	rec2 := do(s, "GET", "/v1/watch/app/db.yaml?timeout=10ms", map[string]string{"If-None-Match": "\"stale\""})
+	assert.Equal(t, http.StatusOK, rec2.Code)
+	assert.Nil(t, json.Unmarshal(rec2.Body.Bytes(), &wr))
+	assert.Equal(t, pubsub.ConfigUpdated.String(), wr.Kind)
+
+	rec3 := do(s, "GET", "/v1/watch/app/db.yaml?timeout=foo", nil)
+	assert.Equal(t, http.StatusBadRequest, rec3.Code)
+}
+
+func TestEvents(t *testing.T) {
+	s, db, ps := newTestServer()
+	s.heartbeat = 20 * time.Millisecond
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	put(db, "/configs/app/db.yaml", "foo: bar")
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/events/app/db.yaml", nil)
+	req.Header.Set("Last-Event-ID", "\"stale\"")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() []string {
+		lines := []string{}
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil || l == "\n" {
+				return lines
+			}
+			lines = append(lines, strings.TrimSuffix(l, "\n"))
+		}
+	}
+
+	v, _ := db.Get("/configs/app/db.yaml")
+	missed := readEvent()
+	assert.Equal(t, "id: \""+v.MD5()+"\"", missed[0])
+	assert.Equal(t, "event: "+pubsub.ConfigUpdated.String(), missed[1])
+
+	assert.Equal(t, []string{": heartbeat"}, readEvent())
+
+	db.Delete("/configs/app/db.yaml")
+	ps.Publish("/configs/app/db.yaml", pubsub.NewEvent(pubsub.ConfigDeleted, "/configs/app/db.yaml"))
+	deleted := readEvent()
+	for deleted[0] == ": heartbeat" {
+		deleted = readEvent()
+	}
+	assert.Equal(t, "id: -", deleted[0])
+	assert.Equal(t, "event: "+pubsub.ConfigDeleted.String(), deleted[1])
+	var wr WatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(deleted[2], "data: ")), &wr))
+	assert.Equal(t, "app/db.yaml", wr.Path)
+}
+
+func TestShutdown(t *testing.T) {
+	s, _, ps := newTestServer()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, _ := http.Get(srv.URL + "/v1/watch/app/db.yaml?timeout=5s")
+		done <- resp
+	}()
+	events, err := http.Get(srv.URL + "/v1/events/app/db.yaml")
+	assert.Nil(t, err)
+	defer events.Body.Close()
+	assert.Eventually(t, func() bool {
+		return ps.TopicExists("/configs/app/db.yaml")
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	// Events published before the shutdown are sent before it
+	ps.Publish("/configs/app/db.yaml", pubsub.NewEvent(pubsub.ConfigUpdated, "/configs/app/db.yaml"))
+	s.Shutdown()
+
+	resp := <-done
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var wr WatchResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&wr))
+	resp.Body.Close()
+	assert.Equal(t, pubsub.ConfigUpdated.String(), wr.Kind)
+
+	// The event stream ends right after the event
+	body, err := ioutil.ReadAll(events.Body)
+	assert.Nil(t, err)
+	updated := strings.Index(string(body), "event: "+pubsub.ConfigUpdated.String())
+	shuttingDown := strings.Index(string(body), "event: "+pubsub.ServerShuttingDown.String())
+	assert.True(t, updated >= 0 && updated < shuttingDown, string(body))
+
+	// Watches after the shutdown get its event
+	resp2, err := http.Get(srv.URL + "/v1/watch/app/db.yaml?timeout=5s")
+	assert.Nil(t, err)
+	var wr2 WatchResponse
+	assert.Nil(t, json.NewDecoder(resp2.Body).Decode(&wr2))
+	resp2.Body.Close()
+	assert.Equal(t, pubsub.ServerShuttingDown.String(), wr2.Kind)
+}
+
+type fakeAuthenticator map[string]*tokens.Token
+
+func (fa fakeAuthenticator) Authenticate(token string) (*tokens.Token, error) {
+	t, ok := fa[token]
+	if !ok {
+		return nil, tokens.NewInvalidTokenError()
+	}
+	return t, nil
+}
+
+func TestAuth(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	policy, _ := acl.ParsePolicy([]byte("rules:\n  - identities: [\"reader\"]\n    paths: [\"/configs/app/**\"]\n    verbs: [\"get\", \"list\"]"))
+	auth := Auth{
+		Authenticator: fakeAuthenticator{
+			"r3ad":  {Name: "reader", Scopes: []acl.Verb{acl.Any}},
+			"w4tch": {Name: "watcher", Scopes: []acl.Verb{acl.Watch}},
+		},
+		Authorizer: policy,
+	}
+	s := NewServer(db, ps, "/configs", auth, zerolog.Nop())
+	put(db, "/configs/app/db.yaml", "foo: bar")
+	put(db, "/configs/other.yaml", "foo: baz")
+
+	rec := do(s, "GET", "/v1/configs/app/db.yaml", map[string]string{"Authorization": "Bearer r3ad"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec2 := do(s, "GET", "/v1/configs/other.yaml", map[string]string{"Authorization": "Bearer r3ad"})
+	assert.Equal(t, http.StatusForbidden, rec2.Code)
+
+	rec3 := do(s, "GET", "/v1/configs/app/db.yaml", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec3.Code)
+
+	rec4 := do(s, "GET", "/v1/configs/app/db.yaml", map[string]string{"Authorization": "Bearer wrong"})
+	assert.Equal(t, http.StatusUnauthorized, rec4.Code)
+
+	rec5 := do(s, "GET", "/v1/configs/app/db.yaml", map[string]string{"Authorization": "Bearer w4tch"})
+	assert.Equal(t, http.StatusForbidden, rec5.Code)
+
+	rec6 := do(s, "GET", "/v1/configs", map[string]string{"Authorization": "Bearer r3ad"})
+	var resp ListResponse
+	assert.Nil(t, json.Unmarshal(rec6.Body.Bytes(), &resp))
+	assert.Len(t, resp.Configs, 1)
+	assert.Equal(t, "app/db.yaml", resp.Configs[0].Path)
+
+	rec7 := do(s, "GET", "/v1/events/app/db.yaml", map[string]string{"Authorization": "Bearer r3ad"})
+	assert.Equal(t, http.StatusForbidden, rec7.Code)
+
+	// Anonymous callers are only let in explicitly, and then authorized as anonymous
+	auth.AllowAnonymous = true
+	s2 := NewServer(db, ps, "/configs", auth, zerolog.Nop())
+	rec8 := do(s2, "GET", "/v1/configs/app/db.yaml", nil)
+	assert.Equal(t, http.StatusForbidden, rec8.Code)
+}
@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/fcgravalos/gonfigd/pubsub"
+)
+
+// writeEvent sends ev through the event stream.
+// Its id is the version of the config after the change, so clients can resume with Last-Event-ID.
+func (s *Server) writeEvent(w http.ResponseWriter, f http.Flusher, ev *pubsub.Event, sID string, rel string) error {
+	data, err := json.Marshal(WatchResponse{
+		SubscriptionID: sID,
+		Event:          ev.String(),
+		Kind:           ev.Kind().String(),
+		Path:           rel,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.version(ev.ConfigPath()), ev.Kind().String(), data); err != nil {
+		return err
+	}
+	f.Flush()
+	return nil
+}
+
+// handleEvents streams the changes of a config as Server-Sent Events, mirroring WatchConfig.
+// Idle streams get a heartbeat comment, and clients reconnecting with Last-Event-ID
+// get the change they missed, if any, right away.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	rel := strings.TrimPrefix(r.URL.Path, eventsPrefix)
+	key := s.key(rel)
+	if !s.authenticated(w, r, acl.Watch, key) {
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	sub, err := s.subscribe(key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer s.ps.UnSubscribe(key, sub.ID())
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	if ev := s.missedEvent(key, r.Header.Get("Last-Event-ID")); ev != nil {
+		if err := s.writeEvent(w, f, ev, sub.ID(), rel); err != nil {
+			return
+		}
+	}
+
+	sCh := sub.Channel()
+	for {
+		var ev *pubsub.Event
+		// Events published before the shutdown are sent before it
+		select {
+		case ev = <-sCh:
+		default:
+			select {
+			case ev = <-sCh:
+			case <-time.After(s.heartbeat):
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				f.Flush()
+				continue
+			case <-s.shutdown:
+				s.writeEvent(w, f, pubsub.NewEvent(pubsub.ServerShuttingDown, key), sub.ID(), rel)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if err := s.writeEvent(w, f, ev, sub.ID(), rel); err != nil {
+			s.log.Error().Msgf("failed to send event %s through event stream: %v", ev.String(), err)
+			return
+		}
+		s.log.Info().Msgf("event %s sent to event stream subscription ID %s", ev.String(), sub.ID())
+	}
+}
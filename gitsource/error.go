@@ -0,0 +1,41 @@
+package gitsource
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	GitCommand ErrType = "GIT_COMMAND_ERROR"
+	Unknown    ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type GitCommandError struct {
+	errType ErrType
+	args    []string
+	output  string
+	err     error
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case GitCommandError:
+		return GitCommand
+	default:
+		return Unknown
+	}
+}
+
+func IsGitCommandError(e error) bool {
+	return getErrorType(e) == GitCommand
+}
+
+func (e GitCommandError) Error() string {
+	return fmt.Sprintf("[%s] git %s failed: %v: %s", e.errType, strings.Join(e.args, " "), e.err, strings.TrimSpace(e.output))
+}
+
+func NewGitCommandError(args []string, output string, err error) GitCommandError {
+	return GitCommandError{errType: GitCommand, args: args, output: output, err: err}
+}
@@ -0,0 +1,407 @@
+// Package gitsource serves the configs of a branch, tag or commit of a git repository
+//
+// The repository is mirrored into a local folder and fetched every interval, or when
+// its webhook is called. Configs are keyed by their path within the repository joined
+// to the root folder, like the fswatcher does, and events are published for every
+// file changed between the previous and the new commit.
+package gitsource
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/fswatcher"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/metrics"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/signing"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/fcgravalos/gonfigd/tracing"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// Kind is the kind of source of git repositories
+	Kind = "git"
+	// SignatureHeader is the webhook header holding the hex HMAC-SHA256 of the body, i.e: sha256=<hex>
+	SignatureHeader     = "X-Hub-Signature-256"
+	defaultRef          = "master"
+	defaultSyncInterval = 30 * time.Second
+	// maxWebhookBody is the largest webhook body read, git hosting payloads are way smaller
+	maxWebhookBody = 1 << 20
+)
+
+func init() {
+	source.Register(Kind, func(spec source.Spec, env source.Env) (source.Source, error) {
+		repo := spec.Option("repo", "")
+		if repo == "" || spec.Root == "" {
+			return nil, source.NewInvalidSpecError(fmt.Sprintf("source %s must have a root and a repo option", spec.Name))
+		}
+		interval, err := spec.Duration("syncInterval", defaultSyncInterval)
+		if err != nil {
+			return nil, err
+		}
+		s := NewSource(repo, spec.Option("ref", defaultRef), spec.Option("mirrorDir", ""), spec.Root, env.KV, env.PS, env.Logger)
+		s.verifier = env.Verifier
+		s.deps = env.Deps
+		s.name = spec.Name
+		s.interval = interval
+		s.SetWebhookSecret(spec.Option("webhookSecret", ""))
+		return s, nil
+	})
+}
+
+// Source keeps the KV in sync with a git repository
+type Source struct {
+	sync.Mutex
+	name          string
+	interval      time.Duration
+	repo          string
+	ref           string
+	dir           string
+	root          string
+	webhookSecret string
+	verifier      *signing.Verifier
+	deps          source.DependencyTracker
+	tempDir       string
+	head          string
+	trigger       chan struct{}
+	kv            kv.KV
+	ps            pubsub.PubSub
+	log           zerolog.Logger
+}
+
+// NewSource returns a new *Source
+// repo string, the repository to clone, a local path or a file:// URL
+// ref string, the branch, tag or commit to serve
+// dir string, the folder the repository is mirrored into, a temporary folder removed on Start return when empty
+// root string, the folder configs are keyed under, cleaned like the keys joined to it
+func NewSource(repo string, ref string, dir string, root string, kv kv.KV, ps pubsub.PubSub, logger zerolog.Logger) *Source {
+	return &Source{
+		name:     Kind,
+		interval: defaultSyncInterval,
+		repo:     repo,
+		ref:      ref,
+		dir:      dir,
+		root:     filepath.Clean(root),
+		trigger:  make(chan struct{}, 1),
+		kv:       kv,
+		ps:       ps,
+		log:      logger,
+	}
+}
+
+// Name implements source.Source
+func (s *Source) Name() string {
+	return s.name
+}
+
+// SetWebhookSecret requires webhook calls to be signed with secret
+// The webhook is disabled until a secret is set
+func (s *Source) SetWebhookSecret(secret string) {
+	s.webhookSecret = secret
+}
+
+// Head returns the commit currently served
+func (s *Source) Head() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.head
+}
+
+func (s *Source) git(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, NewGitCommandError(args, stderr.String(), err)
+	}
+	return out, nil
+}
+
+// fetch mirrors the repository into dir, or updates the mirror if it already exists
+func (s *Source) fetch(ctx context.Context) error {
+	if s.dir == "" {
+		dir, err := ioutil.TempDir("", "gonfigd-git")
+		if err != nil {
+			return err
+		}
+		s.dir = filepath.Join(dir, "mirror")
+		s.tempDir = dir
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "HEAD")); err != nil {
+		_, err := s.git(ctx, "clone", "--mirror", "--quiet", s.repo, s.dir)
+		return err
+	}
+	_, err := s.git(ctx, "--git-dir", s.dir, "fetch", "--prune", "--quiet", "origin")
+	return err
+}
+
+// isConfig checks every segment of a path within the repository is a valid config file name
+func isConfig(path string) bool {
+	for _, part := range strings.Split(path, "/") {
+		if !fswatcher.IsValidFileName(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitZ splits the NUL separated output of git commands run with -z
+func splitZ(out []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+}
+
+// changes returns the files changed between from and to, with the event to publish for each of them
+func (s *Source) changes(ctx context.Context, from string, to string) (map[string]pubsub.EventType, error) {
+	changes := make(map[string]pubsub.EventType)
+	if from == "" {
+		out, err := s.git(ctx, "--git-dir", s.dir, "ls-tree", "-r", "-z", "--name-only", to)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range splitZ(out) {
+			if f != "" {
+				changes[f] = pubsub.ConfigCreated
+			}
+		}
+		return changes, nil
+	}
+
+	out, err := s.git(ctx, "--git-dir", s.dir, "diff", "--name-status", "--no-renames", "-z", from, to)
+	if err != nil {
+		return nil, err
+	}
+	fields := splitZ(out)
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "A":
+			changes[fields[i+1]] = pubsub.ConfigCreated
+		case "D":
+			changes[fields[i+1]] = pubsub.ConfigDeleted
+		default:
+			changes[fields[i+1]] = pubsub.ConfigUpdated
+		}
+	}
+	return changes, nil
+}
+
+func (s *Source) publishEvent(ctx context.Context, config string, evType pubsub.EventType) error {
+	ev := pubsub.NewEventWithContext(ctx, evType, config)
+	if !s.ps.TopicExists(config) {
+		if err := s.ps.CreateTopic(config); err != nil {
+			return err
+		}
+	}
+	return s.ps.Publish(config, ev)
+}
+
+// apply stores a changed file of commit into the KV and publishes its event
+func (s *Source) apply(ctx context.Context, commit string, path string, evType pubsub.EventType) error {
+	key := filepath.Join(s.root, filepath.FromSlash(path))
+	if evType == pubsub.ConfigDeleted {
+		if err := s.kv.Delete(key); err != nil {
+			return err
+		}
+		if s.deps != nil {
+			s.deps.Untrack(key)
+		}
+		if err := s.publishEvent(ctx, key, evType); err != nil {
+			return err
+		}
+		return source.PublishDependents(ctx, s.ps, s.deps, key)
+	}
+
+	data, err := s.git(ctx, "--git-dir", s.dir, "cat-file", "blob", fmt.Sprintf("%s:%s", commit, path))
+	if err != nil {
+		return err
+	}
+	if s.verifier != nil {
+		// A missing signature fails the verification too
+		sig, _ := s.git(ctx, "--git-dir", s.dir, "cat-file", "blob", fmt.Sprintf("%s:%s%s", commit, path, signing.SignatureSuffix))
+		// Configs are signed for their path within the repository
+		if _, err := s.verifier.Verify(path, data, sig); err != nil {
+			metrics.SignatureFailures.WithLabelValues(Kind).Inc()
+			s.log.Error().
+				Str("alert", "signature_verification_failed").
+				Msgf("rejecting %s at commit %s, keeping its last verified version: %v", path, commit, err)
+			return nil
+		}
+	}
+	v, err := kv.NewValueWithMetadata(data, map[string]string{kv.MetadataCommit: commit})
+	if err != nil {
+		return err
+	}
+	if old, err := s.kv.Get(key); err == nil {
+		if old.MD5() == v.MD5() {
+			return nil
+		}
+		evType = pubsub.ConfigUpdated
+	}
+	if err := s.kv.Put(key, v); err != nil {
+		return err
+	}
+	if s.deps != nil {
+		s.deps.Track(key, string(data))
+	}
+	if err := s.publishEvent(ctx, key, evType); err != nil {
+		return err
+	}
+	return source.PublishDependents(ctx, s.ps, s.deps, key)
+}
+
+// Sync fetches the repository and, if ref moved, applies the changes to the KV
+func (s *Source) Sync(ctx context.Context) error {
+	ctx, span := tracing.Tracer().Start(ctx, "gitsource.Sync")
+	defer span.End()
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.fetch(ctx); err != nil {
+		return err
+	}
+	out, err := s.git(ctx, "--git-dir", s.dir, "rev-parse", "--verify", "--quiet", s.ref+"^{commit}")
+	if err != nil {
+		return err
+	}
+	commit := strings.TrimSpace(string(out))
+	if commit == s.head {
+		return nil
+	}
+
+	changes, err := s.changes(ctx, s.head, commit)
+	if err != nil {
+		// i.e: the previous commit is gone after a force push
+		s.log.Warn().Msgf("cannot diff %s..%s, reloading every config: %v", s.head, commit, err)
+		if changes, err = s.changes(ctx, "", commit); err != nil {
+			return err
+		}
+		// Configs served but missing from the new tree were deleted by the force push
+		prefix := s.root
+		if prefix == "." {
+			// Keys under the current folder have no prefix
+			prefix = ""
+		}
+		keys, err := s.kv.List(prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			rel, err := filepath.Rel(s.root, key)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			if _, ok := changes[filepath.ToSlash(rel)]; !ok {
+				changes[filepath.ToSlash(rel)] = pubsub.ConfigDeleted
+			}
+		}
+	}
+	if s.verifier != nil {
+		// Configs are verified again when their signature changes
+		for path := range changes {
+			config := strings.TrimSuffix(path, signing.SignatureSuffix)
+			if _, ok := changes[config]; config == path || ok || !isConfig(config) {
+				continue
+			}
+			if _, err := s.git(ctx, "--git-dir", s.dir, "cat-file", "-e", fmt.Sprintf("%s:%s", commit, config)); err == nil {
+				changes[config] = pubsub.ConfigUpdated
+			}
+		}
+	}
+	for path, evType := range changes {
+		if !isConfig(path) {
+			continue
+		}
+		if err := s.apply(ctx, commit, path, evType); err != nil {
+			return err
+		}
+		s.log.Info().Msgf("%s %s at commit %s", evType.String(), path, commit)
+	}
+	s.head = commit
+	return nil
+}
+
+// Snapshot implements source.Source, syncing the repository once
+func (s *Source) Snapshot(ctx context.Context) error {
+	return s.Sync(ctx)
+}
+
+// Start implements source.Source, watching the repository every sync interval
+func (s *Source) Start(ctx context.Context) error {
+	s.Watch(ctx, s.interval)
+	s.Lock()
+	defer s.Unlock()
+	if s.tempDir != "" {
+		return os.RemoveAll(s.tempDir)
+	}
+	return nil
+}
+
+// Watch syncs the repository every interval, or as soon as the webhook is called
+func (s *Source) Watch(ctx context.Context, interval time.Duration) {
+	for {
+		if err := s.Sync(ctx); err != nil {
+			s.log.Error().Msgf("failed to sync git repository %s: %v", s.repo, err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-s.trigger:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// validSignature checks body is signed with the webhook secret
+func (s *Source) validSignature(r *http.Request, body []byte) bool {
+	sig, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(SignatureHeader), "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.webhookSecret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// ServeHTTP implements the webhook, any signed POST request triggers a sync
+// Without a webhook secret it is not served, so the repository cannot be synced by anyone
+func (s *Source) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.webhookSecret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.validSignature(r, body) {
+		s.log.Warn().Msgf("git webhook called with an invalid signature from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+		// A sync is already pending
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
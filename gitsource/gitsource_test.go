@@ -0,0 +1,344 @@
+package gitsource
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/interpolate"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/signing"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func run(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func commit(t *testing.T, repo string, files map[string]string, removed ...string) string {
+	for name, content := range files {
+		path := filepath.Join(repo, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range removed {
+		run(t, repo, "rm", "--quiet", name)
+	}
+	run(t, repo, "add", "-A")
+	run(t, repo, "commit", "--quiet", "-m", "test")
+	return run(t, repo, "rev-parse", "HEAD")
+}
+
+func newTestSource(t *testing.T) (*Source, string, string, kv.KV, pubsub.PubSub) {
+	tmp, _ := ioutil.TempDir("", "gitsource-tests")
+	repo := filepath.Join(tmp, "repo")
+	os.MkdirAll(repo, 0755)
+	run(t, repo, "init", "--quiet")
+	run(t, repo, "checkout", "--quiet", "-b", "main")
+
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	s := NewSource("file://"+repo, "main", filepath.Join(tmp, "mirror"), "/configs", db, ps, zerolog.Nop())
+	return s, tmp, repo, db, ps
+}
+
+func subscribe(ps pubsub.PubSub, key string) *pubsub.Subscription {
+	ps.CreateTopic(key)
+	sub, _ := ps.Subscribe(key)
+	return sub
+}
+
+func TestSync(t *testing.T) {
+	s, tmp, repo, db, ps := newTestSource(t)
+	defer os.RemoveAll(tmp)
+	ctx := context.Background()
+
+	c1 := commit(t, repo, map[string]string{"app/db.yaml": "foo: bar", "app/cache.yaml": "foo: bar", ".hidden": "x"})
+	assert.Nil(t, s.Sync(ctx))
+	assert.Equal(t, c1, s.Head())
+
+	v, err := db.Get("/configs/app/db.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo: bar", v.Text())
+	assert.Equal(t, c1, v.Metadata(kv.MetadataCommit))
+	_, err2 := db.Get("/configs/.hidden")
+	assert.True(t, kv.IsKeyNotFoundError(err2))
+
+	dbSub := subscribe(ps, "/configs/app/db.yaml")
+	cacheSub := subscribe(ps, "/configs/app/cache.yaml")
+	newSub := subscribe(ps, "/configs/app/new.yaml")
+
+	c2 := commit(t, repo, map[string]string{"app/db.yaml": "foo: baz", "app/new.yaml": "new: true"}, "app/cache.yaml")
+	errCh := make(chan error)
+	go func() {
+		errCh <- s.Sync(ctx)
+	}()
+	kinds := make(map[string]pubsub.EventType)
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-dbSub.Channel():
+			kinds[ev.ConfigPath()] = ev.Kind()
+		case ev := <-cacheSub.Channel():
+			kinds[ev.ConfigPath()] = ev.Kind()
+		case ev := <-newSub.Channel():
+			kinds[ev.ConfigPath()] = ev.Kind()
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+	assert.Nil(t, <-errCh)
+	assert.Equal(t, c2, s.Head())
+	assert.Equal(t, map[string]pubsub.EventType{
+		"/configs/app/db.yaml":    pubsub.ConfigUpdated,
+		"/configs/app/cache.yaml": pubsub.ConfigDeleted,
+		"/configs/app/new.yaml":   pubsub.ConfigCreated,
+	}, kinds)
+
+	v2, _ := db.Get("/configs/app/db.yaml")
+	assert.Equal(t, "foo: baz", v2.Text())
+	assert.Equal(t, c2, v2.Metadata(kv.MetadataCommit))
+	_, err3 := db.Get("/configs/app/cache.yaml")
+	assert.True(t, kv.IsKeyNotFoundError(err3))
+
+	// Nothing changed
+	assert.Nil(t, s.Sync(ctx))
+	assert.Equal(t, c2, s.Head())
+}
+
+func TestSyncForcePush(t *testing.T) {
+	s, tmp, repo, db, ps := newTestSource(t)
+	defer os.RemoveAll(tmp)
+	ctx := context.Background()
+	commit(t, repo, map[string]string{"app/db.yaml": "foo: bar", "app/cache.yaml": "foo: bar"})
+	assert.Nil(t, s.Sync(ctx))
+	other, _ := kv.NewValue([]byte("foo: bar"))
+	db.Put("/configs-other/db.yaml", other)
+
+	// The history is rewritten without app/cache.yaml, and the previous head is gone from the mirror
+	run(t, repo, "checkout", "--quiet", "--orphan", "rewritten")
+	run(t, repo, "rm", "--quiet", "-f", "app/cache.yaml")
+	rewritten := commit(t, repo, map[string]string{"app/db.yaml": "foo: baz"})
+	run(t, repo, "branch", "-M", "main")
+	run(t, tmp, "--git-dir", s.dir, "fetch", "--prune", "--quiet", "origin")
+	run(t, tmp, "--git-dir", s.dir, "gc", "--quiet", "--prune=now")
+
+	cacheSub := subscribe(ps, "/configs/app/cache.yaml")
+	errCh := make(chan error)
+	go func() {
+		errCh <- s.Sync(ctx)
+	}()
+	select {
+	case ev := <-cacheSub.Channel():
+		assert.Equal(t, pubsub.ConfigDeleted, ev.Kind())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	assert.Nil(t, <-errCh)
+	assert.Equal(t, rewritten, s.Head())
+	_, err := db.Get("/configs/app/cache.yaml")
+	assert.True(t, kv.IsKeyNotFoundError(err))
+	v, _ := db.Get("/configs/app/db.yaml")
+	assert.Equal(t, "foo: baz", v.Text())
+	// Keys out of the root folder are left alone
+	_, err2 := db.Get("/configs-other/db.yaml")
+	assert.Nil(t, err2)
+}
+
+func TestSyncForcePushRelativeRoot(t *testing.T) {
+	s, tmp, repo, db, _ := newTestSource(t)
+	defer os.RemoveAll(tmp)
+	ctx := context.Background()
+	// Keys are joined to the cleaned root, i.e: app/db.yaml for the default ./ root folder
+	s = NewSource(s.repo, s.ref, s.dir, "./", db, s.ps, zerolog.Nop())
+	commit(t, repo, map[string]string{"app/db.yaml": "foo: bar", "app/cache.yaml": "foo: bar"})
+	assert.Nil(t, s.Sync(ctx))
+	_, err := db.Get("app/cache.yaml")
+	assert.Nil(t, err)
+
+	run(t, repo, "checkout", "--quiet", "--orphan", "rewritten")
+	run(t, repo, "rm", "--quiet", "-f", "app/cache.yaml")
+	commit(t, repo, map[string]string{"app/db.yaml": "foo: baz"})
+	run(t, repo, "branch", "-M", "main")
+	run(t, tmp, "--git-dir", s.dir, "fetch", "--prune", "--quiet", "origin")
+	run(t, tmp, "--git-dir", s.dir, "gc", "--quiet", "--prune=now")
+
+	assert.Nil(t, s.Sync(ctx))
+	_, err2 := db.Get("app/cache.yaml")
+	assert.True(t, kv.IsKeyNotFoundError(err2))
+	v, _ := db.Get("app/db.yaml")
+	assert.Equal(t, "foo: baz", v.Text())
+}
+
+func TestSyncRef(t *testing.T) {
+	s, tmp, repo, db, _ := newTestSource(t)
+	defer os.RemoveAll(tmp)
+	commit(t, repo, map[string]string{"db.yaml": "env: main"})
+	run(t, repo, "checkout", "--quiet", "-b", "staging")
+	staging := commit(t, repo, map[string]string{"db.yaml": "env: staging"})
+
+	s.ref = "staging"
+	assert.Nil(t, s.Sync(context.Background()))
+	assert.Equal(t, staging, s.Head())
+	v, _ := db.Get("/configs/db.yaml")
+	assert.Equal(t, "env: staging", v.Text())
+
+	s.ref = "missing"
+	assert.True(t, IsGitCommandError(s.Sync(context.Background())))
+}
+
+func TestSourceFromSpec(t *testing.T) {
+	_, tmp, repo, db, ps := newTestSource(t)
+	defer os.RemoveAll(tmp)
+	c1 := commit(t, repo, map[string]string{"db.yaml": "foo: bar"})
+
+	src, err := source.New(source.Spec{
+		Name:    "shared",
+		Kind:    Kind,
+		Root:    "/shared",
+		Options: map[string]string{"repo": repo, "ref": "main", "syncInterval": "1h"},
+	}, source.Env{KV: db, PS: ps, Logger: zerolog.Nop()})
+	assert.Nil(t, err)
+	assert.Equal(t, "shared", src.Name())
+	assert.Nil(t, src.Snapshot(context.Background()))
+	v, _ := db.Get("/shared/db.yaml")
+	assert.Equal(t, c1, v.Metadata(kv.MetadataCommit))
+
+	// The temporary mirror is removed once stopped
+	mirror := filepath.Dir(src.(*Source).dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, src.Start(ctx))
+	_, statErr := os.Stat(mirror)
+	assert.True(t, os.IsNotExist(statErr))
+
+	_, err2 := source.New(source.Spec{Name: "shared", Kind: Kind, Root: "/shared"}, source.Env{})
+	assert.True(t, source.IsInvalidSpecError(err2))
+}
+
+func TestSyncDependents(t *testing.T) {
+	_, tmp, repo, db, ps := newTestSource(t)
+	defer os.RemoveAll(tmp)
+	commit(t, repo, map[string]string{"db.yaml": "host: db1", "app.yaml": "db: ${file:db.yaml#host}"})
+	interpolator := interpolate.NewInterpolator("/configs", db)
+	src, err := source.New(source.Spec{
+		Name:    "git",
+		Kind:    Kind,
+		Root:    "/configs",
+		Options: map[string]string{"repo": repo, "ref": "main"},
+	}, source.Env{KV: db, PS: ps, Deps: interpolator, Logger: zerolog.Nop()})
+	assert.Nil(t, err)
+	assert.Nil(t, src.Snapshot(context.Background()))
+
+	// Configs referencing a changed one get an event, so they are rendered again
+	appSub := subscribe(ps, "/configs/app.yaml")
+	commit(t, repo, map[string]string{"db.yaml": "host: db2"})
+	errCh := make(chan error)
+	go func() {
+		errCh <- src.(*Source).Sync(context.Background())
+	}()
+	select {
+	case ev := <-appSub.Channel():
+		assert.Equal(t, pubsub.ConfigUpdated, ev.Kind())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	assert.Nil(t, <-errCh)
+	rendered, err := interpolator.Render("/configs/app.yaml", "db: ${file:db.yaml#host}")
+	assert.Nil(t, err)
+	assert.Equal(t, "db: db2", rendered)
+}
+
+func TestSyncSigned(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	s, tmp, repo, db, _ := newTestSource(t)
+	defer os.RemoveAll(tmp)
+	s.verifier = signing.NewVerifier(map[string]ed25519.PublicKey{"ci": pub})
+	ctx := context.Background()
+
+	commit(t, repo, map[string]string{
+		"signed.yaml":     "foo: bar",
+		"signed.yaml.sig": string(signing.Sign(priv, "signed.yaml", []byte("foo: bar"))),
+		"unsigned.yaml":   "foo: bar",
+		// Signatures are bound to the path they were made for
+		"copied.yaml":     "foo: bar",
+		"copied.yaml.sig": string(signing.Sign(priv, "signed.yaml", []byte("foo: bar"))),
+	})
+	assert.Nil(t, s.Sync(ctx))
+	keys, _ := db.List("")
+	assert.Equal(t, []string{"/configs/signed.yaml"}, keys)
+
+	// Signing a config afterwards makes it verified
+	commit(t, repo, map[string]string{"unsigned.yaml.sig": string(signing.Sign(priv, "unsigned.yaml", []byte("foo: bar")))})
+	assert.Nil(t, s.Sync(ctx))
+	keys2, _ := db.List("")
+	assert.Equal(t, []string{"/configs/signed.yaml", "/configs/unsigned.yaml"}, keys2)
+
+	// Tampered configs keep their last verified version
+	commit(t, repo, map[string]string{"signed.yaml": "foo: tampered"})
+	assert.Nil(t, s.Sync(ctx))
+	v, _ := db.Get("/configs/signed.yaml")
+	assert.Equal(t, "foo: bar", v.Text())
+}
+
+func TestWebhook(t *testing.T) {
+	s, tmp, _, _, _ := newTestSource(t)
+	defer os.RemoveAll(tmp)
+
+	// Disabled without a secret
+	rr0 := httptest.NewRecorder()
+	s.ServeHTTP(rr0, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("{}")))
+	assert.Equal(t, http.StatusNotFound, rr0.Code)
+
+	s.SetWebhookSecret("secret")
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+	rr2 := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("{}"))
+	req.Header.Set(SignatureHeader, "sha256=0123")
+	s.ServeHTTP(rr2, req)
+	assert.Equal(t, http.StatusUnauthorized, rr2.Code)
+
+	rrBig := httptest.NewRecorder()
+	s.ServeHTTP(rrBig, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(make([]byte, maxWebhookBody+1))))
+	assert.Equal(t, http.StatusBadRequest, rrBig.Code)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("{}"))
+	rr3 := httptest.NewRecorder()
+	req2 := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("{}"))
+	req2.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	s.ServeHTTP(rr3, req2)
+	assert.Equal(t, http.StatusAccepted, rr3.Code)
+
+	select {
+	case <-s.trigger:
+	default:
+		t.Fatal("webhook did not trigger a sync")
+	}
+}
@@ -6,8 +6,14 @@ require (
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/golang/protobuf v1.4.1
 	github.com/google/uuid v1.1.1
+	github.com/open-telemetry/opentelemetry-proto v0.3.0
+	github.com/pmezard/go-difflib v1.0.0
+	github.com/prometheus/client_golang v1.6.0
 	github.com/rs/zerolog v1.18.0
 	github.com/stretchr/testify v1.5.1
+	go.opentelemetry.io/otel v0.6.0
+	go.opentelemetry.io/otel/exporters/otlp v0.6.0
 	google.golang.org/grpc v1.29.1
 	google.golang.org/protobuf v1.22.0
+	gopkg.in/yaml.v2 v2.2.7
 )
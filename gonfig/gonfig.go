@@ -2,55 +2,343 @@ package gonfig
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
+	"net/http"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/fcgravalos/gonfigd/acl"
 	"github.com/fcgravalos/gonfigd/api"
+	// Registers the bundle kind of source
+	_ "github.com/fcgravalos/gonfigd/bundlesource"
+	"github.com/fcgravalos/gonfigd/configtree"
 	"github.com/fcgravalos/gonfigd/fswatcher"
+	"github.com/fcgravalos/gonfigd/gateway"
+	"github.com/fcgravalos/gonfigd/gitsource"
+	"github.com/fcgravalos/gonfigd/history"
+	"github.com/fcgravalos/gonfigd/interpolate"
 	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/metrics"
 	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/replication"
+	"github.com/fcgravalos/gonfigd/secrets"
+	"github.com/fcgravalos/gonfigd/signing"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/fcgravalos/gonfigd/tlsconfig"
+	"github.com/fcgravalos/gonfigd/tokens"
+	"github.com/fcgravalos/gonfigd/tracing"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/plugin/grpctrace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+// maxMessageSize bounds the gRPC messages, large enough to restore snapshots and to replicate the whole store
+const maxMessageSize = replication.MaxMessageSize
+
 type Config struct {
-	GrpcAddr       string
+	GrpcAddr string
+	// HTTPAddr enables the HTTP/JSON gateway
+	HTTPAddr string
+	// OTLPAddr enables exporting traces to the OTLP collector at this address
+	OTLPAddr string
+	// MetricsAddr enables the Prometheus metrics HTTP listener at /metrics
+	MetricsAddr    string
 	KvKind         kv.Kind
 	PsKind         pubsub.Kind
 	RootFolder     string
 	FsWalkInterval time.Duration
-	Logger         zerolog.Logger
+	// SourcesFile is a YAML file with the sources of configs to run, overriding RootFolder and GitRepo
+	SourcesFile string
+	// GitRepo serves the configs of a git repository, a local path or a file:// URL, instead of watching RootFolder
+	GitRepo string
+	// GitRef is the branch, tag or commit of GitRepo to serve
+	GitRef string
+	// GitMirrorDir is the folder GitRepo is mirrored into, a temporary folder when empty
+	GitMirrorDir string
+	// GitSyncInterval is how often GitRepo is fetched
+	GitSyncInterval time.Duration
+	// GitWebhookSecret, when set, enables the git webhook of the HTTP gateway, requiring its calls to be signed with it
+	GitWebhookSecret string
+	// TrustedKeysFile enables signature verification, configs must be signed by one of the ed25519 keys it contains
+	TrustedKeysFile string
+	// EnableWrites enables the PutConfig and DeleteConfig RPCs, writing into RootFolder
+	EnableWrites bool
+	// HistorySize is how many versions of every config are kept for GetHistory, disabled when 0
+	HistorySize int
+	// EnableReplication enables the Replicate RPC, so followers can replicate the configs served
+	EnableReplication bool
+	// ReplicationLogSize is how many batches of changes are kept for followers to resume from
+	ReplicationLogSize int
+	// LeaderAddr replicates the configs of the leader at this gRPC address instead of watching RootFolder
+	LeaderAddr string
+	// LeaderCAFile enables TLS to the leader, verifying its certificate with this CA
+	LeaderCAFile string
+	// LeaderCertFile and LeaderKeyFile are the client certificate presented to a leader running with mTLS
+	LeaderCertFile string
+	LeaderKeyFile  string
+	// LeaderTokenFile is a file with the bearer token sent to the leader
+	LeaderTokenFile string
+	// Interpolation enables resolving ${env:VAR} and ${file:config#key} references
+	Interpolation bool
+	// InterpolationEnv are the environment variables ${env:VAR} can resolve, names or prefixes ending in *
+	InterpolationEnv []string
+	// SecretsKeyFile enables decrypting ENC[...] values with the base64 AES-256 key it contains
+	SecretsKeyFile string
+	// TLSCertFile and TLSKeyFile enable TLS on the gRPC server
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables mTLS, clients must present a certificate signed by this CA
+	TLSClientCAFile string
+	// TLSReloadInterval is how often certificate files are checked for rotation
+	TLSReloadInterval time.Duration
+	// TokenStoreFile enables bearer token authentication with the hashed tokens it contains
+	TokenStoreFile string
+	// AllowAnonymous lets callers with neither a bearer token nor a client certificate in, when TokenStoreFile is set
+	AllowAnonymous bool
+	// TokenReloadInterval is how often the token store file is checked for changes
+	TokenReloadInterval time.Duration
+	// ACLPolicyFile enables per-path authorization with the policy it contains
+	ACLPolicyFile string
+	// ACLReloadInterval is how often the ACL policy file is checked for changes
+	ACLReloadInterval time.Duration
+	// ShutdownTimeout is how long in-flight calls are waited for on shutdown before they are cancelled
+	ShutdownTimeout time.Duration
+	Logger          zerolog.Logger
+	// Reloads receives new settings, i.e: on SIGHUP. The token store, the ACL policy and the TLS
+	// certificates are read again at once, from their new files if they changed, and the new reload
+	// intervals and ShutdownTimeout are applied. Other settings which changed need a restart to be applied.
+	Reloads <-chan Config
+}
+
+// Validate checks the settings are consistent, and that the sources can be configured
+func (cfg Config) Validate() error {
+	if cfg.GrpcAddr == "" {
+		return fmt.Errorf("the gRPC server address is required")
+	}
+	if cfg.RootFolder == "" {
+		return fmt.Errorf("the root folder is required")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("the TLS certificate and private key must be set together")
+	}
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		return fmt.Errorf("mTLS requires a TLS certificate")
+	}
+	intervals := map[string]time.Duration{
+		"fswatcher walk": cfg.FsWalkInterval,
+		"git sync":       cfg.GitSyncInterval,
+		"TLS reload":     cfg.TLSReloadInterval,
+		"token reload":   cfg.TokenReloadInterval,
+		"ACL reload":     cfg.ACLReloadInterval,
+	}
+	for name, interval := range intervals {
+		if interval <= 0 {
+			return fmt.Errorf("the %s interval must be positive", name)
+		}
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return fmt.Errorf("the shutdown timeout must be positive")
+	}
+	if cfg.HistorySize < 0 {
+		return fmt.Errorf("the history size cannot be negative")
+	}
+	if cfg.EnableReplication && cfg.ReplicationLogSize <= 0 {
+		return fmt.Errorf("the replication log size must be positive")
+	}
+	if _, err := sourceSpecs(cfg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// changedSettings returns the names of the settings of next which differ from the ones of cfg
+func changedSettings(cfg Config, next Config) []string {
+	var changed []string
+	current, other := reflect.ValueOf(cfg), reflect.ValueOf(next)
+	for i := 0; i < current.NumField(); i++ {
+		name := current.Type().Field(i).Name
+		if name == "Logger" || name == "Reloads" {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), other.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// watcher checks the files it loaded every interval, reading them again when they change
+type watcher interface {
+	Watch(ctx context.Context, interval time.Duration)
+}
+
+// sourceSpecs returns the sources to run, read from SourcesFile or, when not set,
+// a replica of LeaderAddr if set, a git source if GitRepo is set, or a fswatcher of RootFolder otherwise
+func sourceSpecs(cfg Config) ([]source.Spec, error) {
+	if cfg.SourcesFile != "" {
+		specs, err := source.LoadSpecs(cfg.SourcesFile)
+		if err != nil {
+			return nil, err
+		}
+		for i := range specs {
+			if specs[i].Root == "" {
+				specs[i].Root = cfg.RootFolder
+			}
+		}
+		return specs, nil
+	}
+	if cfg.LeaderAddr != "" {
+		if cfg.EnableWrites {
+			return nil, fmt.Errorf("writes are not supported when replicating a leader")
+		}
+		return []source.Spec{{
+			Name: replication.Kind,
+			Kind: replication.Kind,
+			Root: cfg.RootFolder,
+			Options: map[string]string{
+				"leader":    cfg.LeaderAddr,
+				"caFile":    cfg.LeaderCAFile,
+				"certFile":  cfg.LeaderCertFile,
+				"keyFile":   cfg.LeaderKeyFile,
+				"tokenFile": cfg.LeaderTokenFile,
+			},
+		}}, nil
+	}
+	if cfg.GitRepo != "" {
+		if cfg.EnableWrites {
+			return nil, fmt.Errorf("writes are not supported when serving a git repository")
+		}
+		return []source.Spec{{
+			Name: gitsource.Kind,
+			Kind: gitsource.Kind,
+			Root: cfg.RootFolder,
+			Options: map[string]string{
+				"repo":          cfg.GitRepo,
+				"ref":           cfg.GitRef,
+				"mirrorDir":     cfg.GitMirrorDir,
+				"syncInterval":  cfg.GitSyncInterval.String(),
+				"webhookSecret": cfg.GitWebhookSecret,
+			},
+		}}, nil
+	}
+	return []source.Spec{{
+		Name:    fswatcher.Kind,
+		Kind:    fswatcher.Kind,
+		Root:    cfg.RootFolder,
+		Options: map[string]string{"walkInterval": cfg.FsWalkInterval.String()},
+	}}, nil
 }
 
-func Start(ctx context.Context, waitChan chan struct{}, cfg Config) error {
+// Start runs gonfigd until ctx is done, then shuts it down gracefully, waiting up to cfg.ShutdownTimeout for in-flight calls.
+// It returns an error when gonfigd cannot start, or when a source or a server fails, after stopping the others.
+func Start(ctx context.Context, cfg Config) (err error) {
+	ctx, stop := context.WithCancel(ctx)
+	var runErr error
+	var failOnce sync.Once
+	// fail stops gonfigd, Start returning err
+	fail := func(err error) {
+		failOnce.Do(func() { runErr = err })
+		stop()
+	}
+	// sourcesWg are the sources, stopped before the servers so their last changes reach the watchers
+	var wg, sourcesWg sync.WaitGroup
+	defer func() {
+		stop()
+		sourcesWg.Wait()
+		wg.Wait()
+		if err == nil {
+			err = runErr
+		}
+	}()
+
 	// create a server instance
 	kv, err := kv.NewKV(cfg.KvKind)
 	if err != nil {
-		log.Fatalf("failed to create new kv instance: %v", err)
+		cfg.Logger.Error().Msgf("failed to create new kv instance: %v", err)
 		return err
 	}
 
 	ps, err := pubsub.NewPubSub(cfg.PsKind)
 	if err != nil {
-		log.Fatalf("failed to create new pubsub instance: %v", err)
+		cfg.Logger.Error().Msgf("failed to create new pubsub instance: %v", err)
 		return err
 	}
 
-	var wg sync.WaitGroup
+	var historyStore *history.Store
+	if cfg.HistorySize > 0 {
+		historyStore = history.NewStore(kv, cfg.HistorySize)
+		kv = historyStore
+	}
 
-	// Start fsWatcher
-	wg.Add(1)
-	go func(ctx context.Context) {
-		defer wg.Done()
-		cfg.Logger.Info().
-			Msg("starting fswatcher")
-		if err := fswatcher.Start(ctx, cfg.RootFolder, cfg.FsWalkInterval, kv, ps, cfg.Logger); err != nil {
-			cfg.Logger.Fatal().Msgf("fswatcher returned with error: %v", err)
+	// Sources write through the replication log, so every change reaches the followers
+	var replicator api.Replicator
+	if cfg.EnableReplication {
+		replicationLog := replication.NewLog(kv, cfg.ReplicationLogSize)
+		kv = replicationLog
+		replicator = replicationLog
+	}
+
+	var deps source.DependencyTracker
+	var renderers []api.Renderer
+	if cfg.Interpolation {
+		interpolator := interpolate.NewInterpolator(cfg.RootFolder, kv)
+		interpolator.AllowEnv(cfg.InterpolationEnv...)
+		deps = interpolator
+		renderers = append(renderers, interpolator)
+	}
+	if cfg.SecretsKeyFile != "" {
+		decrypter, err := secrets.NewDecrypterFromFile(cfg.SecretsKeyFile)
+		if err != nil {
+			cfg.Logger.Error().Msgf("failed to load secrets key: %v", err)
+			return err
 		}
-	}(ctx)
+		renderers = append(renderers, decrypter)
+	}
+
+	specs, err := sourceSpecs(cfg)
+	if err != nil {
+		cfg.Logger.Error().Msgf("failed to configure sources: %v", err)
+		return err
+	}
+	env := source.Env{KV: kv, PS: ps, Deps: deps, Logger: cfg.Logger}
+	if cfg.TrustedKeysFile != "" {
+		if env.Verifier, err = signing.LoadTrustedKeys(cfg.TrustedKeysFile); err != nil {
+			cfg.Logger.Error().Msgf("failed to load trusted keys: %v", err)
+			return err
+		}
+	}
+	var sources []source.Source
+	for _, spec := range specs {
+		src, err := source.New(spec, env)
+		if err != nil {
+			cfg.Logger.Error().Msgf("failed to create source %s: %v", spec.Name, err)
+			return err
+		}
+		if err := src.Snapshot(ctx); err != nil {
+			cfg.Logger.Error().Msgf("failed to load the configs of source %s: %v", spec.Name, err)
+			return err
+		}
+		sources = append(sources, src)
+	}
+
+	// Start sources
+	for _, src := range sources {
+		sourcesWg.Add(1)
+		go func(ctx context.Context, src source.Source) {
+			defer sourcesWg.Done()
+			cfg.Logger.Info().
+				Msgf("starting source %s", src.Name())
+			if err := src.Start(ctx); err != nil {
+				cfg.Logger.Error().Msgf("source %s returned with error: %v", src.Name(), err)
+				fail(fmt.Errorf("source %s failed: %v", src.Name(), err))
+			}
+		}(ctx, src)
+	}
 
 	// Start GRPC server
 	lis, err := net.Listen("tcp", fmt.Sprintf("%s", cfg.GrpcAddr))
@@ -59,8 +347,92 @@ func Start(ctx context.Context, waitChan chan struct{}, cfg Config) error {
 		return err
 	}
 
-	s := api.NewServer(kv, ps, cfg.Logger)
-	grpcServer := grpc.NewServer()
+	// stopWatching stops the watchers by name, so they can be restarted with a new interval
+	stopWatching := make(map[string]context.CancelFunc)
+	watch := func(name string, w watcher, interval time.Duration) {
+		if stop, ok := stopWatching[name]; ok {
+			stop()
+		}
+		watchCtx, stop := context.WithCancel(ctx)
+		stopWatching[name] = stop
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Watch(watchCtx, interval)
+		}()
+	}
+
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(maxMessageSize), grpc.MaxSendMsgSize(maxMessageSize)}
+	var tlsCfg *tls.Config
+	var tlsReloader *tlsconfig.Reloader
+	if cfg.TLSCertFile != "" {
+		tlsReloader, err = tlsconfig.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile, cfg.Logger)
+		if err != nil {
+			cfg.Logger.Error().Msgf("failed to load TLS certificates: %v", err)
+			return err
+		}
+		tlsCfg = tlsReloader.TLSConfig()
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+		watch("TLS certificates", tlsReloader, cfg.TLSReloadInterval)
+	}
+
+	if cfg.OTLPAddr != "" {
+		shutdown, err := tracing.Init(cfg.OTLPAddr)
+		if err != nil {
+			cfg.Logger.Error().Msgf("failed to initialize tracing: %v", err)
+			return err
+		}
+		defer shutdown()
+	}
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		grpctrace.UnaryServerInterceptor(tracing.Tracer()),
+		api.MetricsUnaryInterceptor(),
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpctrace.StreamServerInterceptor(tracing.Tracer()),
+		api.MetricsStreamInterceptor(),
+	}
+	var gatewayAuth gateway.Auth
+	var store *tokens.Store
+	if cfg.TokenStoreFile != "" {
+		store, err = tokens.NewStore(cfg.TokenStoreFile, cfg.Logger)
+		if err != nil {
+			cfg.Logger.Error().Msgf("failed to load token store: %v", err)
+			return err
+		}
+		unaryInterceptors = append(unaryInterceptors, api.AuthenticationUnaryInterceptor(store, cfg.AllowAnonymous, cfg.Logger))
+		streamInterceptors = append(streamInterceptors, api.AuthenticationStreamInterceptor(store, cfg.AllowAnonymous, cfg.Logger))
+		gatewayAuth.Authenticator = store
+		gatewayAuth.AllowAnonymous = cfg.AllowAnonymous
+		watch("token store", store, cfg.TokenReloadInterval)
+	}
+	var enforcer *acl.Enforcer
+	if cfg.ACLPolicyFile != "" {
+		enforcer, err = acl.NewEnforcer(cfg.ACLPolicyFile, cfg.Logger)
+		if err != nil {
+			cfg.Logger.Error().Msgf("failed to load ACL policy: %v", err)
+			return err
+		}
+		unaryInterceptors = append(unaryInterceptors, api.AuthorizationUnaryInterceptor(enforcer, cfg.Logger))
+		streamInterceptors = append(streamInterceptors, api.AuthorizationStreamInterceptor(enforcer, cfg.Logger))
+		gatewayAuth.Authorizer = enforcer
+		watch("ACL policy", enforcer, cfg.ACLReloadInterval)
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
+
+	var writer *configtree.Writer
+	if cfg.EnableWrites {
+		writer = configtree.NewWriter(cfg.RootFolder)
+	}
+	s := api.NewServer(kv, ps, writer, replicator, cfg.Logger, renderers...)
+	if historyStore != nil {
+		s.SetHistory(historyStore)
+	}
+	grpcServer := grpc.NewServer(opts...)
 	api.RegisterGonfigServer(grpcServer, s)
 
 	wg.Add(1)
@@ -68,15 +440,166 @@ func Start(ctx context.Context, waitChan chan struct{}, cfg Config) error {
 		defer wg.Done()
 		cfg.Logger.Info().
 			Msg("starting gonfigd gRPC server")
-		if err = grpcServer.Serve(lis); err != nil {
-			cfg.Logger.Fatal().Msgf("failed to serve: %v", err)
+		if err := grpcServer.Serve(lis); err != nil {
+			cfg.Logger.Error().Msgf("failed to serve: %v", err)
+			fail(fmt.Errorf("gRPC server failed: %v", err))
 		}
 	}()
 
+	var gatewayHandler *gateway.Server
+	var gatewayServer *http.Server
+	if cfg.HTTPAddr != "" {
+		gatewayHandler = gateway.NewServer(kv, ps, cfg.RootFolder, gatewayAuth, cfg.Logger, renderers...)
+		var handler http.Handler = gatewayHandler
+		// Sources accepting webhooks, i.e: git, are served at /v1/hooks/{name}
+		mux := http.NewServeMux()
+		for _, src := range sources {
+			if hook, ok := src.(http.Handler); ok {
+				mux.Handle("/v1/hooks/"+src.Name(), hook)
+			}
+		}
+		mux.Handle("/", handler)
+		handler = mux
+		gatewayServer = &http.Server{
+			Addr:      cfg.HTTPAddr,
+			Handler:   handler,
+			TLSConfig: tlsCfg,
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg.Logger.Info().
+				Msgf("starting HTTP gateway at %s", cfg.HTTPAddr)
+			var err error
+			if tlsCfg != nil {
+				err = gatewayServer.ListenAndServeTLS("", "")
+			} else {
+				err = gatewayServer.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				cfg.Logger.Error().Msgf("HTTP gateway failed: %v", err)
+				fail(fmt.Errorf("HTTP gateway failed: %v", err))
+			}
+		}()
+	}
+
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{Addr: cfg.MetricsAddr, Handler: mux}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg.Logger.Info().
+				Msgf("starting metrics server at %s", cfg.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				cfg.Logger.Error().Msgf("metrics server failed: %v", err)
+				fail(fmt.Errorf("metrics server failed: %v", err))
+			}
+		}()
+	}
+
+	// current are the settings in use, updated with the ones applied on reload
+	current := cfg
+	var currentMu sync.Mutex
+	// reload reads the files of the token store, the ACL policy and the TLS certificates again,
+	// switching to their new files if they changed, and applies the new intervals and shutdown timeout
+	reload := func(next Config) {
+		currentMu.Lock()
+		defer currentMu.Unlock()
+		if tlsReloader != nil && next.TLSCertFile != "" {
+			if err := tlsReloader.SetFiles(next.TLSCertFile, next.TLSKeyFile, next.TLSClientCAFile); err != nil {
+				cfg.Logger.Error().Msgf("failed to reload TLS certificates, keeping the previous ones: %v", err)
+			} else {
+				current.TLSCertFile, current.TLSKeyFile, current.TLSClientCAFile = next.TLSCertFile, next.TLSKeyFile, next.TLSClientCAFile
+				cfg.Logger.Info().Msgf("TLS certificates reloaded from %s", next.TLSCertFile)
+			}
+			if next.TLSReloadInterval != current.TLSReloadInterval {
+				watch("TLS certificates", tlsReloader, next.TLSReloadInterval)
+				current.TLSReloadInterval = next.TLSReloadInterval
+			}
+		}
+		if store != nil && next.TokenStoreFile != "" {
+			if err := store.SetFile(next.TokenStoreFile); err != nil {
+				cfg.Logger.Error().Msgf("failed to reload token store, keeping the previous one: %v", err)
+			} else {
+				current.TokenStoreFile = next.TokenStoreFile
+				cfg.Logger.Info().Msgf("token store reloaded from %s", next.TokenStoreFile)
+			}
+			if next.TokenReloadInterval != current.TokenReloadInterval {
+				watch("token store", store, next.TokenReloadInterval)
+				current.TokenReloadInterval = next.TokenReloadInterval
+			}
+		}
+		if enforcer != nil && next.ACLPolicyFile != "" {
+			if err := enforcer.SetFile(next.ACLPolicyFile); err != nil {
+				cfg.Logger.Error().Msgf("failed to reload ACL policy, keeping the previous one: %v", err)
+			} else {
+				current.ACLPolicyFile = next.ACLPolicyFile
+				cfg.Logger.Info().Msgf("ACL policy reloaded from %s", next.ACLPolicyFile)
+			}
+			if next.ACLReloadInterval != current.ACLReloadInterval {
+				watch("ACL policy", enforcer, next.ACLReloadInterval)
+				current.ACLReloadInterval = next.ACLReloadInterval
+			}
+		}
+		current.ShutdownTimeout = next.ShutdownTimeout
+		if changed := changedSettings(current, next); len(changed) > 0 {
+			cfg.Logger.Warn().Msgf("settings %s changed, restart gonfigd to apply them", strings.Join(changed, ", "))
+		}
+	}
+	if cfg.Reloads != nil {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			for {
+				select {
+				case next := <-cfg.Reloads:
+					reload(next)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(ctx)
+	}
+
 	<-ctx.Done()
-	grpcServer.Stop()
+	cfg.Logger.Info().Msg("shutting down gonfigd")
+	// In-flight changes are published before watchers are told the server is shutting down
+	sourcesWg.Wait()
+	s.Shutdown()
+	if gatewayHandler != nil {
+		gatewayHandler.Shutdown()
+	}
 
-	wg.Wait()
-	waitChan <- struct{}{}
+	currentMu.Lock()
+	shutdownTimeout := current.ShutdownTimeout
+	currentMu.Unlock()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	if gatewayServer != nil {
+		if err := gatewayServer.Shutdown(shutdownCtx); err != nil {
+			cfg.Logger.Warn().Msgf("HTTP gateway requests still running after %s, closing them", shutdownTimeout)
+			gatewayServer.Close()
+		}
+	}
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		cfg.Logger.Warn().Msgf("gRPC calls still running after %s, cancelling them", shutdownTimeout)
+		grpcServer.Stop()
+		<-stopped
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
 	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -17,6 +18,8 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var cfg *Config
@@ -37,7 +40,9 @@ func pickRandomTCPPort() int {
 
 func TestGetConfig(t *testing.T) {
 	var conn *grpc.ClientConn
-	conn, e1 := grpc.Dial(cfg.GrpcAddr, grpc.WithInsecure())
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dialCancel()
+	conn, e1 := grpc.DialContext(dialCtx, cfg.GrpcAddr, grpc.WithInsecure(), grpc.WithBlock())
 	assert.Nil(t, e1)
 	assert.NotNil(t, conn)
 	defer conn.Close()
@@ -51,16 +56,20 @@ func TestGetConfig(t *testing.T) {
 	client, e2 := c.WatchConfig(ctx, &api.WatchConfigRequest{ConfigPath: fp})
 	assert.Nil(t, e2)
 	assert.NotNil(t, client)
+	// The file is written once subscribed, the fswatcher publishes its event right away
+	_, e3 := client.Header()
+	assert.Nil(t, e3)
 	outCh := make(chan string)
-	defer close(outCh)
 	go func(outCh chan string) {
 		for {
+			resp, err := client.Recv()
+			if err != nil {
+				return
+			}
 			select {
-			case <-time.After(1 * time.Second):
-				resp, _ := client.Recv()
-				if resp != nil {
-					outCh <- resp.GetEvent()
-				}
+			case outCh <- resp.GetEvent():
+			case <-ctx.Done():
+				return
 			}
 		}
 	}(outCh)
@@ -76,10 +85,185 @@ func TestGetConfig(t *testing.T) {
 	assert.Equal(t, response.GetConfig(), "foo: bar")
 }
 
+func TestPutConfig(t *testing.T) {
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dialCancel()
+	conn, e1 := grpc.DialContext(dialCtx, cfg.GrpcAddr, grpc.WithInsecure(), grpc.WithBlock())
+	assert.Nil(t, e1)
+	defer conn.Close()
+
+	c := api.NewGonfigClient(conn)
+	ctx := context.Background()
+	fp := fmt.Sprintf("%s/put/test.yaml", cfg.RootFolder)
+
+	resp, e2 := c.PutConfig(ctx, &api.PutConfigRequest{ConfigPath: fp, Config: "foo: bar"})
+	assert.Nil(t, e2)
+	data, _ := ioutil.ReadFile(fp)
+	assert.Equal(t, "foo: bar", string(data))
+
+	_, e3 := c.PutConfig(ctx, &api.PutConfigRequest{ConfigPath: fp, Config: "foo: baz", ExpectedMD5: "0123"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(e3))
+
+	_, e4 := c.PutConfig(ctx, &api.PutConfigRequest{ConfigPath: fp, Config: "foo: [baz"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(e4))
+
+	_, e5 := c.DeleteConfig(ctx, &api.DeleteConfigRequest{ConfigPath: fp, ExpectedMD5: resp.GetMd5()})
+	assert.Nil(t, e5)
+	_, statErr := os.Stat(fp)
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		GrpcAddr:            ":8080",
+		RootFolder:          "/etc/gonfigd",
+		FsWalkInterval:      5 * time.Second,
+		GitSyncInterval:     30 * time.Second,
+		TLSReloadInterval:   30 * time.Second,
+		TokenReloadInterval: 10 * time.Second,
+		ACLReloadInterval:   10 * time.Second,
+		ShutdownTimeout:     10 * time.Second,
+	}
+	assert.Nil(t, valid.Validate())
+
+	invalid := []func(cfg *Config){
+		func(cfg *Config) { cfg.GrpcAddr = "" },
+		func(cfg *Config) { cfg.TLSCertFile = "server.crt" },
+		func(cfg *Config) { cfg.TLSClientCAFile = "ca.crt" },
+		func(cfg *Config) { cfg.FsWalkInterval = 0 },
+		func(cfg *Config) { cfg.ShutdownTimeout = 0 },
+		func(cfg *Config) { cfg.HistorySize = -1 },
+		func(cfg *Config) { cfg.EnableReplication = true },
+		func(cfg *Config) { cfg.GitRepo, cfg.EnableWrites = "file:///repo", true },
+		func(cfg *Config) { cfg.SourcesFile = "/does/not/exist.yaml" },
+	}
+	for _, fn := range invalid {
+		cfg := valid
+		fn(&cfg)
+		assert.NotNil(t, cfg.Validate())
+	}
+}
+
+func TestChangedSettings(t *testing.T) {
+	current := Config{GrpcAddr: ":8080", ACLPolicyFile: "acl.yaml", Logger: zerolog.Nop()}
+	next := current
+	next.Logger = zerolog.New(os.Stderr)
+	next.Reloads = make(chan Config)
+	assert.Empty(t, changedSettings(current, next))
+	next.GrpcAddr = ":9090"
+	next.HistorySize = 5
+	assert.Equal(t, []string{"GrpcAddr", "HistorySize"}, changedSettings(current, next))
+}
+
+func TestShutdown(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gonfig-shutdown-tests")
+	defer os.RemoveAll(dir)
+	shutdownCfg := *cfg
+	shutdownCfg.GrpcAddr = fmt.Sprintf("127.0.0.1:%d", pickRandomTCPPort())
+	shutdownCfg.RootFolder = dir
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- Start(ctx, shutdownCfg)
+	}()
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dialCancel()
+	conn, err := grpc.DialContext(dialCtx, shutdownCfg.GrpcAddr, grpc.WithInsecure(), grpc.WithBlock())
+	assert.Nil(t, err)
+	defer conn.Close()
+	stream, err := api.NewGonfigClient(conn).WatchConfig(context.Background(), &api.WatchConfigRequest{ConfigPath: dir + "/test.yaml"})
+	assert.Nil(t, err)
+	_, err = stream.Header()
+	assert.Nil(t, err)
+
+	// Watchers get a last event before their stream ends
+	cancel()
+	resp, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.Contains(t, resp.GetEvent(), pubsub.ServerShuttingDown.String())
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("gonfigd did not stop")
+	}
+}
+
+func TestReloadACLPolicyFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gonfig-reload-tests")
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "configs")
+	os.Mkdir(root, 0755)
+	ioutil.WriteFile(filepath.Join(root, "test.yaml"), []byte("foo: bar"), 0644)
+	denyAll := filepath.Join(dir, "deny.yaml")
+	ioutil.WriteFile(denyAll, []byte("rules:\n  - identities: [\"nobody\"]\n    paths: [\"**\"]\n    verbs: [\"get\"]"), 0644)
+	allowGet := filepath.Join(dir, "allow.yaml")
+	ioutil.WriteFile(allowGet, []byte("rules:\n  - identities: [\"anonymous\"]\n    paths: [\"**\"]\n    verbs: [\"get\"]"), 0644)
+
+	reloads := make(chan Config, 1)
+	reloadCfg := *cfg
+	reloadCfg.GrpcAddr = fmt.Sprintf("127.0.0.1:%d", pickRandomTCPPort())
+	reloadCfg.RootFolder = root
+	reloadCfg.ACLPolicyFile = denyAll
+	reloadCfg.ACLReloadInterval = time.Hour
+	reloadCfg.Reloads = reloads
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- Start(ctx, reloadCfg)
+	}()
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dialCancel()
+	conn, err := grpc.DialContext(dialCtx, reloadCfg.GrpcAddr, grpc.WithInsecure(), grpc.WithBlock())
+	assert.Nil(t, err)
+	defer conn.Close()
+	c := api.NewGonfigClient(conn)
+	req := &api.GetConfigRequest{ConfigPath: filepath.Join(root, "test.yaml")}
+	_, err = c.GetConfig(context.Background(), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// The new policy file is enforced without a restart
+	next := reloadCfg
+	next.ACLPolicyFile = allowGet
+	reloads <- next
+	assert.Eventually(t, func() bool {
+		resp, err := c.GetConfig(context.Background(), req)
+		return err == nil && resp.GetConfig() == "foo: bar"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("gonfigd did not stop")
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	// The address is taken by the gonfigd of TestMain
+	failingCfg := *cfg
+	failingCfg.RootFolder, _ = ioutil.TempDir("", "gonfig-failure-tests")
+	defer os.RemoveAll(failingCfg.RootFolder)
+	done := make(chan error, 1)
+	go func() {
+		done <- Start(context.Background(), failingCfg)
+	}()
+	select {
+	case err := <-done:
+		assert.NotNil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("gonfigd did not fail")
+	}
+}
+
 func TestMain(m *testing.M) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	waitChan := make(chan struct{})
 
 	logger := zerolog.New(os.Stderr).
 		With().
@@ -93,18 +277,26 @@ func TestMain(m *testing.M) {
 	}
 	defer os.Remove(dir)
 	cfg = &Config{
-		GrpcAddr:       fmt.Sprintf(":%d", pickRandomTCPPort()),
-		KvKind:         kv.INMEMORY,
-		PsKind:         pubsub.INMEMORY,
-		RootFolder:     dir,
-		FsWalkInterval: 5 * time.Second,
-		Logger:         logger,
+		GrpcAddr:        fmt.Sprintf(":%d", pickRandomTCPPort()),
+		KvKind:          kv.INMEMORY,
+		PsKind:          pubsub.INMEMORY,
+		RootFolder:      dir,
+		FsWalkInterval:  5 * time.Second,
+		EnableWrites:    true,
+		ShutdownTimeout: 5 * time.Second,
+		Logger:          logger,
 	}
 
-	go Start(ctx, waitChan, *cfg)
+	done := make(chan error, 1)
+	go func() {
+		done <- Start(ctx, *cfg)
+	}()
 
 	res := m.Run()
 	cancel()
-	<-waitChan
+	if err := <-done; err != nil {
+		log.Printf("gonfigd failed: %v", err)
+		res = 1
+	}
 	os.Exit(res)
 }
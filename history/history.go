@@ -0,0 +1,124 @@
+// Package history keeps the last versions of every config of a KV,
+// so operators can inspect how a config changed and roll it back
+package history
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/kv"
+)
+
+// DefaultSize is how many versions of every config are kept by default
+const DefaultSize = 10
+
+// Version is a version of a config, the deletion of the config when Deleted is set
+type Version struct {
+	MD5          string
+	LastModified time.Time
+	Content      string
+	Metadata     map[string]string
+	Deleted      bool
+}
+
+// Store is a kv.KV recording the versions of every config it writes
+type Store struct {
+	kv.KV
+	mu       sync.Mutex
+	size     int
+	versions map[string][]Version
+}
+
+// NewStore returns a new *Store recording the versions written into store
+// size int, how many versions of every config are kept, deletions included
+func NewStore(store kv.KV, size int) *Store {
+	return &Store{KV: store, size: size, versions: make(map[string][]Version)}
+}
+
+// Versions returns the versions of key, newest first
+func (s *Store) Versions(key string) []Version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Version(nil), s.versions[key]...)
+}
+
+// record prepends a version of key, the lock must be held by the caller
+func (s *Store) record(key string, v *kv.Value) {
+	version := Version{LastModified: time.Now(), Deleted: true}
+	if v != nil {
+		version = Version{MD5: v.MD5(), LastModified: v.LastModified(), Content: v.Text(), Metadata: v.AllMetadata()}
+	}
+	versions := append([]Version{version}, s.versions[key]...)
+	if len(versions) > s.size {
+		versions = versions[:s.size]
+	}
+	s.versions[key] = versions
+}
+
+// Put implements kv.KV
+func (s *Store) Put(key string, value *kv.Value) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.KV.Put(key, value); err != nil {
+		return err
+	}
+	s.record(key, value)
+	return nil
+}
+
+// PutIfMatch implements kv.KV
+func (s *Store) PutIfMatch(key string, value *kv.Value, expectedMD5 string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.KV.PutIfMatch(key, value, expectedMD5); err != nil {
+		return err
+	}
+	s.record(key, value)
+	return nil
+}
+
+// Update implements kv.KV
+func (s *Store) Update(key string, fn kv.UpdateFunc) (*kv.Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	v, err := s.KV.Update(key, func(old *kv.Value) (*kv.Value, error) {
+		v, err := fn(old)
+		changed = err == nil && v != nil
+		return v, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		s.record(key, v)
+	}
+	return v, nil
+}
+
+// Delete implements kv.KV
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.KV.Get(key); err != nil {
+		return s.KV.Delete(key)
+	}
+	if err := s.KV.Delete(key); err != nil {
+		return err
+	}
+	s.record(key, nil)
+	return nil
+}
+
+// Apply implements kv.KV
+func (s *Store) Apply(changes map[string]*kv.Value) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.KV.Apply(changes); err != nil {
+		return err
+	}
+	for key, v := range changes {
+		s.record(key, v)
+	}
+	return nil
+}
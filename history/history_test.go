@@ -0,0 +1,40 @@
+package history
+
+import (
+	"testing"
+
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersions(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	s := NewStore(db, 3)
+	v1, _ := kv.NewValue([]byte("foo: bar"))
+	v2, _ := kv.NewValueWithMetadata([]byte("foo: baz"), map[string]string{kv.MetadataCommit: "abc"})
+	v3, _ := kv.NewValue([]byte("foo: qux"))
+
+	assert.Nil(t, s.Put("/configs/db.yaml", v1))
+	assert.Nil(t, s.PutIfMatch("/configs/db.yaml", v2, v1.MD5()))
+	// Failed and no-op writes are not recorded
+	assert.NotNil(t, s.PutIfMatch("/configs/db.yaml", v3, "bad-md5"))
+	s.Update("/configs/db.yaml", func(old *kv.Value) (*kv.Value, error) { return nil, nil })
+	assert.Nil(t, s.Delete("/configs/missing.yaml"))
+
+	versions := s.Versions("/configs/db.yaml")
+	assert.Len(t, versions, 2)
+	assert.Equal(t, v2.MD5(), versions[0].MD5)
+	assert.Equal(t, "foo: baz", versions[0].Content)
+	assert.Equal(t, "abc", versions[0].Metadata[kv.MetadataCommit])
+	assert.Equal(t, v1.MD5(), versions[1].MD5)
+	assert.Empty(t, s.Versions("/configs/missing.yaml"))
+
+	// Only the last versions are kept
+	assert.Nil(t, s.Delete("/configs/db.yaml"))
+	assert.Nil(t, s.Apply(map[string]*kv.Value{"/configs/db.yaml": v3}))
+	versions2 := s.Versions("/configs/db.yaml")
+	assert.Len(t, versions2, 3)
+	assert.Equal(t, v3.MD5(), versions2[0].MD5)
+	assert.True(t, versions2[1].Deleted)
+	assert.Equal(t, v2.MD5(), versions2[2].MD5)
+}
@@ -0,0 +1,57 @@
+package interpolate
+
+import "fmt"
+
+const (
+	UnresolvedReference ErrType = "UNRESOLVED_REFERENCE_ERROR"
+	CyclicReference     ErrType = "CYCLIC_REFERENCE_ERROR"
+	Unknown             ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type UnresolvedReferenceError struct {
+	errType ErrType
+	ref     string
+	reason  string
+}
+
+type CyclicReferenceError struct {
+	errType ErrType
+	config  string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case UnresolvedReferenceError:
+		return UnresolvedReference
+	case CyclicReferenceError:
+		return CyclicReference
+	default:
+		return Unknown
+	}
+}
+
+func IsUnresolvedReferenceError(e error) bool {
+	return getErrorType(e) == UnresolvedReference
+}
+
+func IsCyclicReferenceError(e error) bool {
+	return getErrorType(e) == CyclicReference
+}
+
+func (e UnresolvedReferenceError) Error() string {
+	return fmt.Sprintf("[%s] Reference %s could not be resolved: %s", e.errType, e.ref, e.reason)
+}
+
+func (e CyclicReferenceError) Error() string {
+	return fmt.Sprintf("[%s] Config %s is part of a reference cycle", e.errType, e.config)
+}
+
+func NewUnresolvedReferenceError(ref string, reason string) UnresolvedReferenceError {
+	return UnresolvedReferenceError{errType: UnresolvedReference, ref: ref, reason: reason}
+}
+
+func NewCyclicReferenceError(config string) CyclicReferenceError {
+	return CyclicReferenceError{errType: CyclicReference, config: config}
+}
@@ -0,0 +1,231 @@
+// Package interpolate resolves variable references inside configs before they are served
+package interpolate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fcgravalos/gonfigd/kv"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	envScheme  = "env"
+	fileScheme = "file"
+)
+
+// refRegexp matches ${env:VAR} and ${file:path/to/config.yaml#some.key} references
+var refRegexp = regexp.MustCompile(`\$\{(env|file):([^}]+)\}`)
+
+type configSet map[string]struct{}
+
+// Interpolator renders configs replacing their references,
+// and keeps track of which configs depend on which
+type Interpolator struct {
+	sync.RWMutex
+	root string
+	kv   kv.KV
+	// deps holds the configs referenced by each config
+	deps map[string]configSet
+	// rdeps holds the configs referencing each config
+	rdeps map[string]configSet
+	// envAllowed are the environment variables references can resolve, names or prefixes ending in *
+	envAllowed []string
+}
+
+// NewInterpolator returns a new *Interpolator
+// root string, the root folder file references are relative to
+// kv kv.KV, where referenced configs will be read from
+func NewInterpolator(root string, kv kv.KV) *Interpolator {
+	return &Interpolator{
+		root:  root,
+		kv:    kv,
+		deps:  make(map[string]configSet),
+		rdeps: make(map[string]configSet),
+	}
+}
+
+// AllowEnv lets references resolve the given environment variables, names or prefixes ending in *, i.e: APP_*
+// No environment variable can be referenced otherwise, as they may hold the secrets of the daemon.
+// It must be called before rendering any config.
+func (i *Interpolator) AllowEnv(patterns ...string) {
+	i.envAllowed = append(i.envAllowed, patterns...)
+}
+
+func (i *Interpolator) isEnvAllowed(name string) bool {
+	for _, p := range i.envAllowed {
+		if p == name || (strings.HasSuffix(p, "*") && strings.HasPrefix(name, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasReferences checks whether content holds any reference
+func (i *Interpolator) HasReferences(content string) bool {
+	return refRegexp.MatchString(content)
+}
+
+// splitFileRef splits a file reference into the config key in the KV and the (optional) yaml key
+func (i *Interpolator) splitFileRef(ref string) (string, string) {
+	parts := strings.SplitN(ref, "#", 2)
+	path := filepath.Join(i.root, parts[0])
+	if len(parts) == 1 {
+		return path, ""
+	}
+	return path, parts[1]
+}
+
+// references returns the configs referenced in content
+func (i *Interpolator) references(content string) configSet {
+	refs := make(configSet)
+	for _, m := range refRegexp.FindAllStringSubmatch(content, -1) {
+		if m[1] == fileScheme {
+			path, _ := i.splitFileRef(m[2])
+			refs[path] = struct{}{}
+		}
+	}
+	return refs
+}
+
+// Track updates the dependencies of the given config from its content
+func (i *Interpolator) Track(path string, content string) {
+	refs := i.references(content)
+	i.Lock()
+	defer i.Unlock()
+	for dep := range i.deps[path] {
+		delete(i.rdeps[dep], path)
+		if len(i.rdeps[dep]) == 0 {
+			delete(i.rdeps, dep)
+		}
+	}
+	if len(refs) == 0 {
+		delete(i.deps, path)
+		return
+	}
+	i.deps[path] = refs
+	for dep := range refs {
+		if _, ok := i.rdeps[dep]; !ok {
+			i.rdeps[dep] = make(configSet)
+		}
+		i.rdeps[dep][path] = struct{}{}
+	}
+}
+
+// Untrack forgets the dependencies of the given config
+// Configs referencing it are still tracked, as they will be rendered again if it comes back
+func (i *Interpolator) Untrack(path string) {
+	i.Track(path, "")
+}
+
+// Dependents returns, sorted, every config that directly or transitively references the given config
+func (i *Interpolator) Dependents(path string) []string {
+	i.RLock()
+	defer i.RUnlock()
+	visited := configSet{path: struct{}{}}
+	pending := []string{path}
+	dependents := []string{}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		for d := range i.rdeps[current] {
+			if _, ok := visited[d]; ok {
+				continue
+			}
+			visited[d] = struct{}{}
+			dependents = append(dependents, d)
+			pending = append(pending, d)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// Render returns content with all its references resolved
+func (i *Interpolator) Render(path string, content string) (string, error) {
+	return i.render(path, content, configSet{path: struct{}{}})
+}
+
+func (i *Interpolator) render(path string, content string, visiting configSet) (string, error) {
+	var rErr error
+	rendered := refRegexp.ReplaceAllStringFunc(content, func(ref string) string {
+		if rErr != nil {
+			return ref
+		}
+		m := refRegexp.FindStringSubmatch(ref)
+		var value string
+		switch m[1] {
+		case envScheme:
+			if !i.isEnvAllowed(m[2]) {
+				rErr = NewUnresolvedReferenceError(ref, "environment variable is not allowed")
+				return ref
+			}
+			v, ok := os.LookupEnv(m[2])
+			if !ok {
+				rErr = NewUnresolvedReferenceError(ref, "environment variable is not set")
+				return ref
+			}
+			value = v
+		case fileScheme:
+			value, rErr = i.resolveFile(ref, m[2], visiting)
+		}
+		return value
+	})
+	if rErr != nil {
+		return "", rErr
+	}
+	return rendered, nil
+}
+
+func (i *Interpolator) resolveFile(ref string, fileRef string, visiting configSet) (string, error) {
+	path, key := i.splitFileRef(fileRef)
+	if _, ok := visiting[path]; ok {
+		return "", NewCyclicReferenceError(path)
+	}
+	v, err := i.kv.Get(path)
+	if err != nil {
+		return "", NewUnresolvedReferenceError(ref, err.Error())
+	}
+
+	visiting[path] = struct{}{}
+	content, err := i.render(path, v.Text(), visiting)
+	delete(visiting, path)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return content, nil
+	}
+	return lookupKey(ref, content, key)
+}
+
+// lookupKey finds a dot-separated key (i.e: database.port) within a YAML/JSON document
+func lookupKey(ref string, content string, key string) (string, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return "", NewUnresolvedReferenceError(ref, err.Error())
+	}
+	for _, k := range strings.Split(key, ".") {
+		m, ok := doc.(map[interface{}]interface{})
+		if !ok {
+			return "", NewUnresolvedReferenceError(ref, fmt.Sprintf("%s is not a map", k))
+		}
+		if doc, ok = m[k]; !ok {
+			return "", NewUnresolvedReferenceError(ref, fmt.Sprintf("key %s not found", k))
+		}
+	}
+	switch doc.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		out, err := yaml.Marshal(doc)
+		if err != nil {
+			return "", NewUnresolvedReferenceError(ref, err.Error())
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return fmt.Sprintf("%v", doc), nil
+}
@@ -0,0 +1,80 @@
+package interpolate
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+func putConfig(db kv.KV, key string, content string) {
+	v, _ := kv.NewValue([]byte(content))
+	db.Put(key, v)
+}
+
+func TestRender(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	i := NewInterpolator("/configs", db)
+	i.AllowEnv("GONFIGD_TEST_HOST", "GONFIGD_TEST_U*")
+
+	os.Setenv("GONFIGD_TEST_HOST", "db.example.com")
+	defer os.Unsetenv("GONFIGD_TEST_HOST")
+	putConfig(db, "/configs/common.yaml", "database:\n  host: ${env:GONFIGD_TEST_HOST}\n  port: 5432")
+
+	out, err := i.Render("/configs/app.yaml", "addr: ${file:common.yaml#database.host}:${file:common.yaml#database.port}")
+	assert.Nil(t, err)
+	assert.Equal(t, "addr: db.example.com:5432", out)
+
+	out2, err2 := i.Render("/configs/app.yaml", "${file:common.yaml#database}")
+	assert.Nil(t, err2)
+	assert.Equal(t, "host: db.example.com\nport: 5432", out2)
+
+	out3, err3 := i.Render("/configs/app.yaml", "no references")
+	assert.Nil(t, err3)
+	assert.Equal(t, "no references", out3)
+
+	_, err4 := i.Render("/configs/app.yaml", "${env:GONFIGD_TEST_UNSET}")
+	assert.EqualError(t, err4, fmt.Sprintf("[%s] Reference ${env:GONFIGD_TEST_UNSET} could not be resolved: environment variable is not set", UnresolvedReference))
+
+	// Only allowed environment variables can be referenced
+	os.Setenv("GONFIGD_TEST_SECRET", "s3cr3t")
+	defer os.Unsetenv("GONFIGD_TEST_SECRET")
+	_, err8 := i.Render("/configs/app.yaml", "${env:GONFIGD_TEST_SECRET}")
+	assert.EqualError(t, err8, fmt.Sprintf("[%s] Reference ${env:GONFIGD_TEST_SECRET} could not be resolved: environment variable is not allowed", UnresolvedReference))
+
+	assert.True(t, i.HasReferences("a: ${file:common.yaml}"))
+	assert.False(t, i.HasReferences("a: $HOME"))
+
+	_, err5 := i.Render("/configs/app.yaml", "${file:missing.yaml}")
+	assert.True(t, IsUnresolvedReferenceError(err5))
+
+	_, err6 := i.Render("/configs/app.yaml", "${file:common.yaml#database.user}")
+	assert.EqualError(t, err6, fmt.Sprintf("[%s] Reference ${file:common.yaml#database.user} could not be resolved: key user not found", UnresolvedReference))
+
+	putConfig(db, "/configs/a.yaml", "${file:b.yaml}")
+	putConfig(db, "/configs/b.yaml", "${file:a.yaml}")
+	_, err7 := i.Render("/configs/a.yaml", "${file:b.yaml}")
+	assert.True(t, IsCyclicReferenceError(err7))
+}
+
+func TestDependents(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	i := NewInterpolator("/configs", db)
+
+	i.Track("/configs/app.yaml", "${file:common.yaml#host} ${env:FOO}")
+	i.Track("/configs/common.yaml", "host: ${file:base.yaml#host}")
+	i.Track("/configs/other.yaml", "${file:base.yaml}")
+
+	assert.Equal(t, []string{"/configs/app.yaml", "/configs/common.yaml", "/configs/other.yaml"}, i.Dependents("/configs/base.yaml"))
+	assert.Equal(t, []string{"/configs/app.yaml"}, i.Dependents("/configs/common.yaml"))
+	assert.Equal(t, []string{}, i.Dependents("/configs/app.yaml"))
+
+	i.Track("/configs/common.yaml", "host: localhost")
+	assert.Equal(t, []string{"/configs/other.yaml"}, i.Dependents("/configs/base.yaml"))
+
+	i.Untrack("/configs/other.yaml")
+	assert.Equal(t, []string{}, i.Dependents("/configs/base.yaml"))
+	assert.Equal(t, []string{"/configs/app.yaml"}, i.Dependents("/configs/common.yaml"))
+}
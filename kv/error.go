@@ -6,6 +6,7 @@ const (
 	KeyNotFound    ErrType = "KEY_NOT_FOUND_ERROR"
 	Compression    ErrType = "COMPRESSION_ERROR"
 	NotImplemented ErrType = "NOT_IMPLEMENTED_ERROR"
+	Conflict       ErrType = "CONFLICT_ERROR"
 	Unknown        ErrType = "UNKNOWN_ERROR"
 )
 
@@ -27,6 +28,13 @@ type NotImplementedError struct {
 	kvImpl  string
 }
 
+type ConflictError struct {
+	errType     ErrType
+	key         string
+	expectedMD5 string
+	actualMD5   string
+}
+
 func getErrorType(e error) ErrType {
 	switch e.(type) {
 	case KeyNotFoundError:
@@ -35,6 +43,8 @@ func getErrorType(e error) ErrType {
 		return Compression
 	case NotImplementedError:
 		return NotImplemented
+	case ConflictError:
+		return Conflict
 	default:
 		return Unknown
 	}
@@ -52,6 +62,10 @@ func IsNotImplementedError(e error) bool {
 	return getErrorType(e) == NotImplemented
 }
 
+func IsConflictError(e error) bool {
+	return getErrorType(e) == Conflict
+}
+
 func (e KeyNotFoundError) Error() string {
 	return fmt.Sprintf("[%s] Key %s not found in KV", e.errType, e.key)
 }
@@ -75,3 +89,17 @@ func NewCompressionError(data []byte, err error) CompressionError {
 func NewNotImplementedError(impl string) NotImplementedError {
 	return NotImplementedError{errType: NotImplemented, kvImpl: impl}
 }
+
+func (e ConflictError) Error() string {
+	if e.actualMD5 == "" {
+		return fmt.Sprintf("[%s] Key %s not found in KV, expected md5 %s", e.errType, e.key, e.expectedMD5)
+	}
+	if e.expectedMD5 == "" {
+		return fmt.Sprintf("[%s] Key %s already exists with md5 %s", e.errType, e.key, e.actualMD5)
+	}
+	return fmt.Sprintf("[%s] Key %s has md5 %s, expected %s", e.errType, e.key, e.actualMD5, e.expectedMD5)
+}
+
+func NewConflictError(key string, expectedMD5 string, actualMD5 string) ConflictError {
+	return ConflictError{errType: Conflict, key: key, expectedMD5: expectedMD5, actualMD5: actualMD5}
+}
@@ -1,7 +1,11 @@
 package kv
 
 import (
+	"sort"
+	"strings"
 	"sync"
+
+	"github.com/fcgravalos/gonfigd/metrics"
 )
 
 // InMemory is an in-memory data structure implementation of the KV interface
@@ -10,28 +14,111 @@ type InMemory struct {
 	Db map[string]*Value
 }
 
+// put stores value, the lock must be held by the caller
+func (im *InMemory) put(key string, value *Value) {
+	if old, ok := im.Db[key]; ok {
+		metrics.KVSize.Sub(float64(len(old.Data())))
+	} else {
+		metrics.KVKeys.Inc()
+	}
+	im.Db[key] = value
+	metrics.KVSize.Add(float64(len(value.Data())))
+}
+
 // Put inserts a new key/Value pair in the KV Db
 // It wont raise any error as the operation is safe
 func (im *InMemory) Put(key string, value *Value) error {
 	im.Lock()
-	im.Db[key] = value
+	im.put(key, value)
 	im.Unlock()
 	return nil
 }
 
+// PutIfMatch inserts value only if the current value of key has expectedMD5
+// An empty expectedMD5 only inserts value if key does not exist
+func (im *InMemory) PutIfMatch(key string, value *Value, expectedMD5 string) error {
+	im.Lock()
+	defer im.Unlock()
+	actualMD5 := ""
+	if old, ok := im.Db[key]; ok {
+		actualMD5 = old.MD5()
+	}
+	if actualMD5 != expectedMD5 {
+		return NewConflictError(key, expectedMD5, actualMD5)
+	}
+	im.put(key, value)
+	return nil
+}
+
+// Update replaces the value of key with the one returned by fn, holding the lock meanwhile
+func (im *InMemory) Update(key string, fn UpdateFunc) (*Value, error) {
+	im.Lock()
+	defer im.Unlock()
+	old := im.Db[key]
+	value, err := fn(old)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return old, nil
+	}
+	im.put(key, value)
+	return value, nil
+}
+
+// Apply puts or deletes, when the value is nil, every key holding the lock,
+// so readers never see only part of the changes
+func (im *InMemory) Apply(changes map[string]*Value) error {
+	im.Lock()
+	defer im.Unlock()
+	for key, value := range changes {
+		if value != nil {
+			im.put(key, value)
+		} else {
+			im.delete(key)
+		}
+	}
+	return nil
+}
+
 // Get retrieves the value of the given key
 func (im *InMemory) Get(key string) (*Value, error) {
+	im.Lock()
 	v, ok := im.Db[key]
+	im.Unlock()
 	if !ok {
 		return nil, NewKeyNotFoundError(key)
 	}
 	return v, nil
 }
 
+// delete removes key, the lock must be held by the caller
+func (im *InMemory) delete(key string) {
+	if old, ok := im.Db[key]; ok {
+		metrics.KVSize.Sub(float64(len(old.Data())))
+		metrics.KVKeys.Dec()
+		delete(im.Db, key)
+	}
+}
+
 // Delete will remove a key from the KV Db
 func (im *InMemory) Delete(key string) error {
 	im.Lock()
-	delete(im.Db, key)
+	im.delete(key)
 	im.Unlock()
 	return nil
 }
+
+// List returns, sorted, the keys starting with prefix
+func (im *InMemory) List(prefix string) ([]string, error) {
+	im.Lock()
+	keys := make([]string, 0, len(im.Db))
+	for k := range im.Db {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	im.Unlock()
+	sort.Strings(keys)
+	return keys, nil
+}
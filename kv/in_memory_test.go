@@ -2,8 +2,11 @@ package kv
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 
+	"github.com/fcgravalos/gonfigd/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -37,3 +40,126 @@ func TestInMemoryOperations(t *testing.T) {
 	assert.Nil(t, v4)
 	assert.EqualError(t, err7, fmt.Sprintf("[%s] Key foo not found in KV", KeyNotFound))
 }
+
+func TestInMemoryList(t *testing.T) {
+	db, _ := NewKV(INMEMORY)
+	v, _ := NewValue([]byte("bar"))
+	for _, k := range []string{"configs/b.yaml", "configs/a.yaml", "other/c.yaml"} {
+		db.Put(k, v)
+	}
+
+	keys, err := db.List("configs/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"configs/a.yaml", "configs/b.yaml"}, keys)
+
+	all, err2 := db.List("")
+	assert.Nil(t, err2)
+	assert.Equal(t, []string{"configs/a.yaml", "configs/b.yaml", "other/c.yaml"}, all)
+
+	none, err3 := db.List("missing/")
+	assert.Nil(t, err3)
+	assert.Equal(t, []string{}, none)
+}
+
+func TestInMemoryMetrics(t *testing.T) {
+	db, _ := NewKV(INMEMORY)
+	keys := testutil.ToFloat64(metrics.KVKeys)
+	size := testutil.ToFloat64(metrics.KVSize)
+
+	v1, _ := NewValue([]byte("bar"))
+	db.Put("metrics-foo", v1)
+	assert.Equal(t, keys+1, testutil.ToFloat64(metrics.KVKeys))
+	assert.Equal(t, size+float64(len(v1.Data())), testutil.ToFloat64(metrics.KVSize))
+
+	v2, _ := NewValue([]byte("a longer bar"))
+	db.Put("metrics-foo", v2)
+	assert.Equal(t, keys+1, testutil.ToFloat64(metrics.KVKeys))
+	assert.Equal(t, size+float64(len(v2.Data())), testutil.ToFloat64(metrics.KVSize))
+
+	db.Delete("metrics-foo")
+	assert.Equal(t, keys, testutil.ToFloat64(metrics.KVKeys))
+	assert.Equal(t, size, testutil.ToFloat64(metrics.KVSize))
+}
+
+func TestInMemoryPutIfMatch(t *testing.T) {
+	db, _ := NewKV(INMEMORY)
+	v1, _ := NewValue([]byte("bar"))
+	v2, _ := NewValue([]byte("baz"))
+
+	assert.Nil(t, db.PutIfMatch("foo", v1, ""))
+
+	err := db.PutIfMatch("foo", v2, "")
+	assert.EqualError(t, err, fmt.Sprintf("[%s] Key foo already exists with md5 %s", Conflict, v1.MD5()))
+
+	err2 := db.PutIfMatch("foo", v2, "0123")
+	assert.True(t, IsConflictError(err2))
+
+	assert.Nil(t, db.PutIfMatch("foo", v2, v1.MD5()))
+	v, _ := db.Get("foo")
+	assert.Equal(t, v2, v)
+
+	err3 := db.PutIfMatch("missing", v2, v1.MD5())
+	assert.EqualError(t, err3, fmt.Sprintf("[%s] Key missing not found in KV, expected md5 %s", Conflict, v1.MD5()))
+}
+
+func TestInMemoryUpdate(t *testing.T) {
+	db, _ := NewKV(INMEMORY)
+	v1, _ := NewValue([]byte("bar"))
+
+	v, err := db.Update("foo", func(old *Value) (*Value, error) {
+		assert.Nil(t, old)
+		return v1, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, v1, v)
+
+	unchanged, err2 := db.Update("foo", func(old *Value) (*Value, error) {
+		return nil, nil
+	})
+	assert.Nil(t, err2)
+	assert.Equal(t, v1, unchanged)
+
+	_, err3 := db.Update("foo", func(old *Value) (*Value, error) {
+		return nil, fmt.Errorf("aborted")
+	})
+	assert.EqualError(t, err3, "aborted")
+	current, _ := db.Get("foo")
+	assert.Equal(t, v1, current)
+
+	// Concurrent updates are serialized, none of them is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.Update("counter", func(old *Value) (*Value, error) {
+				n := 0
+				if old != nil {
+					fmt.Sscanf(old.Text(), "%d", &n)
+				}
+				return NewValue([]byte(fmt.Sprintf("%d", n+1)))
+			})
+		}()
+	}
+	wg.Wait()
+	counter, _ := db.Get("counter")
+	assert.Equal(t, "50", counter.Text())
+}
+
+func TestInMemoryApply(t *testing.T) {
+	db, _ := NewKV(INMEMORY)
+	v1, _ := NewValue([]byte("bar"))
+	v2, _ := NewValue([]byte("baz"))
+	db.Put("a", v1)
+	db.Put("b", v1)
+
+	err := db.Apply(map[string]*Value{"a": v2, "b": nil, "c": v2})
+	assert.Nil(t, err)
+
+	a, _ := db.Get("a")
+	assert.Equal(t, v2, a)
+	_, err2 := db.Get("b")
+	assert.True(t, IsKeyNotFoundError(err2))
+	c, _ := db.Get("c")
+	assert.Equal(t, v2, c)
+}
@@ -10,10 +10,22 @@ var supportedKVs map[string]Kind = map[string]Kind{
 
 type KV interface {
 	Put(k string, v *Value) error
+	// PutIfMatch puts v only if the current value of k has expectedMD5,
+	// an empty expectedMD5 means k must not exist
+	PutIfMatch(k string, v *Value, expectedMD5 string) error
+	// Update atomically replaces the value of k with the one returned by fn
+	Update(k string, fn UpdateFunc) (*Value, error)
+	// Apply atomically puts every value, or deletes its key when the value is nil
+	Apply(changes map[string]*Value) error
 	Get(k string) (*Value, error)
 	Delete(k string) error
+	List(prefix string) ([]string, error)
 }
 
+// UpdateFunc receives the current value of a key, nil if missing, and returns its new value.
+// Returning a nil value leaves the key untouched, returning an error aborts the update.
+type UpdateFunc func(old *Value) (*Value, error)
+
 type Kind string
 
 func KVFromName(name string) (Kind, error) {
@@ -11,10 +11,14 @@ import (
 	"time"
 )
 
+// MetadataCommit is the metadata key holding the git commit a value was read from
+const MetadataCommit = "commit"
+
 type Value struct {
 	lastModified time.Time
 	md5          string
 	data         string
+	metadata     map[string]string
 }
 
 func compressAndEncode(data []byte) (string, error) {
@@ -51,6 +55,43 @@ func NewValue(data []byte) (*Value, error) {
 	}, nil
 }
 
+// NewValueWithMetadata returns a new *Value carrying metadata about where data comes from, i.e: its commit
+func NewValueWithMetadata(data []byte, metadata map[string]string) (*Value, error) {
+	v, err := NewValue(data)
+	if err != nil {
+		return nil, err
+	}
+	v.metadata = make(map[string]string, len(metadata))
+	for k, val := range metadata {
+		v.metadata[k] = val
+	}
+	return v, nil
+}
+
+// RestoreValue returns a *Value as it was stored somewhere else, i.e: in a leader or a snapshot
+func RestoreValue(data []byte, metadata map[string]string, lastModified time.Time) (*Value, error) {
+	v, err := NewValueWithMetadata(data, metadata)
+	if err != nil {
+		return nil, err
+	}
+	v.lastModified = lastModified
+	return v, nil
+}
+
+// AllMetadata returns a copy of every metadata key of the value
+func (v *Value) AllMetadata() map[string]string {
+	metadata := make(map[string]string, len(v.metadata))
+	for k, val := range v.metadata {
+		metadata[k] = val
+	}
+	return metadata
+}
+
+// Metadata returns the value of the metadata key, empty if not set
+func (v *Value) Metadata(key string) string {
+	return v.metadata[key]
+}
+
 func (v *Value) LastModified() time.Time {
 	return v.lastModified
 }
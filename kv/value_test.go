@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,3 +19,22 @@ func TestGetValue(t *testing.T) {
 	_, err2 := base64.StdEncoding.DecodeString(v.Data())
 	assert.Nil(t, err2)
 }
+
+func TestValueMetadata(t *testing.T) {
+	v, err := NewValueWithMetadata([]byte("foo"), map[string]string{MetadataCommit: "0123"})
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", v.Text())
+	assert.Equal(t, "0123", v.Metadata(MetadataCommit))
+
+	v2, _ := NewValue([]byte("foo"))
+	assert.Equal(t, "", v2.Metadata(MetadataCommit))
+}
+
+func TestRestoreValue(t *testing.T) {
+	lastModified := time.Unix(0, 1590000000000000000)
+	v, err := RestoreValue([]byte("foo"), map[string]string{MetadataCommit: "0123"}, lastModified)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", v.Text())
+	assert.True(t, lastModified.Equal(v.LastModified()))
+	assert.Equal(t, map[string]string{MetadataCommit: "0123"}, v.AllMetadata())
+}
@@ -6,11 +6,15 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/fcgravalos/gonfigd/history"
 	"github.com/fcgravalos/gonfigd/kv"
 	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/replication"
+	"github.com/fcgravalos/gonfigd/settings"
 
 	"github.com/fcgravalos/gonfigd/gonfig"
 	"github.com/rs/zerolog"
@@ -19,22 +23,135 @@ import (
 // Will be initialized at build time
 var version string
 
-func main() {
+// envPrefix prefixes the environment variables setting flags, i.e: GONFIGD_SERVER_ADDR
+const envPrefix = "GONFIGD_"
+
+// options are the settings of gonfigd which are not part of gonfig.Config
+type options struct {
+	version          bool
+	configFile       string
+	kv               string
+	interpolationEnv string
+	debug            bool
+}
+
+// parseSettings parses the flags in args, and then the GONFIGD_ environment variables and
+// the settings file for the flags not set, returning the validated settings
+func parseSettings(args []string) (*gonfig.Config, *options, error) {
 	cfg := &gonfig.Config{}
+	opts := &options{}
+	fs := flag.NewFlagSet("gonfigd", flag.ExitOnError)
+
+	fs.BoolVar(&opts.version, "version", false, "Show gonfigd version")
+	fs.StringVar(&opts.configFile, "config-file", "", "YAML settings file, with the flag names as keys. Settings can also be set by GONFIGD_ environment variables, i.e: GONFIGD_SERVER_ADDR")
+	fs.StringVar(&cfg.GrpcAddr, "server-addr", ":8080", "gRPC server address.")
+	fs.StringVar(&cfg.HTTPAddr, "http-addr", "", "HTTP/JSON gateway address, i.e: :8081. Disabled when empty")
+	fs.StringVar(&cfg.OTLPAddr, "otlp-addr", "", "OTLP collector gRPC address traces are exported to, i.e: localhost:55680. Disabled when empty")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "Prometheus metrics HTTP address, i.e: :9090. Disabled when empty")
+	fs.StringVar(&cfg.RootFolder, "root-folder", "./", "Root folder of the configuration tree")
+	fs.StringVar(&opts.kv, "kv", "in-memory", "Key-Value implementation. Only 'in-memory' supported")
+	fs.DurationVar(&cfg.FsWalkInterval, "fswalk-interval", 5*time.Second, "How often the fswatcher will inspect the configuration tree for new folders. Example: 10s")
+	fs.StringVar(&cfg.SourcesFile, "sources-file", "", "YAML file with the sources of configs to run, i.e: fs, git and bundle. Replaces the --root-folder fswatcher and the --git-repo source")
+	fs.StringVar(&cfg.GitRepo, "git-repo", "", "Git repository, a local path or a file:// URL, to serve configs from instead of watching the root folder")
+	fs.StringVar(&cfg.GitRef, "git-ref", "master", "Branch, tag or commit of the git repository to serve")
+	fs.StringVar(&cfg.GitMirrorDir, "git-mirror-dir", "", "Folder the git repository is mirrored into. A temporary folder when empty")
+	fs.DurationVar(&cfg.GitSyncInterval, "git-sync-interval", 30*time.Second, "How often the git repository is fetched. Example: 1m")
+	fs.StringVar(&cfg.GitWebhookSecret, "git-webhook-secret", "", "Secret the calls to the /v1/hooks/git webhook of the HTTP gateway must be signed with (X-Hub-Signature-256). The webhook is disabled when empty")
+	fs.StringVar(&cfg.TrustedKeysFile, "trusted-keys-file", "", "File with the trusted ed25519 public keys, one 'name base64-key' per line. Configs and bundles must be signed by one of them (detached .sig files)")
+	fs.BoolVar(&cfg.EnableWrites, "enable-writes", false, "Enable the PutConfig and DeleteConfig RPCs, writing configs into the root folder")
+	fs.IntVar(&cfg.HistorySize, "history-size", history.DefaultSize, "How many versions of every config are kept, so they can be inspected and rolled back. Disabled when 0")
+	fs.BoolVar(&cfg.EnableReplication, "enable-replication", false, "Enable the Replicate RPC, so followers can replicate the configs served")
+	fs.IntVar(&cfg.ReplicationLogSize, "replication-log-size", replication.DefaultLogSize, "How many batches of changes are kept for followers to resume from after a disconnection")
+	fs.StringVar(&cfg.LeaderAddr, "leader-addr", "", "gRPC address of the leader to replicate configs from, instead of watching the root folder")
+	fs.StringVar(&cfg.LeaderCAFile, "leader-ca-file", "", "CA verifying the leader certificate. Enables TLS to the leader")
+	fs.StringVar(&cfg.LeaderCertFile, "leader-cert-file", "", "Client certificate presented to a leader running with mTLS")
+	fs.StringVar(&cfg.LeaderKeyFile, "leader-key-file", "", "Client certificate private key")
+	fs.StringVar(&cfg.LeaderTokenFile, "leader-token-file", "", "File with the bearer token sent to the leader")
+	fs.BoolVar(&cfg.Interpolation, "interpolation", false, "Resolve ${env:VAR} and ${file:path/to/config.yaml#key} references before serving configs")
+	fs.StringVar(&opts.interpolationEnv, "interpolation-env", "", "Comma separated environment variables ${env:VAR} references can resolve, names or prefixes ending in *, i.e: APP_*,HOSTNAME. None when empty")
+	fs.StringVar(&cfg.SecretsKeyFile, "secrets-key-file", "", "File containing the base64 AES-256 key used to decrypt ENC[...] values when serving configs")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert-file", "", "Server TLS certificate. Enables TLS on the gRPC server")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key-file", "", "Server TLS private key")
+	fs.StringVar(&cfg.TLSClientCAFile, "tls-client-ca-file", "", "CA bundle used to verify client certificates. Enables mTLS")
+	fs.DurationVar(&cfg.TLSReloadInterval, "tls-reload-interval", 30*time.Second, "How often TLS certificate files are checked for rotation. Example: 1m")
+	fs.StringVar(&cfg.TokenStoreFile, "token-store-file", "", "YAML file with the SHA-256 hashed bearer tokens, their names and scopes. Enables token authentication")
+	fs.BoolVar(&cfg.AllowAnonymous, "allow-anonymous", false, "Let callers with neither a bearer token nor a client certificate in when token authentication is enabled, i.e: to grant them read access with the ACL policy")
+	fs.DurationVar(&cfg.TokenReloadInterval, "token-reload-interval", 10*time.Second, "How often the token store file is checked for changes. Example: 30s")
+	fs.StringVar(&cfg.ACLPolicyFile, "acl-policy-file", "", "YAML ACL policy granting identities get/watch/list/write over config path globs. Enables authorization")
+	fs.DurationVar(&cfg.ACLReloadInterval, "acl-reload-interval", 10*time.Second, "How often the ACL policy file is checked for changes. Example: 30s")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "How long in-flight calls are waited for on shutdown before they are cancelled. Example: 30s")
+	fs.BoolVar(&opts.debug, "debug", false, "Enable debug logging")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := settings.Load(fs, "config-file", envPrefix, os.LookupEnv, "version"); err != nil {
+		return nil, nil, err
+	}
+	if opts.version {
+		return cfg, opts, nil
+	}
+
+	// Add a better way of selecting these, when we actually support more kvs and pubsubs.
+	kvkind, err := kv.KVFromName(opts.kv)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.KvKind = kvkind
+	if opts.interpolationEnv != "" {
+		cfg.InterpolationEnv = strings.Split(opts.interpolationEnv, ",")
+	}
+	cfg.PsKind = pubsub.INMEMORY
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid settings: %v", err)
+	}
+	return cfg, opts, nil
+}
+
+func setLogLevel(debug bool) {
+	if debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
 
-	var enableDebugLog bool
-	var kvImpl string
-	var versionFlag bool
+// reload parses the settings again, applying the log level and sending the other settings to gonfig.
+// Invalid settings are ignored, keeping the current ones.
+func reload(logger zerolog.Logger, reloads chan gonfig.Config) {
+	cfg, opts, err := parseSettings(os.Args[1:])
+	if err != nil {
+		logger.Error().Msgf("failed to reload settings, keeping the current ones: %v", err)
+		return
+	}
+	setLogLevel(opts.debug)
+	cfg.Logger = logger
+	select {
+	case reloads <- *cfg:
+		logger.Info().Msg("settings reloaded")
+	default:
+		logger.Warn().Msg("a reload is already in progress, ignoring this one")
+	}
+}
 
-	flag.BoolVar(&versionFlag, "version", false, "Show gonfigd version")
-	flag.StringVar(&cfg.GrpcAddr, "server-addr", ":8080", "gRPC server address.")
-	flag.StringVar(&cfg.RootFolder, "root-folder", "./", "Root folder of the configuration tree")
-	flag.StringVar(&kvImpl, "kv", "in-memory", "Key-Value implementation. Only 'in-memory' supported")
-	flag.DurationVar(&cfg.FsWalkInterval, "fswalk-interval", 5*time.Second, "How often the fswatcher will inspect the configuration tree for new folders. Example: 10s")
-	flag.BoolVar(&enableDebugLog, "debug", false, "Enable debug logging")
-	flag.Parse()
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		os.Exit(snapshotCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		os.Exit(agentCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "exec" {
+		os.Exit(execCommand(os.Args[2:]))
+	}
 
-	if versionFlag {
+	cfg, opts, err := parseSettings(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	if opts.version {
 		fmt.Printf("gonfigd version %s\n", version)
 		os.Exit(0)
 	}
@@ -46,39 +163,43 @@ func main() {
 		Caller().
 		Logger()
 
-	if enableDebugLog {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	}
+	setLogLevel(opts.debug)
 
 	cfg.Logger = logger
-
-	// Add a better way of selecting these, when we actually support more kvs and pubsubs.
-	kvkind, err := kv.KVFromName(kvImpl)
-	if err != nil {
-		logger.Fatal().Msgf("%v", err)
-	}
-	cfg.KvKind = kvkind
-	cfg.PsKind = pubsub.INMEMORY
+	reloads := make(chan gonfig.Config, 1)
+	cfg.Reloads = reloads
 	ctx, cancel := context.WithCancel(context.Background())
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	waitChan := make(chan struct{}, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	errChan := make(chan error, 1)
 
 	go func() {
-		gonfig.Start(ctx, waitChan, *cfg)
+		errChan <- gonfig.Start(ctx, *cfg)
 	}()
 
 	for {
 		select {
 		case s := <-sigChan:
+			if s == syscall.SIGHUP {
+				reload(logger, reloads)
+				break
+			}
+			if ctx.Err() != nil {
+				logger.Warn().
+					Msgf("received %s signal again, exiting without waiting", s.String())
+				os.Exit(1)
+			}
 			logger.Info().
 				Msgf("received %s signal, gracefully stopping...", s.String())
 			cancel()
 			break
-		case <-waitChan:
+		case err := <-errChan:
+			if err != nil {
+				logger.Error().
+					Msgf("gonfigd stopped: %v", err)
+				os.Exit(1)
+			}
 			logger.Info().
 				Msg("gonfigd stopped, goodbye!")
 			return
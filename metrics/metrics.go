@@ -0,0 +1,121 @@
+// Package metrics holds the Prometheus collectors of gonfigd
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gonfigd"
+
+var (
+	// Registry is where every gonfigd collector is registered
+	Registry = prometheus.NewRegistry()
+
+	// GrpcRequests counts the gRPC calls by method and status code
+	GrpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "gRPC calls handled, by method and status code.",
+	}, []string{"method", "code"})
+
+	// GrpcRequestDuration observes how long gRPC calls take by method
+	GrpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the gRPC calls, by method. Streams are observed when they end.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// Subscriptions tracks the active subscriptions per topic
+	Subscriptions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pubsub",
+		Name:      "subscriptions",
+		Help:      "Active subscriptions, by topic.",
+	}, []string{"topic"})
+
+	// PublishDuration observes how long it takes to deliver an event to every subscriber of a topic
+	PublishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "pubsub",
+		Name:      "publish_duration_seconds",
+		Help:      "Time taken to deliver an event to every subscriber of its topic.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// DroppedEvents counts the events that could not be delivered to a subscriber falling behind
+	DroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "pubsub",
+		Name:      "dropped_events_total",
+		Help:      "Events not delivered because the subscriber fell too many events behind.",
+	})
+
+	// FsEvents counts the filesystem events received by the fswatcher by operation
+	FsEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "fswatcher",
+		Name:      "events_total",
+		Help:      "Filesystem events received, by operation.",
+	}, []string{"op"})
+
+	// WalkDuration observes how long it takes to walk the configuration tree
+	WalkDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "fswatcher",
+		Name:      "walk_duration_seconds",
+		Help:      "Time taken to walk the configuration tree.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// SignatureFailures counts the configs or bundles rejected because their signature could not be verified
+	SignatureFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "signing",
+		Name:      "verification_failures_total",
+		Help:      "Configs or bundles rejected because their signature could not be verified, by source kind.",
+	}, []string{"source"})
+
+	// KVKeys tracks the number of keys stored in the KV
+	KVKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "kv",
+		Name:      "keys",
+		Help:      "Keys stored in the KV.",
+	})
+
+	// KVSize tracks the size of the (compressed) values stored in the KV
+	KVSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "kv",
+		Name:      "size_bytes",
+		Help:      "Size of the compressed and encoded values stored in the KV.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		GrpcRequests,
+		GrpcRequestDuration,
+		Subscriptions,
+		PublishDuration,
+		DroppedEvents,
+		FsEvents,
+		WalkDuration,
+		SignatureFailures,
+		KVKeys,
+		KVSize,
+	)
+}
+
+// Handler returns the http.Handler exposing the gonfigd metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
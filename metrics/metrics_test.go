@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	GrpcRequests.WithLabelValues("/Gonfig/GetConfig", "OK").Inc()
+	FsEvents.WithLabelValues("CREATE").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+
+	body, _ := ioutil.ReadAll(rec.Body)
+	assert.Contains(t, string(body), `gonfigd_grpc_requests_total{code="OK",method="/Gonfig/GetConfig"} 1`)
+	assert.Contains(t, string(body), `gonfigd_fswatcher_events_total{op="CREATE"} 1`)
+	assert.Contains(t, string(body), "gonfigd_kv_keys 0")
+	assert.Contains(t, string(body), "go_goroutines")
+}
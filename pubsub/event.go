@@ -1,6 +1,7 @@
 package pubsub
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -12,6 +13,8 @@ const (
 	ConfigUpdated
 	// ConfigDeleted EventType indicates that the config has been deleted
 	ConfigDeleted
+	// ServerShuttingDown EventType indicates that the server is shutting down, so watchers should reconnect elsewhere
+	ServerShuttingDown
 )
 
 // EventType is type of configuration change Event
@@ -26,6 +29,8 @@ func (t EventType) String() string {
 		return "CONFIG_UPDATED"
 	case t == ConfigDeleted:
 		return "CONFIG_DELETED"
+	case t == ServerShuttingDown:
+		return "SERVER_SHUTTING_DOWN"
 	}
 	return "UNKNOWN"
 }
@@ -38,13 +43,21 @@ type Event struct {
 	configPath string
 	// Creation timestamp
 	createdAt time.Time
+	// The context the Event was created in, carrying its trace
+	ctx context.Context
 }
 
 // NewEvent returns a pointer to Event type
 // kind EventType, the kind of Event
 // configPath string, the config path
 func NewEvent(kind EventType, configPath string) *Event {
-	return &Event{kind: kind, configPath: configPath, createdAt: time.Now()}
+	return NewEventWithContext(context.Background(), kind, configPath)
+}
+
+// NewEventWithContext returns a pointer to Event type carrying ctx,
+// so subscribers can continue the trace that originated the Event
+func NewEventWithContext(ctx context.Context, kind EventType, configPath string) *Event {
+	return &Event{kind: kind, configPath: configPath, createdAt: time.Now(), ctx: ctx}
 }
 
 // Kind returns the EventType
@@ -57,6 +70,11 @@ func (ev *Event) ConfigPath() string {
 	return ev.configPath
 }
 
+// Context returns the context the Event was created in
+func (ev *Event) Context() context.Context {
+	return ev.ctx
+}
+
 // CreatedAt returns the timestamp when the Event was created
 func (ev *Event) CreatedAt() time.Time {
 	return ev.createdAt
@@ -8,7 +8,7 @@ import (
 )
 
 func TestEvent(t *testing.T) {
-	for _, e := range []EventType{ConfigCreated, ConfigUpdated, ConfigDeleted} {
+	for _, e := range []EventType{ConfigCreated, ConfigUpdated, ConfigDeleted, ServerShuttingDown} {
 		ev := NewEvent(e, "foo/config.yaml")
 		assert.NotNil(t, ev)
 		assert.Equal(t, fmt.Sprintf("[%s] - %s: %s", ev.CreatedAt(), ev.Kind(), ev.ConfigPath()), ev.String())
@@ -3,9 +3,14 @@ package pubsub
 
 import (
 	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/metrics"
+	"github.com/fcgravalos/gonfigd/tracing"
+	"go.opentelemetry.io/otel/api/trace"
 )
 
-type subscriptions map[string]chan *Event
+type subscriptions map[string]*Subscription
 
 // InMemory is the data structure implementing the PubSub interface
 type InMemory struct {
@@ -14,9 +19,12 @@ type InMemory struct {
 }
 
 // CreateTopic creates a new topic from string
+// Creating an existing topic keeps its subscriptions
 func (im *InMemory) CreateTopic(topic string) error {
 	im.Lock()
-	im.pubsub[topic] = make(subscriptions, 0)
+	if _, ok := im.pubsub[topic]; !ok {
+		im.pubsub[topic] = make(subscriptions, 0)
+	}
 	im.Unlock()
 	return nil
 }
@@ -27,6 +35,7 @@ func (im *InMemory) DeleteTopic(topic string) error {
 	_, ok := im.pubsub[topic]
 	if ok {
 		delete(im.pubsub, topic)
+		metrics.Subscriptions.DeleteLabelValues(topic)
 	}
 	im.Unlock()
 	return nil
@@ -34,15 +43,32 @@ func (im *InMemory) DeleteTopic(topic string) error {
 
 // TopicExists checks whether or not a topic exists
 func (im *InMemory) TopicExists(topic string) bool {
+	im.Lock()
+	defer im.Unlock()
 	_, ok := im.pubsub[topic]
 	return ok
 }
 
-// Publish injects a new *Event into a topic
+// Publish injects a new *Event into a topic without waiting for the subscribers to receive it
+// Subscribers falling subscriptionBuffer events behind miss it, counted by metrics.DroppedEvents
 func (im *InMemory) Publish(topic string, ev *Event) error {
-	for _, sCh := range im.pubsub[topic] {
-		sCh <- ev
+	_, span := tracing.Tracer().Start(ev.Context(), "pubsub.Publish", trace.WithAttributes(tracing.ConfigPath(topic)))
+	defer span.End()
+	start := time.Now()
+	im.Lock()
+	subs := make([]*Subscription, 0, len(im.pubsub[topic]))
+	for _, s := range im.pubsub[topic] {
+		subs = append(subs, s)
 	}
+	im.Unlock()
+
+	for _, s := range subs {
+		if !s.send(ev) {
+			metrics.DroppedEvents.Inc()
+			span.AddEvent(ev.Context(), "event dropped")
+		}
+	}
+	metrics.PublishDuration.Observe(time.Since(start).Seconds())
 	return nil
 }
 
@@ -50,24 +76,36 @@ func (im *InMemory) Publish(topic string, ev *Event) error {
 // returns the newly created Subscription object,
 // or NoSuchTopicError if the topic is not created yet
 func (im *InMemory) Subscribe(topic string) (*Subscription, error) {
-	if !im.TopicExists(topic) {
-		return nil, NewNoSuchTopicError(topic)
-	}
 	s := NewSubscription()
 	im.Lock()
-	im.pubsub[topic][s.ID()] = s.Channel()
+	subs, ok := im.pubsub[topic]
+	if !ok {
+		im.Unlock()
+		return nil, NewNoSuchTopicError(topic)
+	}
+	subs[s.ID()] = s
 	im.Unlock()
+	metrics.Subscriptions.WithLabelValues(topic).Inc()
 	return s, nil
 }
 
-// UnSubscribe removes a subscription from a topic
+// UnSubscribe removes a subscription from a topic and closes its channel
+// It is safe to call while the topic is being published to
 func (im *InMemory) UnSubscribe(topic string, sID string) error {
-	if !im.TopicExists(topic) {
+	im.Lock()
+	subs, ok := im.pubsub[topic]
+	if !ok {
+		im.Unlock()
 		return NewNoSuchTopicError(topic)
 	}
-	im.Lock()
-	close(im.pubsub[topic][sID])
-	delete(im.pubsub[topic], sID)
+	s, ok := subs[sID]
+	if ok {
+		delete(subs, sID)
+		metrics.Subscriptions.WithLabelValues(topic).Dec()
+	}
 	im.Unlock()
+	if ok {
+		s.close()
+	}
 	return nil
 }
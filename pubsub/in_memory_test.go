@@ -2,8 +2,12 @@ package pubsub
 
 import (
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/fcgravalos/gonfigd/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -45,3 +49,77 @@ func TestInMemoryOperations(t *testing.T) {
 	err8 := ps.UnSubscribe("foo", s2.ID())
 	assert.EqualError(t, err8, fmt.Sprintf("[%s] Topic foo does not exist", NoSuchTopic))
 }
+
+func TestUnSubscribeWhilePublishing(t *testing.T) {
+	ps, _ := NewPubSub(INMEMORY)
+	ps.CreateTopic("foo")
+	for i := 0; i < 50; i++ {
+		s, err := ps.Subscribe("foo")
+		assert.Nil(t, err)
+		done := make(chan struct{})
+		go func() {
+			ps.Publish("foo", NewEvent(ConfigUpdated, "foo"))
+			close(done)
+		}()
+		assert.Nil(t, ps.UnSubscribe("foo", s.ID()))
+		<-done
+		// The channel is closed, after the event if it was published before
+		for range s.Channel() {
+		}
+	}
+
+	// Creating an existing topic keeps its subscriptions
+	s, _ := ps.Subscribe("foo")
+	assert.Nil(t, ps.CreateTopic("foo"))
+	go ps.Publish("foo", NewEvent(ConfigUpdated, "foo"))
+	ev := <-s.Channel()
+	assert.Equal(t, ConfigUpdated, ev.Kind())
+}
+
+func TestPublishToSlowSubscribers(t *testing.T) {
+	ps, _ := NewPubSub(INMEMORY)
+	ps.CreateTopic("foo")
+	var subs []*Subscription
+	for i := 0; i < 10; i++ {
+		s, _ := ps.Subscribe("foo")
+		subs = append(subs, s)
+	}
+
+	// Nobody reads, Publish does not wait for them and drops the events past their buffer
+	dropped := testutil.ToFloat64(metrics.DroppedEvents)
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriptionBuffer+1; i++ {
+			ps.Publish("foo", NewEvent(ConfigUpdated, "foo"))
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish waited for slow subscribers")
+	}
+	assert.Equal(t, dropped+float64(len(subs)), testutil.ToFloat64(metrics.DroppedEvents))
+
+	// Unsubscribing while publishing neither blocks nor panics
+	var wg sync.WaitGroup
+	for _, s := range subs {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ps.Publish("foo", NewEvent(ConfigUpdated, "foo"))
+		}()
+		go func(s *Subscription) {
+			defer wg.Done()
+			assert.Nil(t, ps.UnSubscribe("foo", s.ID()))
+		}(s)
+	}
+	wg.Wait()
+	for _, s := range subs {
+		n := 0
+		for range s.Channel() {
+			n++
+		}
+		assert.Equal(t, subscriptionBuffer, n)
+	}
+}
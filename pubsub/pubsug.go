@@ -2,6 +2,8 @@
 package pubsub
 
 import (
+	"sync"
+
 	"github.com/google/uuid"
 )
 
@@ -15,10 +17,16 @@ var supportedPubSubs map[string]Kind = map[string]Kind{
 // Kind is the KV kind
 type Kind string
 
+// subscriptionBuffer is how many events a subscriber can fall behind before new ones are dropped
+const subscriptionBuffer = 64
+
 // Subscription type
 type Subscription struct {
 	id string
 	ch chan *Event
+	// mu guards ch, so it is never sent to after being closed on UnSubscribe
+	mu     sync.Mutex
+	closed bool
 }
 
 // ID returns the subscription id
@@ -35,7 +43,33 @@ func (s *Subscription) Channel() chan *Event {
 func NewSubscription() *Subscription {
 	return &Subscription{
 		id: uuid.New().String(),
-		ch: make(chan *Event),
+		ch: make(chan *Event, subscriptionBuffer),
+	}
+}
+
+// send delivers ev to the subscriber without blocking.
+// It returns false when the event was dropped because the subscriber fell subscriptionBuffer events behind
+func (s *Subscription) send(ev *Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return true
+	}
+	select {
+	case s.ch <- ev:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the subscription channel, events already sent can still be received
+func (s *Subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
 	}
 }
 
@@ -0,0 +1,258 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/fcgravalos/gonfigd/tracing"
+	"github.com/rs/zerolog"
+	grpc "google.golang.org/grpc"
+)
+
+const (
+	// Kind is the kind of source of followers, replicating the configs of a leader
+	Kind        = "replica"
+	minBackoff  = time.Second
+	maxBackoff  = 30 * time.Second
+	dialTimeout = 10 * time.Second
+	// MaxMessageSize bounds the replication messages, snapshots send the whole store in one of them
+	MaxMessageSize = 64 << 20
+)
+
+func init() {
+	source.Register(Kind, func(spec source.Spec, env source.Env) (source.Source, error) {
+		leader := spec.Option("leader", "")
+		if leader == "" {
+			return nil, source.NewInvalidSpecError(fmt.Sprintf("source %s must have a leader option", spec.Name))
+		}
+		opts, err := client.DialOptions(spec.Option("caFile", ""), spec.Option("certFile", ""), spec.Option("keyFile", ""), spec.Option("tokenFile", ""))
+		if err != nil {
+			return nil, source.NewInvalidSpecError(fmt.Sprintf("source %s: %v", spec.Name, err))
+		}
+		f := NewFollower(leader, env.KV, env.PS, env.Logger, opts...)
+		f.name = spec.Name
+		f.deps = env.Deps
+		return f, nil
+	})
+}
+
+// Follower keeps the KV in sync with the one of a leader.
+// Configs keep the keys they have on the leader, so both must share the same root folder.
+type Follower struct {
+	sync.Mutex
+	name     string
+	leader   string
+	opts     []grpc.DialOption
+	conn     *grpc.ClientConn
+	leaderID string
+	revision int64
+	deps     source.DependencyTracker
+	kv       kv.KV
+	ps       pubsub.PubSub
+	log      zerolog.Logger
+}
+
+// NewFollower returns a new *Follower
+// leader string, the gRPC address of the leader
+func NewFollower(leader string, kv kv.KV, ps pubsub.PubSub, logger zerolog.Logger, opts ...grpc.DialOption) *Follower {
+	return &Follower{
+		name:   Kind,
+		leader: leader,
+		opts:   opts,
+		kv:     kv,
+		ps:     ps,
+		log:    logger,
+	}
+}
+
+// Name implements source.Source
+func (f *Follower) Name() string {
+	return f.name
+}
+
+// Revision returns the leader and the revision the KV is at
+func (f *Follower) Revision() (string, int64) {
+	f.Lock()
+	defer f.Unlock()
+	return f.leaderID, f.revision
+}
+
+// stream starts replicating from the last revision applied
+func (f *Follower) stream(ctx context.Context) (api.Gonfig_ReplicateClient, error) {
+	if f.conn == nil {
+		opts := append([]grpc.DialOption{grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(MaxMessageSize))}, f.opts...)
+		conn, err := grpc.Dial(f.leader, opts...)
+		if err != nil {
+			return nil, err
+		}
+		f.conn = conn
+	}
+	leaderID, revision := f.Revision()
+	return api.NewGonfigClient(f.conn).Replicate(ctx, &api.ReplicateRequest{LeaderID: leaderID, FromRevision: revision})
+}
+
+func (f *Follower) publishEvent(ctx context.Context, config string, evType pubsub.EventType) error {
+	ev := pubsub.NewEventWithContext(ctx, evType, config)
+	if !f.ps.TopicExists(config) {
+		if err := f.ps.CreateTopic(config); err != nil {
+			return err
+		}
+	}
+	return f.ps.Publish(config, ev)
+}
+
+// apply applies the changes of resp at once, publishing an event for every config changed
+func (f *Follower) apply(ctx context.Context, resp *api.ReplicateResponse) error {
+	ctx, span := tracing.Tracer().Start(ctx, "replication.apply")
+	defer span.End()
+	f.Lock()
+	defer f.Unlock()
+
+	changes := make(map[string]*kv.Value)
+	events := make(map[string]pubsub.EventType)
+	for _, c := range resp.Changes {
+		old, err := f.kv.Get(c.ConfigPath)
+		exists := err == nil
+		if c.Deleted {
+			if exists {
+				changes[c.ConfigPath] = nil
+				events[c.ConfigPath] = pubsub.ConfigDeleted
+			}
+			continue
+		}
+		v, err := kv.RestoreValue(c.Config, c.Metadata, time.Unix(0, c.LastModified))
+		if err != nil {
+			return err
+		}
+		if exists && old.MD5() == v.MD5() {
+			continue
+		}
+		changes[c.ConfigPath] = v
+		events[c.ConfigPath] = pubsub.ConfigCreated
+		if exists {
+			events[c.ConfigPath] = pubsub.ConfigUpdated
+		}
+	}
+	if resp.Snapshot {
+		keep := make(map[string]bool, len(resp.Changes))
+		for _, c := range resp.Changes {
+			keep[c.ConfigPath] = true
+		}
+		keys, err := f.kv.List("")
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if !keep[k] {
+				changes[k] = nil
+				events[k] = pubsub.ConfigDeleted
+			}
+		}
+	}
+
+	if err := f.kv.Apply(changes); err != nil {
+		return err
+	}
+	f.leaderID, f.revision = resp.LeaderID, resp.Revision
+	if f.deps != nil {
+		for k, v := range changes {
+			if v == nil {
+				f.deps.Untrack(k)
+			} else {
+				f.deps.Track(k, v.Text())
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(events))
+	for k := range events {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := f.publishEvent(ctx, k, events[k]); err != nil {
+			f.log.Error().Msgf("failed to publish %s event for %s: %v", events[k].String(), k, err)
+		}
+		if err := source.PublishDependents(ctx, f.ps, f.deps, k); err != nil {
+			f.log.Error().Msgf("failed to publish the events of the configs referencing %s: %v", k, err)
+		}
+	}
+	if resp.Snapshot {
+		f.log.Info().Msgf("snapshot of leader %s at revision %d applied, %d configs changed", resp.LeaderID, resp.Revision, len(events))
+	} else {
+		f.log.Debug().Msgf("revision %d of leader %s applied, %d configs changed", resp.Revision, resp.LeaderID, len(events))
+	}
+	return nil
+}
+
+// Snapshot implements source.Source, applying the configs of the leader
+func (f *Follower) Snapshot(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	stream, err := f.stream(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	return f.apply(ctx, resp)
+}
+
+// follow applies the changes of the leader until the stream breaks
+func (f *Follower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := f.stream(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err := f.apply(ctx, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Start implements source.Source, following the leader and resuming from the last revision applied
+// whenever the connection breaks. Configs keep being served meanwhile.
+func (f *Follower) Start(ctx context.Context) error {
+	defer func() {
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}()
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		f.log.Error().Msgf("replication from leader %s interrupted, retrying in %s: %v", f.leader, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package replication streams the KV of a leader gonfigd to its followers
+//
+// The leader records every change of its KV in a Log, numbered by revision.
+// Followers get a snapshot of every config first, then the changes as they happen,
+// and resume from their last revision when reconnecting, as long as the leader
+// still holds the changes after it. Otherwise, they get a snapshot again.
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/kv"
+)
+
+// DefaultLogSize is how many batches of changes the leader keeps for followers to resume
+const DefaultLogSize = 1000
+
+type entry struct {
+	revision int64
+	changes  []*api.Change
+}
+
+// Log is a kv.KV recording every change, so followers can replicate them
+type Log struct {
+	kv.KV
+	mu       sync.Mutex
+	id       string
+	revision int64
+	// compacted is the revision of the last entry dropped from entries
+	compacted int64
+	entries   []entry
+	size      int
+	// notify is closed, and replaced, whenever an entry is recorded
+	notify chan struct{}
+}
+
+// NewLog returns a new *Log recording the changes of store
+// size int, how many batches of changes are kept for followers to resume
+func NewLog(store kv.KV, size int) *Log {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Log{
+		KV:     store,
+		id:     hex.EncodeToString(id),
+		size:   size,
+		notify: make(chan struct{}),
+	}
+}
+
+// ID identifies the log, so followers resuming know revisions belong to it
+func (l *Log) ID() string {
+	return l.id
+}
+
+// Revision returns the revision of the last change
+func (l *Log) Revision() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.revision
+}
+
+func putChange(key string, v *kv.Value) *api.Change {
+	return &api.Change{
+		ConfigPath:   key,
+		Config:       []byte(v.Text()),
+		LastModified: v.LastModified().UnixNano(),
+		Metadata:     v.AllMetadata(),
+	}
+}
+
+func deleteChange(key string) *api.Change {
+	return &api.Change{ConfigPath: key, Deleted: true}
+}
+
+// record appends a batch of changes, the lock must be held by the caller
+func (l *Log) record(changes ...*api.Change) {
+	l.revision++
+	l.entries = append(l.entries, entry{revision: l.revision, changes: changes})
+	if len(l.entries) > l.size {
+		l.compacted = l.entries[0].revision
+		l.entries = l.entries[1:]
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Put implements kv.KV
+func (l *Log) Put(key string, value *kv.Value) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.KV.Put(key, value); err != nil {
+		return err
+	}
+	l.record(putChange(key, value))
+	return nil
+}
+
+// PutIfMatch implements kv.KV
+func (l *Log) PutIfMatch(key string, value *kv.Value, expectedMD5 string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.KV.PutIfMatch(key, value, expectedMD5); err != nil {
+		return err
+	}
+	l.record(putChange(key, value))
+	return nil
+}
+
+// Update implements kv.KV
+func (l *Log) Update(key string, fn kv.UpdateFunc) (*kv.Value, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed := false
+	v, err := l.KV.Update(key, func(old *kv.Value) (*kv.Value, error) {
+		v, err := fn(old)
+		changed = err == nil && v != nil
+		return v, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		l.record(putChange(key, v))
+	}
+	return v, nil
+}
+
+// Delete implements kv.KV
+func (l *Log) Delete(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.KV.Get(key); err != nil {
+		return l.KV.Delete(key)
+	}
+	if err := l.KV.Delete(key); err != nil {
+		return err
+	}
+	l.record(deleteChange(key))
+	return nil
+}
+
+// Apply implements kv.KV, recording every change as a single batch
+func (l *Log) Apply(changes map[string]*kv.Value) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.KV.Apply(changes); err != nil {
+		return err
+	}
+	batch := make([]*api.Change, 0, len(changes))
+	for key, v := range changes {
+		if v != nil {
+			batch = append(batch, putChange(key, v))
+		} else {
+			batch = append(batch, deleteChange(key))
+		}
+	}
+	if len(batch) > 0 {
+		l.record(batch...)
+	}
+	return nil
+}
+
+// snapshot returns every config, the lock must be held by the caller
+func (l *Log) snapshot() (*api.ReplicateResponse, error) {
+	keys, err := l.KV.List("")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.ReplicateResponse{LeaderID: l.id, Revision: l.revision, Snapshot: true}
+	for _, key := range keys {
+		v, err := l.KV.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		resp.Changes = append(resp.Changes, putChange(key, v))
+	}
+	return resp, nil
+}
+
+// since returns the responses a follower at revision is missing, or a snapshot if they are not available
+func (l *Log) since(leaderID string, revision int64) ([]*api.ReplicateResponse, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if leaderID != l.id || revision < l.compacted || revision > l.revision {
+		snapshot, err := l.snapshot()
+		if err != nil {
+			return nil, nil, err
+		}
+		return []*api.ReplicateResponse{snapshot}, l.notify, nil
+	}
+	var resps []*api.ReplicateResponse
+	for _, e := range l.entries {
+		if e.revision > revision {
+			resps = append(resps, &api.ReplicateResponse{LeaderID: l.id, Revision: e.revision, Changes: e.changes})
+		}
+	}
+	return resps, l.notify, nil
+}
+
+// Replicate implements api.Replicator, streaming the changes after the request revision until the follower leaves
+func (l *Log) Replicate(req *api.ReplicateRequest, stream api.Gonfig_ReplicateServer) error {
+	leaderID, revision := req.LeaderID, req.FromRevision
+	for {
+		resps, notify, err := l.since(leaderID, revision)
+		if err != nil {
+			return err
+		}
+		for _, resp := range resps {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			leaderID, revision = resp.LeaderID, resp.Revision
+		}
+		select {
+		case <-notify:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
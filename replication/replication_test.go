@@ -0,0 +1,249 @@
+package replication
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/fcgravalos/gonfigd/interpolate"
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/source"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func value(t *testing.T, data string) *kv.Value {
+	v, err := kv.NewValue([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestLog(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	l := NewLog(db, 2)
+
+	assert.Nil(t, l.Put("/configs/db.yaml", value(t, "foo: bar")))
+	assert.Equal(t, int64(1), l.Revision())
+
+	// Failed and no-op writes are not recorded
+	assert.NotNil(t, l.PutIfMatch("/configs/db.yaml", value(t, "foo: baz"), "bad-md5"))
+	l.Update("/configs/db.yaml", func(old *kv.Value) (*kv.Value, error) { return nil, nil })
+	assert.Nil(t, l.Delete("/configs/missing.yaml"))
+	assert.Equal(t, int64(1), l.Revision())
+
+	assert.Nil(t, l.Apply(map[string]*kv.Value{"/configs/db.yaml": nil, "/configs/cache.yaml": value(t, "ttl: 1")}))
+	assert.Equal(t, int64(2), l.Revision())
+
+	resps, _, err := l.since(l.ID(), 1)
+	assert.Nil(t, err)
+	assert.Len(t, resps, 1)
+	assert.False(t, resps[0].Snapshot)
+	assert.Equal(t, int64(2), resps[0].Revision)
+	assert.Len(t, resps[0].Changes, 2)
+
+	// Another leader
+	resps2, _, _ := l.since("other", 1)
+	assert.Len(t, resps2, 1)
+	assert.True(t, resps2[0].Snapshot)
+	assert.Len(t, resps2[0].Changes, 1)
+	assert.Equal(t, "/configs/cache.yaml", resps2[0].Changes[0].ConfigPath)
+	assert.Equal(t, "ttl: 1", string(resps2[0].Changes[0].Config))
+
+	// Changes compacted
+	l.Put("/configs/db.yaml", value(t, "foo: qux"))
+	resps3, _, _ := l.since(l.ID(), 0)
+	assert.True(t, resps3[0].Snapshot)
+	assert.Equal(t, int64(3), resps3[0].Revision)
+	resps4, _, _ := l.since(l.ID(), 1)
+	assert.Len(t, resps4, 2)
+	assert.False(t, resps4[0].Snapshot)
+}
+
+func serve(t *testing.T, addr string, l *Log) (*grpc.Server, string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	s := grpc.NewServer()
+	api.RegisterGonfigServer(s, api.NewServer(l, ps, nil, l, zerolog.Nop()))
+	go s.Serve(lis)
+	return s, lis.Addr().String()
+}
+
+func TestReplicateShutdown(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	l := NewLog(db, DefaultLogSize)
+	l.Put("/configs/db.yaml", value(t, "foo: bar"))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	srv := api.NewServer(l, ps, nil, l, zerolog.Nop())
+	s := grpc.NewServer()
+	api.RegisterGonfigServer(s, srv)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := api.NewGonfigClient(conn).Replicate(ctx, &api.ReplicateRequest{})
+	assert.Nil(t, err)
+	resp, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.True(t, resp.Snapshot)
+
+	// Followers are told to reconnect, and do not hold the graceful stop
+	srv.Shutdown()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not stop")
+	}
+}
+
+func TestFollower(t *testing.T) {
+	leaderDB, _ := kv.NewKV(kv.INMEMORY)
+	l := NewLog(leaderDB, DefaultLogSize)
+	l.Put("/configs/db.yaml", value(t, "foo: bar"))
+	server, addr := serve(t, "127.0.0.1:0", l)
+
+	db, _ := kv.NewKV(kv.INMEMORY)
+	db.Put("/configs/stale.yaml", value(t, "stale: true"))
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	opts, _ := client.DialOptions("", "", "", "")
+	f := NewFollower(addr, db, ps, zerolog.Nop(), opts...)
+
+	assert.Nil(t, f.Snapshot(context.Background()))
+	keys, _ := db.List("")
+	assert.Equal(t, []string{"/configs/db.yaml"}, keys)
+	leaderID, revision := f.Revision()
+	assert.Equal(t, l.ID(), leaderID)
+	assert.Equal(t, int64(1), revision)
+
+	events := make(chan *pubsub.Event)
+	ps.CreateTopic("/configs/db.yaml")
+	sub, _ := ps.Subscribe("/configs/db.yaml")
+	go func() {
+		for ev := range sub.Channel() {
+			events <- ev
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- f.Start(ctx)
+	}()
+
+	l.Put("/configs/db.yaml", value(t, "foo: baz"))
+	select {
+	case ev := <-events:
+		assert.Equal(t, pubsub.ConfigUpdated, ev.Kind())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	v, _ := db.Get("/configs/db.yaml")
+	assert.Equal(t, "foo: baz", v.Text())
+
+	// The follower resumes after the leader comes back
+	server.Stop()
+	l.Delete("/configs/db.yaml")
+	server2, _ := serve(t, addr, l)
+	defer server2.Stop()
+	select {
+	case ev := <-events:
+		assert.Equal(t, pubsub.ConfigDeleted, ev.Kind())
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event received")
+	}
+	_, revision2 := f.Revision()
+	assert.Equal(t, int64(3), revision2)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestFollowerLargeSnapshot(t *testing.T) {
+	leaderDB, _ := kv.NewKV(kv.INMEMORY)
+	l := NewLog(leaderDB, DefaultLogSize)
+	// Bigger than the 4MB gRPC messages are limited to by default
+	large := make([]byte, 5<<20)
+	for i := range large {
+		large[i] = 'a'
+	}
+	l.Put("/configs/large.yaml", value(t, "data: "+string(large)))
+	server, addr := serve(t, "127.0.0.1:0", l)
+	defer server.Stop()
+
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	opts, _ := client.DialOptions("", "", "", "")
+	f := NewFollower(addr, db, ps, zerolog.Nop(), opts...)
+	assert.Nil(t, f.Snapshot(context.Background()))
+	v, err := db.Get("/configs/large.yaml")
+	assert.Nil(t, err)
+	assert.Len(t, v.Text(), len(large)+len("data: "))
+}
+
+func TestFollowerDependents(t *testing.T) {
+	leaderDB, _ := kv.NewKV(kv.INMEMORY)
+	l := NewLog(leaderDB, DefaultLogSize)
+	l.Put("/configs/db.yaml", value(t, "host: db1"))
+	l.Put("/configs/app.yaml", value(t, "db: ${file:db.yaml#host}"))
+	server, addr := serve(t, "127.0.0.1:0", l)
+	defer server.Stop()
+
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	interpolator := interpolate.NewInterpolator("/configs", db)
+	f, err := source.New(source.Spec{
+		Name:    "leader",
+		Kind:    Kind,
+		Options: map[string]string{"leader": addr},
+	}, source.Env{KV: db, PS: ps, Deps: interpolator, Logger: zerolog.Nop()})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Snapshot(context.Background()))
+
+	// Configs referencing a replicated one get an event, so they are rendered again
+	ps.CreateTopic("/configs/app.yaml")
+	sub, _ := ps.Subscribe("/configs/app.yaml")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- f.Start(ctx)
+	}()
+	l.Put("/configs/db.yaml", value(t, "host: db2"))
+	select {
+	case ev := <-sub.Channel():
+		assert.Equal(t, pubsub.ConfigUpdated, ev.Kind())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	rendered, err := interpolator.Render("/configs/app.yaml", "db: ${file:db.yaml#host}")
+	assert.Nil(t, err)
+	assert.Equal(t, "db: db2", rendered)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,57 @@
+package secrets
+
+import "fmt"
+
+const (
+	InvalidKey ErrType = "INVALID_KEY_ERROR"
+	Decryption ErrType = "DECRYPTION_ERROR"
+	Unknown    ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidKeyError struct {
+	errType ErrType
+	reason  string
+}
+
+type DecryptionError struct {
+	errType ErrType
+	value   string
+	err     error
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidKeyError:
+		return InvalidKey
+	case DecryptionError:
+		return Decryption
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidKeyError(e error) bool {
+	return getErrorType(e) == InvalidKey
+}
+
+func IsDecryptionError(e error) bool {
+	return getErrorType(e) == Decryption
+}
+
+func (e InvalidKeyError) Error() string {
+	return fmt.Sprintf("[%s] Invalid encryption key: %s", e.errType, e.reason)
+}
+
+func (e DecryptionError) Error() string {
+	return fmt.Sprintf("[%s] Could not decrypt value %s: %v", e.errType, e.value, e.err)
+}
+
+func NewInvalidKeyError(reason string) InvalidKeyError {
+	return InvalidKeyError{errType: InvalidKey, reason: reason}
+}
+
+func NewDecryptionError(value string, err error) DecryptionError {
+	return DecryptionError{errType: Decryption, value: value, err: err}
+}
@@ -0,0 +1,115 @@
+// Package secrets decrypts sops-style encrypted values embedded in configs
+//
+// Encrypted values look like ENC[AES256_GCM,data:<b64>,iv:<b64>,tag:<b64>,type:str]
+// and are only decrypted in memory, right before a config is served
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	keySize   = 32
+	nonceSize = 12
+	tagSize   = 16
+)
+
+// encRegexp matches every encrypted value within a config
+var encRegexp = regexp.MustCompile(`ENC\[AES256_GCM,data:([A-Za-z0-9+/=]*),iv:([A-Za-z0-9+/=]+),tag:([A-Za-z0-9+/=]+),type:str\]`)
+
+// Decrypter decrypts the encrypted values of configs with a local AES-256 key
+type Decrypter struct {
+	aead cipher.AEAD
+}
+
+// NewDecrypter returns a new *Decrypter
+// key []byte, the 32 bytes AES-256 key
+func NewDecrypter(key []byte) (*Decrypter, error) {
+	if len(key) != keySize {
+		return nil, NewInvalidKeyError(fmt.Sprintf("key must be %d bytes long, got %d", keySize, len(key)))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, NewInvalidKeyError(err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, NewInvalidKeyError(err.Error())
+	}
+	return &Decrypter{aead: aead}, nil
+}
+
+// NewDecrypterFromFile returns a new *Decrypter reading the base64 encoded key from keyFile
+func NewDecrypterFromFile(keyFile string) (*Decrypter, error) {
+	raw, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, NewInvalidKeyError(err.Error())
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, NewInvalidKeyError(err.Error())
+	}
+	return NewDecrypter(key)
+}
+
+// Encrypt returns the ENC[...] representation of plaintext
+func (d *Decrypter) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := d.aead.Seal(nil, nonce, []byte(plaintext), nil)
+	data, tag := sealed[:len(sealed)-tagSize], sealed[len(sealed)-tagSize:]
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]",
+		base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(tag)), nil
+}
+
+func (d *Decrypter) decrypt(value string) (string, error) {
+	m := encRegexp.FindStringSubmatch(value)
+	decoded := make([][]byte, 3)
+	for i, s := range m[1:] {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", NewDecryptionError(value, err)
+		}
+		decoded[i] = b
+	}
+	data, nonce, tag := decoded[0], decoded[1], decoded[2]
+	if len(nonce) != nonceSize || len(tag) != tagSize {
+		return "", NewDecryptionError(value, fmt.Errorf("invalid iv or tag length"))
+	}
+	plaintext, err := d.aead.Open(nil, nonce, append(data, tag...), nil)
+	if err != nil {
+		return "", NewDecryptionError(value, err)
+	}
+	return string(plaintext), nil
+}
+
+// Render returns content with every encrypted value replaced by its plaintext
+func (d *Decrypter) Render(path string, content string) (string, error) {
+	var dErr error
+	rendered := encRegexp.ReplaceAllStringFunc(content, func(value string) string {
+		if dErr != nil {
+			return value
+		}
+		plaintext, err := d.decrypt(value)
+		if err != nil {
+			dErr = err
+			return value
+		}
+		return plaintext
+	})
+	if dErr != nil {
+		return "", dErr
+	}
+	return rendered, nil
+}
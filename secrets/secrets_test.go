@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDecrypter(t *testing.T) {
+	d, err := NewDecrypter([]byte("short"))
+	assert.Nil(t, d)
+	assert.EqualError(t, err, fmt.Sprintf("[%s] Invalid encryption key: key must be 32 bytes long, got 5", InvalidKey))
+
+	dir, _ := ioutil.TempDir("", "secrets-tests")
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))+"\n"), 0600)
+
+	d2, err2 := NewDecrypterFromFile(keyFile)
+	assert.Nil(t, err2)
+	assert.NotNil(t, d2)
+
+	_, err3 := NewDecrypterFromFile(filepath.Join(dir, "missing"))
+	assert.True(t, IsInvalidKeyError(err3))
+}
+
+func TestRender(t *testing.T) {
+	d, _ := NewDecrypter(bytes.Repeat([]byte("k"), 32))
+
+	enc, err := d.Encrypt("s3cr3t")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(enc, "ENC[AES256_GCM,data:"))
+	assert.NotContains(t, enc, "s3cr3t")
+
+	out, err2 := d.Render("app.yaml", fmt.Sprintf("user: admin\npassword: %s", enc))
+	assert.Nil(t, err2)
+	assert.Equal(t, "user: admin\npassword: s3cr3t", out)
+
+	out2, err3 := d.Render("app.yaml", "user: admin")
+	assert.Nil(t, err3)
+	assert.Equal(t, "user: admin", out2)
+
+	other, _ := NewDecrypter(bytes.Repeat([]byte("o"), 32))
+	_, err4 := other.Render("app.yaml", enc)
+	assert.True(t, IsDecryptionError(err4))
+}
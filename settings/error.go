@@ -0,0 +1,37 @@
+package settings
+
+import "fmt"
+
+const (
+	InvalidSettings ErrType = "INVALID_SETTINGS_ERROR"
+	Unknown         ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidSettingsError struct {
+	errType ErrType
+	source  string
+	reason  string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidSettingsError:
+		return InvalidSettings
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidSettingsError(e error) bool {
+	return getErrorType(e) == InvalidSettings
+}
+
+func (e InvalidSettingsError) Error() string {
+	return fmt.Sprintf("[%s] Invalid settings in %s: %s", e.errType, e.source, e.reason)
+}
+
+func NewInvalidSettingsError(source string, reason string) InvalidSettingsError {
+	return InvalidSettingsError{errType: InvalidSettings, source: source, reason: reason}
+}
@@ -0,0 +1,140 @@
+// Package settings sets the flags of a command from a YAML settings file and environment variables
+//
+// The settings file has the flag names as keys. Nested keys are joined with a dash,
+// so settings can be grouped, i.e:
+//
+//	server-addr: :8080
+//	root-folder: /etc/gonfigd
+//	tls:
+//	  cert-file: /etc/gonfigd/tls/server.crt   # --tls-cert-file
+//	  key-file: /etc/gonfigd/tls/server.key    # --tls-key-file
+//
+// Every flag can also be set by an environment variable named after it, prefixed, in upper case
+// and with underscores instead of dashes, i.e: GONFIGD_SERVER_ADDR for --server-addr.
+// Flags set in the command line win over environment variables, which win over the settings file.
+package settings
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LookupEnvFunc returns the value of an environment variable, and whether it is set, like os.LookupEnv
+type LookupEnvFunc func(key string) (string, bool)
+
+// EnvName returns the environment variable setting a flag
+func EnvName(prefix string, flagName string) string {
+	return prefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// flatten collects the settings of a decoded settings file, joining nested keys with a dash
+func flatten(prefix string, value interface{}, settings map[string]string) error {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for k, child := range v {
+			key := fmt.Sprint(k)
+			if prefix != "" {
+				key = prefix + "-" + key
+			}
+			if err := flatten(key, child, settings); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		return fmt.Errorf("%s cannot be a list", prefix)
+	case nil:
+		return fmt.Errorf("%s has no value", prefix)
+	}
+	if prefix == "" {
+		return fmt.Errorf("settings must be a map")
+	}
+	settings[prefix] = fmt.Sprint(value)
+	return nil
+}
+
+// ParseFile returns the settings of a YAML settings file, by flag name
+func ParseFile(data []byte) (map[string]string, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	if value == nil {
+		return settings, nil
+	}
+	if err := flatten("", value, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// Load sets the flags of fs not set in the command line, from the environment variables
+// prefixed with envPrefix, and then from the settings file named by the fileFlag flag, if any.
+// It fails when any setting is not a flag of fs, or has an invalid value.
+// ignore are the flags that can only be set in the command line, i.e: --version
+func Load(fs *flag.FlagSet, fileFlag string, envPrefix string, lookupEnv LookupEnvFunc, ignore ...string) error {
+	ignored := make(map[string]bool, len(ignore))
+	for _, name := range ignore {
+		ignored[name] = true
+	}
+	skip := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		skip[f.Name] = true
+	})
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if skip[f.Name] || ignored[f.Name] || envErr != nil {
+			return
+		}
+		env := EnvName(envPrefix, f.Name)
+		value, ok := lookupEnv(env)
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = NewInvalidSettingsError(env, err.Error())
+			return
+		}
+		skip[f.Name] = true
+	})
+	if envErr != nil {
+		return envErr
+	}
+
+	file := fs.Lookup(fileFlag).Value.String()
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return NewInvalidSettingsError(file, err.Error())
+	}
+	settings, err := ParseFile(data)
+	if err != nil {
+		return NewInvalidSettingsError(file, err.Error())
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ignored[name] || name == fileFlag || fs.Lookup(name) == nil {
+			return NewInvalidSettingsError(file, fmt.Sprintf("unknown setting %s", name))
+		}
+		if skip[name] {
+			continue
+		}
+		if err := fs.Set(name, settings[name]); err != nil {
+			return NewInvalidSettingsError(file, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package settings
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSettings struct {
+	file     string
+	addr     string
+	debug    bool
+	interval time.Duration
+	certFile string
+	version  bool
+}
+
+func newFlagSet(s *testSettings) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&s.file, "config-file", "", "")
+	fs.StringVar(&s.addr, "server-addr", ":8080", "")
+	fs.BoolVar(&s.debug, "debug", false, "")
+	fs.DurationVar(&s.interval, "reload-interval", time.Second, "")
+	fs.StringVar(&s.certFile, "tls-cert-file", "", "")
+	fs.BoolVar(&s.version, "version", false, "")
+	return fs
+}
+
+func env(vars map[string]string) LookupEnvFunc {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, dir string, content string) string {
+	file := filepath.Join(dir, "gonfigd.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "settings-tests")
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, `
+server-addr: :9090
+debug: true
+reload-interval: 1m
+tls:
+  cert-file: /etc/gonfigd/server.crt
+`)
+
+	var s testSettings
+	fs := newFlagSet(&s)
+	assert.Nil(t, fs.Parse([]string{"--config-file", file}))
+	assert.Nil(t, Load(fs, "config-file", "GONFIGD_", env(nil), "version"))
+	assert.Equal(t, testSettings{file: file, addr: ":9090", debug: true, interval: time.Minute, certFile: "/etc/gonfigd/server.crt"}, s)
+
+	// The command line wins over environment variables, which win over the file
+	var s2 testSettings
+	fs2 := newFlagSet(&s2)
+	assert.Nil(t, fs2.Parse([]string{"--server-addr", ":7070"}))
+	vars := map[string]string{"GONFIGD_CONFIG_FILE": file, "GONFIGD_SERVER_ADDR": ":6060", "GONFIGD_DEBUG": "false", "GONFIGD_VERSION": "1.0"}
+	assert.Nil(t, Load(fs2, "config-file", "GONFIGD_", env(vars), "version"))
+	assert.Equal(t, ":7070", s2.addr)
+	assert.False(t, s2.debug)
+	assert.Equal(t, time.Minute, s2.interval)
+	assert.False(t, s2.version)
+
+	// Without settings file
+	var s3 testSettings
+	fs3 := newFlagSet(&s3)
+	assert.Nil(t, fs3.Parse(nil))
+	assert.Nil(t, Load(fs3, "config-file", "GONFIGD_", env(map[string]string{"GONFIGD_DEBUG": "true"})))
+	assert.True(t, s3.debug)
+	assert.Equal(t, ":8080", s3.addr)
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "settings-tests")
+	defer os.RemoveAll(dir)
+	invalid := []string{
+		"unknown: true",
+		"version: true",
+		"config-file: other.yaml",
+		"reload-interval: soon",
+		"server-addr: [a, b]",
+		"server-addr:",
+		"- a",
+		"debug: [",
+	}
+	for _, content := range invalid {
+		file := writeFile(t, dir, content)
+		var s testSettings
+		fs := newFlagSet(&s)
+		fs.Parse([]string{"--config-file", file})
+		assert.True(t, IsInvalidSettingsError(Load(fs, "config-file", "GONFIGD_", env(nil), "version")), content)
+	}
+
+	var s testSettings
+	fs := newFlagSet(&s)
+	fs.Parse([]string{"--config-file", filepath.Join(dir, "missing.yaml")})
+	assert.True(t, IsInvalidSettingsError(Load(fs, "config-file", "GONFIGD_", env(nil))))
+
+	var s2 testSettings
+	fs2 := newFlagSet(&s2)
+	fs2.Parse(nil)
+	assert.True(t, IsInvalidSettingsError(Load(fs2, "config-file", "GONFIGD_", env(map[string]string{"GONFIGD_DEBUG": "maybe"}))))
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "GONFIGD_TLS_CERT_FILE", EnvName("GONFIGD_", "tls-cert-file"))
+}
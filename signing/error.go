@@ -0,0 +1,57 @@
+package signing
+
+import "fmt"
+
+const (
+	InvalidKey       ErrType = "INVALID_KEY_ERROR"
+	InvalidSignature ErrType = "INVALID_SIGNATURE_ERROR"
+	Unknown          ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidKeyError struct {
+	errType ErrType
+	reason  string
+}
+
+type InvalidSignatureError struct {
+	errType ErrType
+	file    string
+	reason  string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidKeyError:
+		return InvalidKey
+	case InvalidSignatureError:
+		return InvalidSignature
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidKeyError(e error) bool {
+	return getErrorType(e) == InvalidKey
+}
+
+func IsInvalidSignatureError(e error) bool {
+	return getErrorType(e) == InvalidSignature
+}
+
+func (e InvalidKeyError) Error() string {
+	return fmt.Sprintf("[%s] Invalid trusted key: %s", e.errType, e.reason)
+}
+
+func (e InvalidSignatureError) Error() string {
+	return fmt.Sprintf("[%s] Signature of %s could not be verified: %s", e.errType, e.file, e.reason)
+}
+
+func NewInvalidKeyError(reason string) InvalidKeyError {
+	return InvalidKeyError{errType: InvalidKey, reason: reason}
+}
+
+func NewInvalidSignatureError(file string, reason string) InvalidSignatureError {
+	return InvalidSignatureError{errType: InvalidSignature, file: file, reason: reason}
+}
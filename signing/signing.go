@@ -0,0 +1,119 @@
+// Package signing verifies the ed25519 detached signatures of configs and bundles
+//
+// The signature of a file lives next to it, with SignatureSuffix appended to its name,
+// and holds the base64 ed25519 signature of its Payload: the path of the file relative
+// to its source, a NUL byte and the whole content. Binding the path keeps a signed config
+// from being served under another name, i.e: a signed staging.yaml copied over prod.yaml.
+// Signatures carry no version, so rolling a file back to an older signed content is not detected.
+// Trusted keys files have one key per line, its name followed by the base64 public key:
+//
+//	# name  key
+//	ci      WUmG2b9Ce6tbKW6pV8TZ0a/pr3gcAHXjYp9Lr0B6o5E=
+package signing
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// SignatureSuffix is appended to a file name to find its detached signature
+const SignatureSuffix = ".sig"
+
+// Verifier checks signatures against a set of trusted keys
+type Verifier struct {
+	keys  map[string]ed25519.PublicKey
+	names []string
+}
+
+// NewVerifier returns a new *Verifier trusting keys, by name
+func NewVerifier(keys map[string]ed25519.PublicKey) *Verifier {
+	v := &Verifier{keys: keys}
+	for name := range keys {
+		v.names = append(v.names, name)
+	}
+	sort.Strings(v.names)
+	return v
+}
+
+// ParseTrustedKeys parses a trusted keys file
+func ParseTrustedKeys(data []byte) (*Verifier, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, NewInvalidKeyError(fmt.Sprintf("line %d must be a name followed by a base64 public key", n))
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, NewInvalidKeyError(fmt.Sprintf("key %s is not a base64 ed25519 public key", fields[0]))
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, NewInvalidKeyError(fmt.Sprintf("key name %s is not unique", fields[0]))
+		}
+		keys[fields[0]] = ed25519.PublicKey(key)
+	}
+	if len(keys) == 0 {
+		return nil, NewInvalidKeyError("no trusted keys found")
+	}
+	return NewVerifier(keys), nil
+}
+
+// LoadTrustedKeys reads and parses a trusted keys file
+func LoadTrustedKeys(file string) (*Verifier, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, NewInvalidKeyError(err.Error())
+	}
+	return ParseTrustedKeys(data)
+}
+
+// Payload returns the signed bytes of data, the content of the file at path
+// path string, the slash separated path of the file relative to its source, i.e: app/db.yaml
+func Payload(path string, data []byte) []byte {
+	payload := make([]byte, 0, len(path)+1+len(data))
+	payload = append(payload, path...)
+	payload = append(payload, 0)
+	return append(payload, data...)
+}
+
+// Verify checks signature, a base64 ed25519 signature, was made over the Payload of path and data
+// by any of the trusted keys, returning the name of the key
+func (v *Verifier) Verify(path string, data []byte, signature []byte) (string, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return "", NewInvalidSignatureError(path, "signature is not a base64 ed25519 signature")
+	}
+	payload := Payload(path, data)
+	for _, name := range v.names {
+		if ed25519.Verify(v.keys[name], payload, sig) {
+			return name, nil
+		}
+	}
+	return "", NewInvalidSignatureError(path, "not signed by any trusted key")
+}
+
+// VerifyFile checks data, the content of file, against its detached signature
+// path string, the path file is served as, see Payload
+func (v *Verifier) VerifyFile(file string, path string, data []byte) (string, error) {
+	signature, err := ioutil.ReadFile(file + SignatureSuffix)
+	if err != nil {
+		return "", NewInvalidSignatureError(path, err.Error())
+	}
+	return v.Verify(path, data, signature)
+}
+
+// Sign returns the base64 ed25519 signature of the Payload of path and data, as expected in signature files
+func Sign(key ed25519.PrivateKey, path string, data []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, Payload(path, data))))
+}
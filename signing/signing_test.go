@@ -0,0 +1,83 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedKeys(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.StdEncoding.EncodeToString(pub)
+
+	v, err := ParseTrustedKeys([]byte(fmt.Sprintf("# trusted keys\n\nci %s\n", b64)))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ci"}, v.names)
+
+	_, err2 := ParseTrustedKeys([]byte("ci"))
+	assert.EqualError(t, err2, fmt.Sprintf("[%s] Invalid trusted key: line 1 must be a name followed by a base64 public key", InvalidKey))
+
+	_, err3 := ParseTrustedKeys([]byte("ci Zm9v"))
+	assert.True(t, IsInvalidKeyError(err3))
+
+	_, err4 := ParseTrustedKeys([]byte(fmt.Sprintf("ci %s\nci %s", b64, b64)))
+	assert.True(t, IsInvalidKeyError(err4))
+
+	_, err5 := ParseTrustedKeys([]byte("# no keys\n"))
+	assert.True(t, IsInvalidKeyError(err5))
+}
+
+func TestVerify(t *testing.T) {
+	ciPub, ciPriv, _ := ed25519.GenerateKey(rand.Reader)
+	opsPub, opsPriv, _ := ed25519.GenerateKey(rand.Reader)
+	_, untrusted, _ := ed25519.GenerateKey(rand.Reader)
+	v := NewVerifier(map[string]ed25519.PublicKey{"ci": ciPub, "ops": opsPub})
+	data := []byte("foo: bar")
+
+	name, err := v.Verify("db.yaml", data, Sign(ciPriv, "db.yaml", data))
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", name)
+
+	name2, err2 := v.Verify("db.yaml", data, Sign(opsPriv, "db.yaml", data))
+	assert.Nil(t, err2)
+	assert.Equal(t, "ops", name2)
+
+	_, err3 := v.Verify("db.yaml", data, Sign(untrusted, "db.yaml", data))
+	assert.EqualError(t, err3, fmt.Sprintf("[%s] Signature of db.yaml could not be verified: not signed by any trusted key", InvalidSignature))
+
+	_, err4 := v.Verify("db.yaml", []byte("foo: baz"), Sign(ciPriv, "db.yaml", data))
+	assert.True(t, IsInvalidSignatureError(err4))
+
+	// Signatures are bound to the path they were made for
+	_, err6 := v.Verify("prod/db.yaml", data, Sign(ciPriv, "staging/db.yaml", data))
+	assert.EqualError(t, err6, fmt.Sprintf("[%s] Signature of prod/db.yaml could not be verified: not signed by any trusted key", InvalidSignature))
+	_, err7 := v.Verify("db.yaml", data, Sign(ciPriv, "db.yam", append([]byte("l"), data...)))
+	assert.True(t, IsInvalidSignatureError(err7))
+
+	_, err5 := v.Verify("db.yaml", data, []byte("not a signature"))
+	assert.True(t, IsInvalidSignatureError(err5))
+}
+
+func TestVerifyFile(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	v := NewVerifier(map[string]ed25519.PublicKey{"ci": pub})
+	dir, _ := ioutil.TempDir("", "signing-tests")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "db.yaml")
+	data := []byte("foo: bar")
+
+	_, err := v.VerifyFile(file, "db.yaml", data)
+	assert.True(t, IsInvalidSignatureError(err))
+
+	ioutil.WriteFile(file+SignatureSuffix, Sign(priv, "db.yaml", data), 0644)
+	name, err2 := v.VerifyFile(file, "db.yaml", data)
+	assert.Nil(t, err2)
+	assert.Equal(t, "ci", name)
+}
@@ -0,0 +1,56 @@
+package snapshot
+
+import "fmt"
+
+const (
+	InvalidSnapshot ErrType = "INVALID_SNAPSHOT_ERROR"
+	NotEmpty        ErrType = "NOT_EMPTY_ERROR"
+	Unknown         ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidSnapshotError struct {
+	errType ErrType
+	reason  string
+}
+
+type NotEmptyError struct {
+	errType ErrType
+	configs int
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidSnapshotError:
+		return InvalidSnapshot
+	case NotEmptyError:
+		return NotEmpty
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidSnapshotError(e error) bool {
+	return getErrorType(e) == InvalidSnapshot
+}
+
+func IsNotEmptyError(e error) bool {
+	return getErrorType(e) == NotEmpty
+}
+
+func (e InvalidSnapshotError) Error() string {
+	return fmt.Sprintf("[%s] Invalid snapshot: %s", e.errType, e.reason)
+}
+
+func (e NotEmptyError) Error() string {
+	return fmt.Sprintf("[%s] %d configs are already served, restoring would replace them", e.errType, e.configs)
+}
+
+func NewInvalidSnapshotError(reason string) InvalidSnapshotError {
+	return InvalidSnapshotError{errType: InvalidSnapshot, reason: reason}
+}
+
+func NewNotEmptyError(configs int) NotEmptyError {
+	return NotEmptyError{errType: NotEmpty, configs: configs}
+}
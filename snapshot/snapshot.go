@@ -0,0 +1,191 @@
+// Package snapshot exports and restores every config of a KV as a single file
+//
+// Snapshots are JSON documents holding the version of the format, the revision
+// of the replication log when the KV has one, and every config with its content,
+// md5, metadata and last modification time, so they can seed new daemons,
+// back up their state or reproduce incidents offline.
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+)
+
+// Version is the version of the snapshot format written, and the only one read
+const Version = 1
+
+// takeAttempts is how many times Take retries when the KV changes while being read
+const takeAttempts = 5
+
+// Revisioned is implemented by KVs numbering their changes, i.e: the replication log
+type Revisioned interface {
+	ID() string
+	Revision() int64
+}
+
+// Entry is a config within a snapshot
+type Entry struct {
+	Key          string            `json:"key"`
+	Content      []byte            `json:"content"`
+	MD5          string            `json:"md5"`
+	LastModified time.Time         `json:"lastModified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// Snapshot is every config of a KV at a point in time
+type Snapshot struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// LogID and Revision identify the state of the replication log the snapshot was taken at, if any
+	LogID    string  `json:"logID,omitempty"`
+	Revision int64   `json:"revision,omitempty"`
+	Entries  []Entry `json:"entries"`
+}
+
+func read(store kv.KV) ([]Entry, error) {
+	keys, err := store.List("")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	entries := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		v, err := store.Get(k)
+		if err != nil {
+			// Deleted meanwhile
+			continue
+		}
+		entries = append(entries, Entry{
+			Key:          k,
+			Content:      []byte(v.Text()),
+			MD5:          v.MD5(),
+			LastModified: v.LastModified(),
+			Metadata:     v.AllMetadata(),
+		})
+	}
+	return entries, nil
+}
+
+// Take returns a snapshot of every config in store.
+// When store is Revisioned, it is read again until no change happens while reading it.
+func Take(store kv.KV) (*Snapshot, error) {
+	s := &Snapshot{Version: Version, CreatedAt: time.Now()}
+	r, ok := store.(Revisioned)
+	if !ok {
+		entries, err := read(store)
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = entries
+		return s, nil
+	}
+	for i := 0; i < takeAttempts; i++ {
+		revision := r.Revision()
+		entries, err := read(store)
+		if err != nil {
+			return nil, err
+		}
+		if r.Revision() == revision {
+			s.LogID, s.Revision, s.Entries = r.ID(), revision, entries
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("configs kept changing while taking the snapshot, %d attempts", takeAttempts)
+}
+
+// Marshal encodes the snapshot as a snapshot file
+func (s *Snapshot) Marshal() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// Unmarshal decodes and validates a snapshot file
+func Unmarshal(data []byte) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, NewInvalidSnapshotError(err.Error())
+	}
+	if s.Version != Version {
+		return nil, NewInvalidSnapshotError(fmt.Sprintf("version %d is not supported, expected %d", s.Version, Version))
+	}
+	seen := make(map[string]bool, len(s.Entries))
+	for _, e := range s.Entries {
+		if e.Key == "" {
+			return nil, NewInvalidSnapshotError("entry without key")
+		}
+		if seen[e.Key] {
+			return nil, NewInvalidSnapshotError(fmt.Sprintf("key %s is not unique", e.Key))
+		}
+		seen[e.Key] = true
+	}
+	return s, nil
+}
+
+// Restore replaces every config of store with the ones of the snapshot at once,
+// publishing an event for every config changed, and returns how many configs it restored.
+// Unless force is set, store must be empty. Configs are restored even if publishing an event fails.
+func (s *Snapshot) Restore(ctx context.Context, store kv.KV, ps pubsub.PubSub, force bool) (int, error) {
+	keys, err := store.List("")
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) > 0 && !force {
+		return 0, NewNotEmptyError(len(keys))
+	}
+
+	changes := make(map[string]*kv.Value, len(s.Entries))
+	events := make(map[string]pubsub.EventType, len(s.Entries))
+	for _, e := range s.Entries {
+		v, err := kv.RestoreValue(e.Content, e.Metadata, e.LastModified)
+		if err != nil {
+			return 0, err
+		}
+		if v.MD5() != e.MD5 {
+			return 0, NewInvalidSnapshotError(fmt.Sprintf("md5 of %s is %s, expected %s", e.Key, v.MD5(), e.MD5))
+		}
+		old, err := store.Get(e.Key)
+		switch {
+		case err != nil:
+			events[e.Key] = pubsub.ConfigCreated
+		case old.MD5() != v.MD5():
+			events[e.Key] = pubsub.ConfigUpdated
+		}
+		changes[e.Key] = v
+	}
+	for _, k := range keys {
+		if _, ok := changes[k]; !ok {
+			changes[k] = nil
+			events[k] = pubsub.ConfigDeleted
+		}
+	}
+	if err := store.Apply(changes); err != nil {
+		return 0, err
+	}
+
+	changed := make([]string, 0, len(events))
+	for k := range events {
+		changed = append(changed, k)
+	}
+	sort.Strings(changed)
+	var publishErr error
+	for _, k := range changed {
+		if err := publish(ctx, ps, k, events[k]); err != nil && publishErr == nil {
+			publishErr = fmt.Errorf("failed to publish %s event for %s: %v", events[k].String(), k, err)
+		}
+	}
+	return len(s.Entries), publishErr
+}
+
+func publish(ctx context.Context, ps pubsub.PubSub, config string, evType pubsub.EventType) error {
+	if !ps.TopicExists(config) {
+		if err := ps.CreateTopic(config); err != nil {
+			return err
+		}
+	}
+	return ps.Publish(config, pubsub.NewEventWithContext(ctx, evType, config))
+}
@@ -0,0 +1,109 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+// revisioned counts the puts of a KV, as the replication log does
+type revisioned struct {
+	kv.KV
+	revision int64
+}
+
+func (r *revisioned) ID() string {
+	return "log"
+}
+
+func (r *revisioned) Revision() int64 {
+	return r.revision
+}
+
+func (r *revisioned) Put(k string, v *kv.Value) error {
+	r.revision++
+	return r.KV.Put(k, v)
+}
+
+func TestTakeAndRestore(t *testing.T) {
+	db, _ := kv.NewKV(kv.INMEMORY)
+	l := &revisioned{KV: db}
+	v, _ := kv.NewValueWithMetadata([]byte("foo: bar"), map[string]string{kv.MetadataCommit: "abc"})
+	l.Put("/configs/db.yaml", v)
+	v2, _ := kv.NewValue([]byte("ttl: 1"))
+	l.Put("/configs/cache.yaml", v2)
+
+	snap, err := Take(l)
+	assert.Nil(t, err)
+	assert.Equal(t, Version, snap.Version)
+	assert.Equal(t, "log", snap.LogID)
+	assert.Equal(t, int64(2), snap.Revision)
+	assert.Len(t, snap.Entries, 2)
+	data, err := snap.Marshal()
+	assert.Nil(t, err)
+
+	snap2, err := Unmarshal(data)
+	assert.Nil(t, err)
+	fresh, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	n, err := snap2.Restore(context.Background(), fresh, ps, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	restored, _ := fresh.Get("/configs/db.yaml")
+	assert.Equal(t, "foo: bar", restored.Text())
+	assert.Equal(t, v.MD5(), restored.MD5())
+	assert.Equal(t, "abc", restored.Metadata(kv.MetadataCommit))
+	assert.True(t, v.LastModified().Equal(restored.LastModified()))
+
+	// Only fresh KVs, unless forced
+	_, err2 := snap2.Restore(context.Background(), fresh, ps, false)
+	assert.True(t, IsNotEmptyError(err2))
+
+	stale, _ := kv.NewValue([]byte("stale: true"))
+	fresh.Put("/configs/stale.yaml", stale)
+	ps.CreateTopic("/configs/stale.yaml")
+	sub, _ := ps.Subscribe("/configs/stale.yaml")
+	events := make(chan *pubsub.Event)
+	go func() {
+		events <- <-sub.Channel()
+	}()
+	errCh := make(chan error)
+	go func() {
+		_, err := snap2.Restore(context.Background(), fresh, ps, true)
+		errCh <- err
+	}()
+	select {
+	case ev := <-events:
+		assert.Equal(t, pubsub.ConfigDeleted, ev.Kind())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	assert.Nil(t, <-errCh)
+	keys, _ := fresh.List("")
+	assert.ElementsMatch(t, []string{"/configs/db.yaml", "/configs/cache.yaml"}, keys)
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	_, err := Unmarshal([]byte(`{"version": 2, "entries": []}`))
+	assert.EqualError(t, err, fmt.Sprintf("[%s] Invalid snapshot: version 2 is not supported, expected 1", InvalidSnapshot))
+
+	_, err2 := Unmarshal([]byte("not json"))
+	assert.True(t, IsInvalidSnapshotError(err2))
+
+	_, err3 := Unmarshal([]byte(`{"version": 1, "entries": [{"key": "/a"}, {"key": "/a"}]}`))
+	assert.True(t, IsInvalidSnapshotError(err3))
+
+	// Tampered content
+	snap, _ := Unmarshal([]byte(`{"version": 1, "entries": [{"key": "/a", "content": "Zm9v", "md5": "bad"}]}`))
+	db, _ := kv.NewKV(kv.INMEMORY)
+	ps, _ := pubsub.NewPubSub(pubsub.INMEMORY)
+	_, err4 := snap.Restore(context.Background(), db, ps, false)
+	assert.True(t, IsInvalidSnapshotError(err4))
+	keys, _ := db.List("")
+	assert.Empty(t, keys)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/api"
+	"github.com/fcgravalos/gonfigd/client"
+	"google.golang.org/grpc"
+)
+
+// maxSnapshotSize bounds the snapshots sent and received, as the daemon does
+const maxSnapshotSize = 64 << 20
+
+const snapshotUsage = `Usage: gonfigd snapshot export|restore [flags]
+
+  export  writes a snapshot of every config served by a daemon to --file
+  restore replaces every config served by a daemon with the ones of the snapshot in --file
+`
+
+// snapshotCommand runs `gonfigd snapshot export|restore`, returning the exit code
+func snapshotCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "restore") {
+		fmt.Fprint(os.Stderr, snapshotUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("snapshot "+args[0], flag.ContinueOnError)
+	addr := fs.String("server-addr", "localhost:8080", "gRPC address of the daemon")
+	file := fs.String("file", "", "Snapshot file to write on export, or to read on restore")
+	caFile := fs.String("ca-file", "", "CA verifying the daemon certificate. Enables TLS")
+	certFile := fs.String("cert-file", "", "Client certificate presented to the daemon running with mTLS")
+	keyFile := fs.String("key-file", "", "Client certificate private key")
+	tokenFile := fs.String("token-file", "", "File with the bearer token sent to the daemon")
+	force := fs.Bool("force", false, "Restore even if the daemon already serves configs, replacing them")
+	timeout := fs.Duration("timeout", time.Minute, "How long to wait for the daemon")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "--file is required")
+		return 2
+	}
+
+	opts, err := client.DialOptions(*caFile, *certFile, *keyFile, *tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to configure the connection: %v\n", err)
+		return 1
+	}
+	opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxSnapshotSize), grpc.MaxCallSendMsgSize(maxSnapshotSize)))
+	conn, err := grpc.Dial(*addr, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to %s: %v\n", *addr, err)
+		return 1
+	}
+	defer conn.Close()
+	client := api.NewGonfigClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if args[0] == "export" {
+		resp, err := client.ExportSnapshot(ctx, &api.ExportSnapshotRequest{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export snapshot: %v\n", err)
+			return 1
+		}
+		if err := ioutil.WriteFile(*file, resp.Snapshot, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write snapshot: %v\n", err)
+			return 1
+		}
+		fmt.Printf("snapshot written to %s\n", *file)
+		return 0
+	}
+
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read snapshot: %v\n", err)
+		return 1
+	}
+	resp, err := client.RestoreSnapshot(ctx, &api.RestoreSnapshotRequest{Snapshot: data, Force: *force})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to restore snapshot: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d configs restored from %s\n", resp.Configs, *file)
+	return 0
+}
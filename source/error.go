@@ -0,0 +1,56 @@
+package source
+
+import "fmt"
+
+const (
+	InvalidSpec ErrType = "INVALID_SPEC_ERROR"
+	UnknownKind ErrType = "UNKNOWN_KIND_ERROR"
+	Unknown     ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidSpecError struct {
+	errType ErrType
+	reason  string
+}
+
+type UnknownKindError struct {
+	errType ErrType
+	kind    string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidSpecError:
+		return InvalidSpec
+	case UnknownKindError:
+		return UnknownKind
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidSpecError(e error) bool {
+	return getErrorType(e) == InvalidSpec
+}
+
+func IsUnknownKindError(e error) bool {
+	return getErrorType(e) == UnknownKind
+}
+
+func (e InvalidSpecError) Error() string {
+	return fmt.Sprintf("[%s] Invalid source spec: %s", e.errType, e.reason)
+}
+
+func (e UnknownKindError) Error() string {
+	return fmt.Sprintf("[%s] %s is not a registered kind of source", e.errType, e.kind)
+}
+
+func NewInvalidSpecError(reason string) InvalidSpecError {
+	return InvalidSpecError{errType: InvalidSpec, reason: reason}
+}
+
+func NewUnknownKindError(kind string) UnknownKindError {
+	return UnknownKindError{errType: UnknownKind, kind: kind}
+}
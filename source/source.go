@@ -0,0 +1,190 @@
+// Package source defines the providers of configs the daemon keeps in the KV
+//
+// Every kind of source registers a Factory, so the daemon can build any
+// combination of sources from their Spec without knowing about them.
+// A sources file looks like:
+//
+//	sources:
+//	- name: local
+//	  kind: fs
+//	  root: /etc/gonfigd
+//	  options:
+//	    walkInterval: 5s
+//	- name: shared
+//	  kind: git
+//	  root: /etc/gonfigd/shared
+//	  options:
+//	    repo: file:///srv/git/configs.git
+//	    ref: main
+//	- name: ci
+//	  kind: bundle
+//	  root: /etc/gonfigd/ci
+//	  options:
+//	    path: /var/lib/gonfigd/configs.tar.gz
+package source
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/kv"
+	"github.com/fcgravalos/gonfigd/pubsub"
+	"github.com/fcgravalos/gonfigd/signing"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+)
+
+// Source provides configs, keeping them in the KV and publishing their changes
+type Source interface {
+	// Name identifies the source, i.e: in logs
+	Name() string
+	// Snapshot loads the current configs of the source into the KV
+	Snapshot(ctx context.Context) error
+	// Start keeps the KV in sync with the source, publishing an event per changed config, until ctx is done
+	Start(ctx context.Context) error
+}
+
+// DependencyTracker keeps track of the configs referenced by other configs,
+// so dependent configs can be notified when a referenced one changes
+type DependencyTracker interface {
+	Track(path string, content string)
+	Untrack(path string)
+	Dependents(path string) []string
+}
+
+// PublishDependents notifies every config referencing config, directly or transitively, that it has been updated
+// Nothing is published when deps is nil
+func PublishDependents(ctx context.Context, ps pubsub.PubSub, deps DependencyTracker, config string) error {
+	if deps == nil {
+		return nil
+	}
+	for _, d := range deps.Dependents(config) {
+		if err := ps.CreateTopic(d); err != nil {
+			return err
+		}
+		if err := ps.Publish(d, pubsub.NewEventWithContext(ctx, pubsub.ConfigUpdated, d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Spec describes a source to build
+type Spec struct {
+	Name string `yaml:"name"`
+	Kind string `yaml:"kind"`
+	// Root is the folder the configs of the source are keyed under
+	Root string `yaml:"root"`
+	// Options are specific to each kind of source
+	Options map[string]string `yaml:"options"`
+}
+
+// Option returns the value of an option, or def if not set
+func (s Spec) Option(key string, def string) string {
+	if v, ok := s.Options[key]; ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Duration returns the value of an option parsed as a time.Duration, or def if not set
+func (s Spec) Duration(key string, def time.Duration) (time.Duration, error) {
+	v := s.Option(key, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, NewInvalidSpecError(fmt.Sprintf("source %s option %s: %v", s.Name, key, err))
+	}
+	return d, nil
+}
+
+// Env holds what sources need from the daemon
+type Env struct {
+	KV kv.KV
+	PS pubsub.PubSub
+	// Deps is optional, when nil, configs referencing others won't be notified
+	Deps DependencyTracker
+	// Verifier is optional, when set, configs must be signed by a trusted key
+	Verifier *signing.Verifier
+	Logger   zerolog.Logger
+}
+
+// Factory builds a source from its spec
+type Factory func(spec Spec, env Env) (Source, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a kind of source available, it is meant to be called from init functions
+func Register(kind string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[kind] = f
+}
+
+// Kinds returns, sorted, the registered kinds of sources
+func Kinds() []string {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	kinds := make([]string, 0, len(factories))
+	for k := range factories {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// New builds the source described by spec
+func New(spec Spec, env Env) (Source, error) {
+	factoriesMu.Lock()
+	f, ok := factories[spec.Kind]
+	factoriesMu.Unlock()
+	if !ok {
+		return nil, NewUnknownKindError(spec.Kind)
+	}
+	return f(spec, env)
+}
+
+type specsFile struct {
+	Sources []Spec `yaml:"sources"`
+}
+
+// ParseSpecs parses a YAML sources file
+// Sources without name are named after their kind, names must be unique
+func ParseSpecs(data []byte) ([]Spec, error) {
+	f := specsFile{}
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, NewInvalidSpecError(err.Error())
+	}
+	names := make(map[string]struct{})
+	for i, s := range f.Sources {
+		if s.Kind == "" {
+			return nil, NewInvalidSpecError(fmt.Sprintf("source %d must have a kind", i))
+		}
+		if s.Name == "" {
+			f.Sources[i].Name = s.Kind
+		}
+		if _, ok := names[f.Sources[i].Name]; ok {
+			return nil, NewInvalidSpecError(fmt.Sprintf("source name %s is not unique", f.Sources[i].Name))
+		}
+		names[f.Sources[i].Name] = struct{}{}
+	}
+	return f.Sources, nil
+}
+
+// LoadSpecs reads and parses a YAML sources file
+func LoadSpecs(file string) ([]Spec, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, NewInvalidSpecError(err.Error())
+	}
+	return ParseSpecs(data)
+}
@@ -0,0 +1,77 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSource struct {
+	name string
+}
+
+func (fs *fakeSource) Name() string {
+	return fs.name
+}
+
+func (fs *fakeSource) Snapshot(ctx context.Context) error {
+	return nil
+}
+
+func (fs *fakeSource) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	Register("fake", func(spec Spec, env Env) (Source, error) {
+		return &fakeSource{name: spec.Name}, nil
+	})
+	assert.Contains(t, Kinds(), "fake")
+
+	src, err := New(Spec{Name: "test", Kind: "fake"}, Env{})
+	assert.Nil(t, err)
+	assert.Equal(t, "test", src.Name())
+
+	_, err2 := New(Spec{Name: "test", Kind: "missing"}, Env{})
+	assert.EqualError(t, err2, fmt.Sprintf("[%s] missing is not a registered kind of source", UnknownKind))
+}
+
+func TestParseSpecs(t *testing.T) {
+	specs, err := ParseSpecs([]byte(`
+sources:
+- name: local
+  kind: fs
+  root: /etc/gonfigd
+  options:
+    walkInterval: 10s
+- kind: git
+  options:
+    repo: file:///srv/git/configs.git
+`))
+	assert.Nil(t, err)
+	assert.Len(t, specs, 2)
+	assert.Equal(t, "local", specs[0].Name)
+	assert.Equal(t, "/etc/gonfigd", specs[0].Root)
+	interval, err2 := specs[0].Duration("walkInterval", time.Second)
+	assert.Nil(t, err2)
+	assert.Equal(t, 10*time.Second, interval)
+	assert.Equal(t, "git", specs[1].Name)
+	assert.Equal(t, "file:///srv/git/configs.git", specs[1].Option("repo", ""))
+	assert.Equal(t, "master", specs[1].Option("ref", "master"))
+
+	_, err3 := ParseSpecs([]byte("sources:\n- name: nokind\n"))
+	assert.True(t, IsInvalidSpecError(err3))
+
+	_, err4 := ParseSpecs([]byte("sources:\n- kind: fs\n- kind: fs\n"))
+	assert.EqualError(t, err4, fmt.Sprintf("[%s] Invalid source spec: source name fs is not unique", InvalidSpec))
+
+	_, err5 := ParseSpecs([]byte("sources:\n- kind: fs\n  unknown: field\n"))
+	assert.True(t, IsInvalidSpecError(err5))
+
+	_, err6 := Spec{Name: "local", Options: map[string]string{"walkInterval": "often"}}.Duration("walkInterval", time.Second)
+	assert.True(t, IsInvalidSpecError(err6))
+}
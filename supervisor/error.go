@@ -0,0 +1,57 @@
+package supervisor
+
+import "fmt"
+
+const (
+	InvalidConfig ErrType = "INVALID_CONFIG_ERROR"
+	Start         ErrType = "START_ERROR"
+	Unknown       ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidConfigError struct {
+	errType ErrType
+	reason  string
+}
+
+type StartError struct {
+	errType ErrType
+	command string
+	err     error
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidConfigError:
+		return InvalidConfig
+	case StartError:
+		return Start
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidConfigError(e error) bool {
+	return getErrorType(e) == InvalidConfig
+}
+
+func IsStartError(e error) bool {
+	return getErrorType(e) == Start
+}
+
+func (e InvalidConfigError) Error() string {
+	return fmt.Sprintf("[%s] Invalid supervisor config: %s", e.errType, e.reason)
+}
+
+func (e StartError) Error() string {
+	return fmt.Sprintf("[%s] %s could not be started: %v", e.errType, e.command, e.err)
+}
+
+func NewInvalidConfigError(reason string) InvalidConfigError {
+	return InvalidConfigError{errType: InvalidConfig, reason: reason}
+}
+
+func NewStartError(command string, err error) StartError {
+	return StartError{errType: Start, command: command, err: err}
+}
@@ -0,0 +1,310 @@
+// Package supervisor runs a command with configs of a remote gonfigd, for apps reading them
+// from files or environment variables
+//
+// Configs are fetched before starting the command, written to their files and exported as
+// environment variables, whole or flattened into a variable per value. Whenever they change, the command is sent ReloadSignal, or restarted
+// when it has none or an environment variable changed, as environment variables can only be
+// set at startup. The command is stopped with StopSignal, and killed if it has not exited after
+// GracePeriod. Signals received by the supervisor are forwarded to the command, and the supervisor
+// exits with the exit code of the command.
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/atomicfile"
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/fcgravalos/gonfigd/envvars"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultGracePeriod is how long the command has to exit when it is stopped, by default
+	DefaultGracePeriod = 10 * time.Second
+
+	defaultPerms os.FileMode = 0644
+)
+
+// signals are the signals ReloadSignal and StopSignal can be set to, by name
+var signals map[string]syscall.Signal = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// forwarded are the signals forwarded to the command
+var forwarded = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// File writes a config to a local file
+type File struct {
+	Path        string
+	Destination string
+	Perms       os.FileMode
+}
+
+// Env exports a config as an environment variable
+type Env struct {
+	Name string
+	Path string
+}
+
+// EnvFrom exports every value of a config as an environment variable, see envvars.Flatten
+type EnvFrom struct {
+	Path    string
+	Options envvars.Options
+}
+
+// Config of a Supervisor
+type Config struct {
+	// Command is the command to run and its arguments
+	Command []string
+	Files   []File
+	Env     []Env
+	// EnvFrom variables are overridden by Env ones with the same name
+	EnvFrom []EnvFrom
+	// ReloadSignal is sent to the command when a file changes, the command is restarted when not set
+	ReloadSignal syscall.Signal
+	// StopSignal stops the command, SIGTERM when not set
+	StopSignal syscall.Signal
+	// GracePeriod is how long the command has to exit once sent StopSignal before being killed,
+	// DefaultGracePeriod when not set
+	GracePeriod time.Duration
+}
+
+// ParseSignal returns the signal named name, i.e: SIGHUP
+func ParseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signals[strings.ToUpper(name)]
+	if !ok {
+		return 0, NewInvalidConfigError(fmt.Sprintf("signal %s is not supported", name))
+	}
+	return sig, nil
+}
+
+// Configs serves and watches configs, i.e: *client.Client
+type Configs interface {
+	Get(path string) (string, error)
+	OnChange(path string, fn client.ChangeFunc) error
+}
+
+// Supervisor runs a command, keeping its configs up to date
+type Supervisor struct {
+	cfg     Config
+	configs Configs
+	env     []string
+	trigger chan struct{}
+	signals chan os.Signal
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	log     zerolog.Logger
+}
+
+// New returns a new *Supervisor, validating cfg
+func New(cfg Config, configs Configs, logger zerolog.Logger) (*Supervisor, error) {
+	if len(cfg.Command) == 0 {
+		return nil, NewInvalidConfigError("no command")
+	}
+	cfg.Files = append([]File(nil), cfg.Files...)
+	destinations := make(map[string]bool, len(cfg.Files))
+	for i, f := range cfg.Files {
+		if f.Path == "" || f.Destination == "" {
+			return nil, NewInvalidConfigError(fmt.Sprintf("file %d must have a path and a destination", i))
+		}
+		if destinations[f.Destination] {
+			return nil, NewInvalidConfigError(fmt.Sprintf("destination %s is not unique", f.Destination))
+		}
+		destinations[f.Destination] = true
+		if f.Perms == 0 {
+			cfg.Files[i].Perms = defaultPerms
+		}
+	}
+	for _, e := range cfg.Env {
+		if e.Name == "" || strings.Contains(e.Name, "=") || e.Path == "" {
+			return nil, NewInvalidConfigError(fmt.Sprintf("environment variable %q must have a valid name and a path", e.Name))
+		}
+	}
+	for _, e := range cfg.EnvFrom {
+		if e.Path == "" {
+			return nil, NewInvalidConfigError("environment variables must be exported from a path")
+		}
+		if _, err := envvars.Flatten("", e.Options); err != nil {
+			return nil, NewInvalidConfigError(fmt.Sprintf("environment variables of %s: %v", e.Path, err))
+		}
+	}
+	if cfg.StopSignal == 0 {
+		cfg.StopSignal = syscall.SIGTERM
+	}
+	if cfg.GracePeriod == 0 {
+		cfg.GracePeriod = DefaultGracePeriod
+	}
+	return &Supervisor{
+		cfg:     cfg,
+		configs: configs,
+		trigger: make(chan struct{}, 1),
+		signals: make(chan os.Signal, len(forwarded)),
+		log:     logger,
+	}, nil
+}
+
+// watch triggers a render whenever path changes
+func (s *Supervisor) watch(path string) {
+	err := s.configs.OnChange(path, func(string, string, bool) {
+		select {
+		case s.trigger <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		s.log.Warn().Msgf("%s is not available yet: %v", path, err)
+	}
+}
+
+// render writes the files and reads the environment variables, returning whether any of them changed.
+// Nothing changes when any config cannot be read or any file cannot be written.
+func (s *Supervisor) render() (bool, bool, error) {
+	env := make([]string, 0, len(s.cfg.Env))
+	for _, e := range s.cfg.EnvFrom {
+		config, err := s.configs.Get(e.Path)
+		if err != nil {
+			return false, false, err
+		}
+		vars, err := envvars.Flatten(config, e.Options)
+		if err != nil {
+			return false, false, err
+		}
+		for _, v := range vars {
+			env = append(env, v.String())
+		}
+	}
+	for _, e := range s.cfg.Env {
+		config, err := s.configs.Get(e.Path)
+		if err != nil {
+			return false, false, err
+		}
+		env = append(env, e.Name+"="+config)
+	}
+	contents := make([]string, len(s.cfg.Files))
+	for i, f := range s.cfg.Files {
+		config, err := s.configs.Get(f.Path)
+		if err != nil {
+			return false, false, err
+		}
+		contents[i] = config
+	}
+	files := make([]atomicfile.File, len(s.cfg.Files))
+	for i, f := range s.cfg.Files {
+		files[i] = atomicfile.File{Path: f.Destination, Data: []byte(contents[i]), Perms: f.Perms}
+	}
+	filesChanged, err := atomicfile.WriteAll(files...)
+	if err != nil {
+		return false, false, err
+	}
+	envChanged := s.env == nil || strings.Join(env, "\x00") != strings.Join(s.env, "\x00")
+	s.env = env
+	return filesChanged, envChanged, nil
+}
+
+// start starts the command
+func (s *Supervisor) start() error {
+	cmd := exec.Command(s.cfg.Command[0], s.cfg.Command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), s.env...)
+	if err := cmd.Start(); err != nil {
+		return NewStartError(s.cfg.Command[0], err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	s.cmd = cmd
+	s.exited = exited
+	s.log.Info().Msgf("%s started with pid %d", s.cfg.Command[0], cmd.Process.Pid)
+	return nil
+}
+
+// stop sends StopSignal to the command, killing it if it has not exited after GracePeriod
+func (s *Supervisor) stop() {
+	s.cmd.Process.Signal(s.cfg.StopSignal)
+	select {
+	case <-s.exited:
+	case <-time.After(s.cfg.GracePeriod):
+		s.log.Warn().Msgf("%s has not exited after %s, killing it", s.cfg.Command[0], s.cfg.GracePeriod)
+		s.cmd.Process.Kill()
+		<-s.exited
+	}
+}
+
+// exitCode returns the exit code of a command, 128 plus the signal number when it was killed by a signal, as shells do
+func exitCode(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
+
+// Run renders the configs and runs the command, until it exits or ctx is done, returning its exit code.
+// It fails when the configs cannot be read or the command cannot be started.
+func (s *Supervisor) Run(ctx context.Context) (int, error) {
+	for _, f := range s.cfg.Files {
+		s.watch(f.Path)
+	}
+	for _, e := range s.cfg.Env {
+		s.watch(e.Path)
+	}
+	for _, e := range s.cfg.EnvFrom {
+		s.watch(e.Path)
+	}
+	if _, _, err := s.render(); err != nil {
+		return 0, err
+	}
+	signal.Notify(s.signals, forwarded...)
+	defer signal.Stop(s.signals)
+	if err := s.start(); err != nil {
+		return 0, err
+	}
+	for {
+		select {
+		case <-s.trigger:
+			filesChanged, envChanged, err := s.render()
+			if err != nil {
+				s.log.Error().Msgf("configs could not be rendered, keeping the current ones: %v", err)
+				continue
+			}
+			switch {
+			case envChanged || (filesChanged && s.cfg.ReloadSignal == 0):
+				s.log.Info().Msgf("configs changed, restarting %s", s.cfg.Command[0])
+				s.stop()
+				if err := s.start(); err != nil {
+					return 0, err
+				}
+			case filesChanged:
+				s.log.Info().Msgf("configs changed, sending %s to %s", s.cfg.ReloadSignal, s.cfg.Command[0])
+				if err := s.cmd.Process.Signal(s.cfg.ReloadSignal); err != nil {
+					s.log.Error().Msgf("%v", err)
+				}
+			}
+		case sig := <-s.signals:
+			s.log.Debug().Msgf("forwarding %s to %s", sig, s.cfg.Command[0])
+			s.cmd.Process.Signal(sig)
+		case <-s.exited:
+			code := exitCode(s.cmd.ProcessState)
+			s.log.Info().Msgf("%s exited with code %d", s.cfg.Command[0], code)
+			return code, nil
+		case <-ctx.Done():
+			s.stop()
+			return exitCode(s.cmd.ProcessState), nil
+		}
+	}
+}
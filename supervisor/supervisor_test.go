@@ -0,0 +1,222 @@
+package supervisor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/client"
+	"github.com/fcgravalos/gonfigd/envvars"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConfigs is an in-memory Configs
+type fakeConfigs struct {
+	sync.Mutex
+	configs   map[string]string
+	callbacks map[string][]client.ChangeFunc
+}
+
+func newFakeConfigs(configs map[string]string) *fakeConfigs {
+	return &fakeConfigs{configs: configs, callbacks: make(map[string][]client.ChangeFunc)}
+}
+
+func (f *fakeConfigs) Get(path string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	config, ok := f.configs[path]
+	if !ok {
+		return "", client.NewNotFoundError(path, nil)
+	}
+	return config, nil
+}
+
+func (f *fakeConfigs) OnChange(path string, fn client.ChangeFunc) error {
+	f.Lock()
+	defer f.Unlock()
+	f.callbacks[path] = append(f.callbacks[path], fn)
+	return nil
+}
+
+func (f *fakeConfigs) set(path string, config string) {
+	f.Lock()
+	f.configs[path] = config
+	callbacks := f.callbacks[path]
+	f.Unlock()
+	for _, fn := range callbacks {
+		fn(path, config, false)
+	}
+}
+
+// lines returns the lines of file, none when it does not exist
+func lines(file string) []string {
+	data, _ := ioutil.ReadFile(file)
+	return strings.Fields(string(data))
+}
+
+// run runs s in the background, returning a channel receiving its exit code
+func run(ctx context.Context, t *testing.T, s *Supervisor) chan int {
+	codes := make(chan int, 1)
+	go func() {
+		code, err := s.Run(ctx)
+		assert.Nil(t, err)
+		codes <- code
+	}()
+	return codes
+}
+
+func waitCode(t *testing.T, codes chan int) int {
+	select {
+	case code := <-codes:
+		return code
+	case <-time.After(5 * time.Second):
+		t.Fatal("the supervisor did not exit")
+	}
+	return 0
+}
+
+func TestNew(t *testing.T) {
+	configs := newFakeConfigs(map[string]string{})
+	s, err := New(Config{Command: []string{"true"}, Files: []File{{Path: "/a", Destination: "/b"}}}, configs, zerolog.Nop())
+	assert.Nil(t, err)
+	assert.Equal(t, defaultPerms, s.cfg.Files[0].Perms)
+	assert.Equal(t, syscall.SIGTERM, s.cfg.StopSignal)
+	assert.Equal(t, DefaultGracePeriod, s.cfg.GracePeriod)
+
+	invalid := []Config{
+		{},
+		{Command: []string{"true"}, Files: []File{{Path: "/a"}}},
+		{Command: []string{"true"}, Files: []File{{Path: "/a", Destination: "/b"}, {Path: "/c", Destination: "/b"}}},
+		{Command: []string{"true"}, Env: []Env{{Name: "A=B", Path: "/a"}}},
+		{Command: []string{"true"}, Env: []Env{{Name: "A"}}},
+		{Command: []string{"true"}, EnvFrom: []EnvFrom{{Path: "/a", Options: envvars.Options{Separator: "-"}}}},
+	}
+	for _, cfg := range invalid {
+		_, err := New(cfg, configs, zerolog.Nop())
+		assert.True(t, IsInvalidConfigError(err))
+	}
+
+	sig, err := ParseSignal("sighup")
+	assert.Nil(t, err)
+	assert.Equal(t, syscall.SIGHUP, sig)
+	_, err = ParseSignal("SIGKILL")
+	assert.True(t, IsInvalidConfigError(err))
+}
+
+func TestRunFailures(t *testing.T) {
+	s, _ := New(Config{Command: []string{"true"}, Env: []Env{{Name: "DB", Path: "/configs/db.yaml"}}}, newFakeConfigs(map[string]string{}), zerolog.Nop())
+	_, err := s.Run(context.Background())
+	assert.True(t, client.IsNotFoundError(err))
+
+	s2, _ := New(Config{Command: []string{"/does/not/exist"}}, newFakeConfigs(map[string]string{}), zerolog.Nop())
+	_, err2 := s2.Run(context.Background())
+	assert.True(t, IsStartError(err2))
+}
+
+func TestRenderFilesAtOnce(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "supervisor-tests")
+	defer os.RemoveAll(dir)
+	db := filepath.Join(dir, "db.yaml")
+	ioutil.WriteFile(db, []byte("host: db1"), 0644)
+	configs := newFakeConfigs(map[string]string{"/configs/db.yaml": "host: db2", "/configs/cache.yaml": "host: cache"})
+	s, err := New(Config{
+		Command: []string{"true"},
+		Files: []File{
+			{Path: "/configs/db.yaml", Destination: db},
+			{Path: "/configs/cache.yaml", Destination: filepath.Join(dir, "missing", "cache.yaml")},
+		},
+	}, configs, zerolog.Nop())
+	assert.Nil(t, err)
+
+	// A file failing to be written leaves the others untouched
+	_, _, err2 := s.render()
+	assert.NotNil(t, err2)
+	data, _ := ioutil.ReadFile(db)
+	assert.Equal(t, "host: db1", string(data))
+}
+
+func TestExitCode(t *testing.T) {
+	s, _ := New(Config{Command: []string{"sh", "-c", "exit 3"}}, newFakeConfigs(map[string]string{}), zerolog.Nop())
+	assert.Equal(t, 3, waitCode(t, run(context.Background(), t, s)))
+}
+
+func TestEnvFrom(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "supervisor-tests")
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	configs := newFakeConfigs(map[string]string{"/configs/db.yaml": "host: db\nport: 5432", "/configs/port": "5433"})
+	s, err := New(Config{
+		Command: []string{"sh", "-c", `echo "$APP_HOST:$APP_PORT" > ` + out},
+		Env:     []Env{{Name: "APP_PORT", Path: "/configs/port"}},
+		EnvFrom: []EnvFrom{{Path: "/configs/db.yaml", Options: envvars.Options{Prefix: "APP"}}},
+	}, configs, zerolog.Nop())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, waitCode(t, run(context.Background(), t, s)))
+	assert.Equal(t, []string{"db:5433"}, lines(out))
+}
+
+func TestRestartAndReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "supervisor-tests")
+	defer os.RemoveAll(dir)
+	starts := filepath.Join(dir, "starts")
+	reloads := filepath.Join(dir, "reloads")
+	file := filepath.Join(dir, "cache.yaml")
+	script := `trap '(cat ` + file + `; echo) >> ` + reloads + `' HUP
+trap 'echo usr1 >> ` + reloads + `' USR1
+trap 'exit 0' TERM
+echo "$DB" >> ` + starts + `
+while true; do sleep 0.05; done`
+	configs := newFakeConfigs(map[string]string{"/configs/db.yaml": "db1", "/configs/cache.yaml": "ttl1"})
+	s, err := New(Config{
+		Command:      []string{"sh", "-c", script},
+		Files:        []File{{Path: "/configs/cache.yaml", Destination: file}},
+		Env:          []Env{{Name: "DB", Path: "/configs/db.yaml"}},
+		ReloadSignal: syscall.SIGHUP,
+	}, configs, zerolog.Nop())
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	codes := run(ctx, t, s)
+	assert.Eventually(t, func() bool { return len(lines(starts)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"db1"}, lines(starts))
+	data, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "ttl1", string(data))
+
+	// Files changes signal the command
+	configs.set("/configs/cache.yaml", "ttl2")
+	assert.Eventually(t, func() bool { return len(lines(reloads)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"ttl2"}, lines(reloads))
+
+	// Environment variable changes restart it
+	configs.set("/configs/db.yaml", "db2")
+	assert.Eventually(t, func() bool { return len(lines(starts)) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"db1", "db2"}, lines(starts))
+
+	// Signals are forwarded
+	s.signals <- syscall.SIGUSR1
+	assert.Eventually(t, func() bool { return len(lines(reloads)) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.Equal(t, 0, waitCode(t, codes))
+}
+
+func TestGracePeriod(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "supervisor-tests")
+	defer os.RemoveAll(dir)
+	started := filepath.Join(dir, "started")
+	s, _ := New(Config{
+		Command:     []string{"sh", "-c", "trap '' TERM; touch " + started + "; while true; do sleep 0.05; done"},
+		GracePeriod: 100 * time.Millisecond,
+	}, newFakeConfigs(map[string]string{}), zerolog.Nop())
+	ctx, cancel := context.WithCancel(context.Background())
+	codes := run(ctx, t, s)
+	assert.Eventually(t, func() bool { _, err := os.Stat(started); return err == nil }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Equal(t, 128+int(syscall.SIGKILL), waitCode(t, codes))
+}
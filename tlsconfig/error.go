@@ -0,0 +1,37 @@
+package tlsconfig
+
+import "fmt"
+
+const (
+	InvalidCertificate ErrType = "INVALID_CERTIFICATE_ERROR"
+	Unknown            ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidCertificateError struct {
+	errType ErrType
+	file    string
+	err     error
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidCertificateError:
+		return InvalidCertificate
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidCertificateError(e error) bool {
+	return getErrorType(e) == InvalidCertificate
+}
+
+func (e InvalidCertificateError) Error() string {
+	return fmt.Sprintf("[%s] Could not load %s: %v", e.errType, e.file, e.err)
+}
+
+func NewInvalidCertificateError(file string, err error) InvalidCertificateError {
+	return InvalidCertificateError{errType: InvalidCertificate, file: file, err: err}
+}
@@ -0,0 +1,174 @@
+// Package tlsconfig builds the TLS configuration of the gonfigd servers,
+// reloading certificates whenever they are rotated on disk
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Reloader holds the current server certificate and client CA pool,
+// and reloads them when their files change
+type Reloader struct {
+	sync.RWMutex
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	cert         *tls.Certificate
+	clientCAs    *x509.CertPool
+	modTimes     map[string]time.Time
+	log          zerolog.Logger
+}
+
+// NewReloader returns a new *Reloader with the certificates already loaded
+// clientCAFile string is optional, when set, clients must present a certificate signed by it (mTLS)
+func NewReloader(certFile string, keyFile string, clientCAFile string, logger zerolog.Logger) (*Reloader, error) {
+	r := &Reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		modTimes:     make(map[string]time.Time),
+		log:          logger,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Files returns the certificate files currently loaded
+func (r *Reloader) Files() (certFile string, keyFile string, clientCAFile string) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.certFile, r.keyFile, r.clientCAFile
+}
+
+func files(certFile string, keyFile string, clientCAFile string) []string {
+	files := []string{certFile, keyFile}
+	if clientCAFile != "" {
+		files = append(files, clientCAFile)
+	}
+	return files
+}
+
+// changed checks whether any of the files has been modified since the last reload
+func (r *Reloader) changed() bool {
+	for _, f := range files(r.Files()) {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		r.RLock()
+		modTime := r.modTimes[f]
+		r.RUnlock()
+		if !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload reads the certificate files again
+// If any of them is invalid, the previous certificates are kept
+func (r *Reloader) Reload() error {
+	return r.SetFiles(r.Files())
+}
+
+// SetFiles loads the certificates in the given files, watching them from now on
+// If any of them is invalid, the previous certificates and their files are kept
+func (r *Reloader) SetFiles(certFile string, keyFile string, clientCAFile string) error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range files(certFile, keyFile, clientCAFile) {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return NewInvalidCertificateError(f, err)
+		}
+		modTimes[f] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return NewInvalidCertificateError(certFile, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return NewInvalidCertificateError(clientCAFile, err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return NewInvalidCertificateError(clientCAFile, fmt.Errorf("no PEM certificates found"))
+		}
+	}
+
+	r.Lock()
+	r.certFile = certFile
+	r.keyFile = keyFile
+	r.clientCAFile = clientCAFile
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	r.Unlock()
+	return nil
+}
+
+// Certificate returns the current server certificate
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert
+}
+
+// TLSConfig returns a *tls.Config always serving the latest certificates
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.RLock()
+			defer r.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				cfg.ClientCAs = r.clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// Watch checks the certificate files every interval, reloading them when they change
+// A failed reload keeps serving the previous certificates
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+			if !r.changed() {
+				break
+			}
+			if err := r.Reload(); err != nil {
+				r.log.Error().Msgf("failed to reload TLS certificates, keeping the previous ones: %v", err)
+				break
+			}
+			certFile, _, _ := r.Files()
+			r.log.Info().Msgf("TLS certificates reloaded from %s", certFile)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
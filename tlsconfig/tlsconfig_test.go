@@ -0,0 +1,96 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSelfSigned writes a new self-signed certificate with the given serial number and its key
+func writeSelfSigned(certFile string, keyFile string, serial int64) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "gonfigd"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func serialOf(cert *tls.Certificate) int64 {
+	c, _ := x509.ParseCertificate(cert.Certificate[0])
+	return c.SerialNumber.Int64()
+}
+
+func TestReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tlsconfig-tests")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	_, err := NewReloader(certFile, keyFile, "", zerolog.Nop())
+	assert.True(t, IsInvalidCertificateError(err))
+
+	writeSelfSigned(certFile, keyFile, 1)
+	r, err2 := NewReloader(certFile, keyFile, certFile, zerolog.Nop())
+	assert.Nil(t, err2)
+	assert.Equal(t, int64(1), serialOf(r.Certificate()))
+
+	cfg, err3 := r.TLSConfig().GetConfigForClient(nil)
+	assert.Nil(t, err3)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	assert.NotNil(t, cfg.ClientCAs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	// Make sure the modification time changes even on coarse-grained filesystems
+	time.Sleep(10 * time.Millisecond)
+	writeSelfSigned(certFile, keyFile, 2)
+	future := time.Now().Add(time.Second)
+	os.Chtimes(certFile, future, future)
+
+	assert.Eventually(t, func() bool {
+		return serialOf(r.Certificate()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	future = future.Add(time.Second)
+	os.Chtimes(certFile, future, future)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(2), serialOf(r.Certificate()))
+
+	// Switching to other files keeps the current ones when the new certificates are invalid
+	otherCert, otherKey := filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key")
+	assert.True(t, IsInvalidCertificateError(r.SetFiles(otherCert, otherKey, "")))
+	writeSelfSigned(otherCert, otherKey, 3)
+	assert.Nil(t, r.SetFiles(otherCert, otherKey, ""))
+	assert.Equal(t, int64(3), serialOf(r.Certificate()))
+	cert, key, ca := r.Files()
+	assert.Equal(t, []string{otherCert, otherKey, ""}, []string{cert, key, ca})
+	cfg2, _ := r.TLSConfig().GetConfigForClient(nil)
+	assert.Equal(t, tls.NoClientCert, cfg2.ClientAuth)
+}
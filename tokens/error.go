@@ -0,0 +1,55 @@
+package tokens
+
+import "fmt"
+
+const (
+	InvalidToken      ErrType = "INVALID_TOKEN_ERROR"
+	InvalidTokenStore ErrType = "INVALID_TOKEN_STORE_ERROR"
+	Unknown           ErrType = "UNKNOWN_ERROR"
+)
+
+type ErrType string
+
+type InvalidTokenError struct {
+	errType ErrType
+}
+
+type InvalidTokenStoreError struct {
+	errType ErrType
+	reason  string
+}
+
+func getErrorType(e error) ErrType {
+	switch e.(type) {
+	case InvalidTokenError:
+		return InvalidToken
+	case InvalidTokenStoreError:
+		return InvalidTokenStore
+	default:
+		return Unknown
+	}
+}
+
+func IsInvalidTokenError(e error) bool {
+	return getErrorType(e) == InvalidToken
+}
+
+func IsInvalidTokenStoreError(e error) bool {
+	return getErrorType(e) == InvalidTokenStore
+}
+
+func (e InvalidTokenError) Error() string {
+	return fmt.Sprintf("[%s] Token is not valid", e.errType)
+}
+
+func (e InvalidTokenStoreError) Error() string {
+	return fmt.Sprintf("[%s] Invalid token store: %s", e.errType, e.reason)
+}
+
+func NewInvalidTokenError() InvalidTokenError {
+	return InvalidTokenError{errType: InvalidToken}
+}
+
+func NewInvalidTokenStoreError(reason string) InvalidTokenStoreError {
+	return InvalidTokenStoreError{errType: InvalidTokenStore, reason: reason}
+}
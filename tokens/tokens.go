@@ -0,0 +1,174 @@
+// Package tokens authenticates callers presenting bearer tokens (API keys)
+//
+// Tokens are never stored in plaintext, the store file only keeps their SHA-256:
+//
+//	tokens:
+//	  - name: deployer
+//	    hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	    scopes: ["get", "watch"]
+package tokens
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+)
+
+// Token is a named API key, restricted to a set of verbs
+type Token struct {
+	Name   string     `yaml:"name"`
+	Hash   string     `yaml:"hash"`
+	Scopes []acl.Verb `yaml:"scopes"`
+
+	hash []byte
+}
+
+// Allows checks whether verb is within the token scopes
+func (t *Token) Allows(verb acl.Verb) bool {
+	for _, s := range t.Scopes {
+		if s == verb || s == acl.Any {
+			return true
+		}
+	}
+	return false
+}
+
+type storeFile struct {
+	Tokens []*Token `yaml:"tokens"`
+}
+
+// Hash returns the hex encoded SHA-256 of token, as expected in the store file
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseStore(data []byte) ([]*Token, error) {
+	sf := &storeFile{}
+	if err := yaml.UnmarshalStrict(data, sf); err != nil {
+		return nil, NewInvalidTokenStoreError(err.Error())
+	}
+	names := make(map[string]struct{})
+	for i, t := range sf.Tokens {
+		if t.Name == "" {
+			return nil, NewInvalidTokenStoreError(fmt.Sprintf("token %d has no name", i))
+		}
+		if _, ok := names[t.Name]; ok {
+			return nil, NewInvalidTokenStoreError(fmt.Sprintf("token %s is duplicated", t.Name))
+		}
+		names[t.Name] = struct{}{}
+		h, err := hex.DecodeString(t.Hash)
+		if err != nil || len(h) != sha256.Size {
+			return nil, NewInvalidTokenStoreError(fmt.Sprintf("token %s hash is not a hex encoded SHA-256", t.Name))
+		}
+		t.hash = h
+	}
+	return sf.Tokens, nil
+}
+
+// Store holds the tokens loaded from a file, reloading them when the file changes
+type Store struct {
+	sync.RWMutex
+	file    string
+	tokens  []*Token
+	modTime time.Time
+	log     zerolog.Logger
+}
+
+// NewStore returns a new *Store with the tokens in file already loaded
+func NewStore(file string, logger zerolog.Logger) (*Store, error) {
+	s := &Store{file: file, log: logger}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// File returns the store file currently loaded
+func (s *Store) File() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.file
+}
+
+// Reload reads the store file again
+// If the new file is invalid, the previous tokens are kept
+func (s *Store) Reload() error {
+	return s.SetFile(s.File())
+}
+
+// SetFile loads the tokens in file, watching file from now on
+// If the new file is invalid, the previous tokens and their file are kept
+func (s *Store) SetFile(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return NewInvalidTokenStoreError(err.Error())
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return NewInvalidTokenStoreError(err.Error())
+	}
+	tokens, err := parseStore(data)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.file = file
+	s.tokens = tokens
+	s.modTime = fi.ModTime()
+	s.Unlock()
+	return nil
+}
+
+// Authenticate returns the Token matching the plaintext token,
+// or InvalidTokenError if there is none
+func (s *Store) Authenticate(token string) (*Token, error) {
+	sum := sha256.Sum256([]byte(token))
+	s.RLock()
+	defer s.RUnlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(sum[:], t.hash) == 1 {
+			return t, nil
+		}
+	}
+	return nil, NewInvalidTokenError()
+}
+
+func (s *Store) changed() bool {
+	fi, err := os.Stat(s.File())
+	if err != nil {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return !fi.ModTime().Equal(s.modTime)
+}
+
+// Watch checks the store file every interval, reloading it when it changes
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+			if !s.changed() {
+				break
+			}
+			if err := s.Reload(); err != nil {
+				s.log.Error().Msgf("failed to reload token store, keeping the previous tokens: %v", err)
+				break
+			}
+			s.log.Info().Msgf("token store reloaded from %s", s.File())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package tokens
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fcgravalos/gonfigd/acl"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tokens-tests")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens.yaml")
+
+	_, err := NewStore(file, zerolog.Nop())
+	assert.True(t, IsInvalidTokenStoreError(err))
+
+	ioutil.WriteFile(file, []byte(fmt.Sprintf("tokens:\n  - name: deployer\n    hash: %s\n    scopes: [\"get\", \"write\"]\n", Hash("s3cr3t"))), 0600)
+	s, err2 := NewStore(file, zerolog.Nop())
+	assert.Nil(t, err2)
+
+	tk, err3 := s.Authenticate("s3cr3t")
+	assert.Nil(t, err3)
+	assert.Equal(t, "deployer", tk.Name)
+	assert.True(t, tk.Allows(acl.Get))
+	assert.True(t, tk.Allows(acl.Write))
+	assert.False(t, tk.Allows(acl.Watch))
+
+	tk2, err4 := s.Authenticate("wrong")
+	assert.Nil(t, tk2)
+	assert.EqualError(t, err4, fmt.Sprintf("[%s] Token is not valid", InvalidToken))
+
+	ioutil.WriteFile(file, []byte("tokens:\n  - name: broken\n    hash: plaintext\n"), 0600)
+	err5 := s.Reload()
+	assert.EqualError(t, err5, fmt.Sprintf("[%s] Invalid token store: token broken hash is not a hex encoded SHA-256", InvalidTokenStore))
+	_, err6 := s.Authenticate("s3cr3t")
+	assert.Nil(t, err6)
+
+	// Switching to another file keeps the current one when the new file is invalid
+	other := filepath.Join(dir, "other.yaml")
+	assert.True(t, IsInvalidTokenStoreError(s.SetFile(other)))
+	assert.Equal(t, file, s.File())
+	ioutil.WriteFile(other, []byte(fmt.Sprintf("tokens:\n  - name: reader\n    hash: %s\n    scopes: [\"get\"]\n", Hash("other"))), 0600)
+	assert.Nil(t, s.SetFile(other))
+	assert.Equal(t, other, s.File())
+	_, err7 := s.Authenticate("s3cr3t")
+	assert.True(t, IsInvalidTokenError(err7))
+	tk3, err8 := s.Authenticate("other")
+	assert.Nil(t, err8)
+	assert.Equal(t, "reader", tk3.Name)
+}
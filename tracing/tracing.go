@@ -0,0 +1,63 @@
+// Package tracing sets up OpenTelemetry tracing, exporting spans to an OTLP collector
+package tracing
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	// ServiceName is the name gonfigd spans are reported with
+	ServiceName = "gonfigd"
+	// instrumentationName identifies the gonfigd tracer
+	instrumentationName = "github.com/fcgravalos/gonfigd"
+	// batchTimeout is the maximum time spans wait before being exported
+	batchTimeout = time.Second
+)
+
+// Tracer returns the gonfigd tracer.
+// It is a no-op tracer until Init is called.
+func Tracer() trace.Tracer {
+	return global.Tracer(instrumentationName)
+}
+
+// ConfigPath returns the span attribute carrying a config path
+func ConfigPath(path string) kv.KeyValue {
+	return kv.String("gonfigd.config_path", path)
+}
+
+// Init registers a global trace provider sending every span to the OTLP collector at addr
+// The returned function flushes the pending spans and stops the exporter
+func Init(addr string) (func(), error) {
+	exp, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(addr))
+	if err != nil {
+		return nil, err
+	}
+	bsp, err := sdktrace.NewBatchSpanProcessor(exp, sdktrace.WithBatchTimeout(batchTimeout))
+	if err != nil {
+		exp.Stop()
+		return nil, err
+	}
+	tp, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithResource(resource.New(standard.ServiceNameKey.String(ServiceName))),
+	)
+	if err != nil {
+		exp.Stop()
+		return nil, err
+	}
+	tp.RegisterSpanProcessor(bsp)
+	global.SetTraceProvider(tp)
+
+	return func() {
+		tp.UnregisterSpanProcessor(bsp)
+		exp.Stop()
+	}, nil
+}
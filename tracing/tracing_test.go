@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	coltracepb "github.com/open-telemetry/opentelemetry-proto/gen/go/collector/trace/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// collector is a stand-in OTLP collector keeping the names of the spans it receives
+type collector struct {
+	sync.Mutex
+	spans []string
+}
+
+func (c *collector) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.Lock()
+	defer c.Unlock()
+	for _, rs := range req.GetResourceSpans() {
+		for _, ils := range rs.GetInstrumentationLibrarySpans() {
+			for _, s := range ils.GetSpans() {
+				c.spans = append(c.spans, s.GetName())
+			}
+		}
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func (c *collector) received() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string{}, c.spans...)
+}
+
+func TestInit(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	col := &collector{}
+	srv := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(srv, col)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	shutdown, err2 := Init(lis.Addr().String())
+	assert.Nil(t, err2)
+	defer shutdown()
+
+	ctx, parent := Tracer().Start(context.Background(), "fswatcher.WRITE")
+	_, child := Tracer().Start(ctx, "pubsub.Publish")
+	child.End()
+	parent.End()
+
+	assert.Eventually(t, func() bool {
+		return len(col.received()) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.ElementsMatch(t, []string{"fswatcher.WRITE", "pubsub.Publish"}, col.received())
+}